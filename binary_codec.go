@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Compact binary payload (decrypted plaintext), selected by its first byte.
+// CSV payloads always start with a printable character, so the version byte
+// cannot collide with them.
+//
+//	version      byte    binaryPayloadV1
+//	flags        byte    bit0: sequence present, bit1: timestamps present
+//	device id    uvarint length + bytes
+//	sequence     uvarint (if flagged)
+//	fix count    uvarint
+//	per fix:
+//	  fields     byte    presence bits for the optional fields below
+//	  time       first fix: uvarint unix ms; others: zigzag varint ms delta
+//	  lat, lng   first fix: zigzag varint degrees*1e7; others: deltas
+//	  optional   in bit order: speed uvarint (0.1 km/h), heading uvarint
+//	             (0.1°), altitude zigzag varint (0.1 m), hdop uvarint (0.01),
+//	             satellites uvarint, battery uvarint (mV)
+//
+// Deltas are taken against the previous fix of the same payload, so a batch
+// of nearby fixes costs a few bytes each.
+const binaryPayloadV1 = 0x01
+
+const (
+	binaryFlagSequence   = 1 << 0
+	binaryFlagTimestamps = 1 << 1
+)
+
+const (
+	binaryFieldSpeed = 1 << iota
+	binaryFieldHeading
+	binaryFieldAltitude
+	binaryFieldHDOP
+	binaryFieldSatellites
+	binaryFieldBattery
+)
+
+const coordinateScale = 1e7
+
+func isBinaryPayload(data []byte) bool {
+	return len(data) > 0 && data[0] == binaryPayloadV1
+}
+
+// encodeBinaryPayload produces the compact form of a payload. Fixes must be
+// in chronological order and, when more than one is sent, carry timestamps.
+// It is the reference encoder for firmware and tests.
+func encodeBinaryPayload(payload *Payload) ([]byte, error) {
+	if payload.DeviceID == "" {
+		return nil, fmt.Errorf("empty device id")
+	}
+	if len(payload.Fixes) == 0 {
+		return nil, fmt.Errorf("payload without fixes")
+	}
+
+	withTime := !payload.Fixes[0].Timestamp.IsZero()
+	for _, fix := range payload.Fixes {
+		if fix.Timestamp.IsZero() == withTime {
+			return nil, fmt.Errorf("either all fixes or none must carry a timestamp")
+		}
+	}
+	if !withTime && len(payload.Fixes) > 1 {
+		return nil, fmt.Errorf("batched fixes need timestamps")
+	}
+	for i, fix := range payload.Fixes {
+		if err := checkBinaryFix(fix); err != nil {
+			return nil, fmt.Errorf("fix %d: %w", i+1, err)
+		}
+	}
+
+	var flags byte
+	if payload.Sequence != nil {
+		flags |= binaryFlagSequence
+	}
+	if withTime {
+		flags |= binaryFlagTimestamps
+	}
+
+	buf := []byte{binaryPayloadV1, flags}
+	buf = binary.AppendUvarint(buf, uint64(len(payload.DeviceID)))
+	buf = append(buf, payload.DeviceID...)
+	if payload.Sequence != nil {
+		buf = binary.AppendUvarint(buf, *payload.Sequence)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(payload.Fixes)))
+
+	var prevTime, prevLat, prevLng int64
+	for i, fix := range payload.Fixes {
+		var fields byte
+		if fix.Speed != nil {
+			fields |= binaryFieldSpeed
+		}
+		if fix.Heading != nil {
+			fields |= binaryFieldHeading
+		}
+		if fix.Altitude != nil {
+			fields |= binaryFieldAltitude
+		}
+		if fix.HDOP != nil {
+			fields |= binaryFieldHDOP
+		}
+		if fix.Satellites != nil {
+			fields |= binaryFieldSatellites
+		}
+		if fix.BatteryVoltage != nil {
+			fields |= binaryFieldBattery
+		}
+		buf = append(buf, fields)
+
+		lat := int64(math.Round(fix.Latitude * coordinateScale))
+		lng := int64(math.Round(fix.Longitude * coordinateScale))
+		if withTime {
+			ms := fix.Timestamp.UnixMilli()
+			if i == 0 {
+				buf = binary.AppendUvarint(buf, uint64(ms))
+			} else {
+				buf = binary.AppendVarint(buf, ms-prevTime)
+			}
+			prevTime = ms
+		}
+		buf = binary.AppendVarint(buf, lat-prevLat)
+		buf = binary.AppendVarint(buf, lng-prevLng)
+		prevLat, prevLng = lat, lng
+
+		if fix.Speed != nil {
+			buf = binary.AppendUvarint(buf, uint64(math.Round(*fix.Speed*10)))
+		}
+		if fix.Heading != nil {
+			buf = binary.AppendUvarint(buf, uint64(math.Round(*fix.Heading*10)))
+		}
+		if fix.Altitude != nil {
+			buf = binary.AppendVarint(buf, int64(math.Round(*fix.Altitude*10)))
+		}
+		if fix.HDOP != nil {
+			buf = binary.AppendUvarint(buf, uint64(math.Round(*fix.HDOP*100)))
+		}
+		if fix.Satellites != nil {
+			buf = binary.AppendUvarint(buf, uint64(*fix.Satellites))
+		}
+		if fix.BatteryVoltage != nil {
+			buf = binary.AppendUvarint(buf, uint64(math.Round(*fix.BatteryVoltage*1000)))
+		}
+	}
+	return buf, nil
+}
+
+// checkBinaryFix rejects fields the wire format cannot carry, which would
+// otherwise wrap around when converted to unsigned varints, and fields the
+// decoder would reject.
+func checkBinaryFix(fix *LocationPacket) error {
+	if !fix.Timestamp.IsZero() && fix.Timestamp.UnixMilli() < 0 {
+		return fmt.Errorf("timestamp before 1970: %s", fix.Timestamp.Format(time.RFC3339))
+	}
+	if !(fix.Latitude >= -90 && fix.Latitude <= 90 && fix.Longitude >= -180 && fix.Longitude <= 180) {
+		return fmt.Errorf("out-of-range coordinates: lat=%f, lng=%f", fix.Latitude, fix.Longitude)
+	}
+
+	unsigned := []struct {
+		name  string
+		value *float64
+		scale float64
+		limit float64
+	}{
+		{"speed", fix.Speed, 10, math.MaxInt64},
+		{"heading", fix.Heading, 10, 3600},
+		{"hdop", fix.HDOP, 100, math.MaxInt64},
+		{"battery voltage", fix.BatteryVoltage, 1000, math.MaxInt64},
+	}
+	for _, field := range unsigned {
+		if field.value == nil {
+			continue
+		}
+		if scaled := math.Round(*field.value * field.scale); !(scaled >= 0 && scaled < field.limit) {
+			return fmt.Errorf("%s out of range: %f", field.name, *field.value)
+		}
+	}
+	if fix.Altitude != nil {
+		if scaled := math.Round(*fix.Altitude * 10); !(scaled > math.MinInt64 && scaled < math.MaxInt64) {
+			return fmt.Errorf("altitude out of range: %f", *fix.Altitude)
+		}
+	}
+	if fix.Satellites != nil && *fix.Satellites < 0 {
+		return fmt.Errorf("satellites out of range: %d", *fix.Satellites)
+	}
+	return nil
+}
+
+// binaryReader walks a payload, remembering the first decoding error so
+// callers can check once at the end.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = fmt.Errorf("truncated payload")
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("malformed uvarint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("malformed varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.data)) < n {
+		r.err = fmt.Errorf("truncated payload")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// Fixed-width big-endian reads, for the third-party binary protocols.
+
+func (r *binaryReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func decodeBinaryPayload(data []byte) (*Payload, error) {
+	return decodeBinary(data, false)
+}
+
+// decodeBinary decodes a compact payload; with anonymous set the device id
+// may be empty, for transports that identify the device themselves.
+func decodeBinary(data []byte, anonymous bool) (*Payload, error) {
+	r := &binaryReader{data: data}
+	if version := r.byte(); version != binaryPayloadV1 {
+		return nil, fmt.Errorf("unsupported binary payload version %d", version)
+	}
+	flags := r.byte()
+
+	payload := &Payload{DeviceID: string(r.bytes(r.uvarint()))}
+	if flags&binaryFlagSequence != 0 {
+		seq := r.uvarint()
+		payload.Sequence = &seq
+	}
+	count := r.uvarint()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if payload.DeviceID == "" && !anonymous {
+		return nil, fmt.Errorf("empty device id")
+	}
+	// Each fix takes at least three bytes; reject counts the data cannot hold
+	if count == 0 || count > uint64(len(r.data))/3 {
+		return nil, fmt.Errorf("invalid fix count %d", count)
+	}
+	withTime := flags&binaryFlagTimestamps != 0
+	if !withTime && count > 1 {
+		return nil, fmt.Errorf("batched fixes need timestamps")
+	}
+
+	var prevTime, lat, lng int64
+	for i := uint64(0); i < count; i++ {
+		fields := r.byte()
+		fix := &LocationPacket{DeviceID: payload.DeviceID}
+
+		if withTime {
+			if i == 0 {
+				prevTime = int64(r.uvarint())
+			} else {
+				prevTime += r.varint()
+			}
+			fix.Timestamp = time.UnixMilli(prevTime).UTC()
+		}
+		lat += r.varint()
+		lng += r.varint()
+		fix.Latitude = float64(lat) / coordinateScale
+		fix.Longitude = float64(lng) / coordinateScale
+
+		if fields&binaryFieldSpeed != 0 {
+			v := float64(r.uvarint()) / 10
+			fix.Speed = &v
+		}
+		if fields&binaryFieldHeading != 0 {
+			v := float64(r.uvarint()) / 10
+			fix.Heading = &v
+		}
+		if fields&binaryFieldAltitude != 0 {
+			v := float64(r.varint()) / 10
+			fix.Altitude = &v
+		}
+		if fields&binaryFieldHDOP != 0 {
+			v := float64(r.uvarint()) / 100
+			fix.HDOP = &v
+		}
+		if fields&binaryFieldSatellites != 0 {
+			v := int(r.uvarint())
+			fix.Satellites = &v
+		}
+		if fields&binaryFieldBattery != 0 {
+			v := float64(r.uvarint()) / 1000
+			fix.BatteryVoltage = &v
+		}
+
+		if r.err != nil {
+			return nil, fmt.Errorf("fix %d: %w", i+1, r.err)
+		}
+		if fix.Latitude < -90 || fix.Latitude > 90 || fix.Longitude < -180 || fix.Longitude > 180 {
+			return nil, fmt.Errorf("fix %d: out-of-range coordinates: lat=%f, lng=%f", i+1, fix.Latitude, fix.Longitude)
+		}
+		if fix.Heading != nil && *fix.Heading >= 360 {
+			return nil, fmt.Errorf("fix %d: heading out of range: %f", i+1, *fix.Heading)
+		}
+		payload.Fixes = append(payload.Fixes, fix)
+	}
+
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(r.data))
+	}
+	return payload, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func float64Ptr(v float64) *float64 { return &v }
+func intPtr(v int) *int             { return &v }
+func uint64Ptr(v uint64) *uint64    { return &v }
+
+func TestBinaryPayloadRoundTrip(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		payload *Payload
+	}{
+		{
+			name: "single fix without timestamp",
+			payload: &Payload{
+				DeviceID: "truck-7",
+				Fixes: []*LocationPacket{
+					{Latitude: 40.4167754, Longitude: -3.7037902},
+				},
+			},
+		},
+		{
+			name: "batch with sequence and every field",
+			payload: &Payload{
+				DeviceID: "tracker-001",
+				Sequence: uint64Ptr(4242),
+				Fixes: []*LocationPacket{
+					{
+						Timestamp: start, Latitude: -33.8688197, Longitude: 151.2092955,
+						Speed: float64Ptr(52.3), Heading: float64Ptr(359.9), Altitude: float64Ptr(-12.5),
+						HDOP: float64Ptr(0.87), Satellites: intPtr(11), BatteryVoltage: float64Ptr(3.912),
+					},
+					{
+						Timestamp: start.Add(10 * time.Second), Latitude: -33.8690001, Longitude: 151.2100002,
+						Speed: float64Ptr(0),
+					},
+					{
+						Timestamp: start.Add(25*time.Second + 500*time.Millisecond), Latitude: -33.87, Longitude: 151.21,
+						Satellites: intPtr(0),
+					},
+				},
+			},
+		},
+		{
+			name: "coordinates at the limits",
+			payload: &Payload{
+				DeviceID: "polar",
+				Sequence: uint64Ptr(0),
+				Fixes: []*LocationPacket{
+					{Timestamp: start, Latitude: 90, Longitude: -180},
+					{Timestamp: start.Add(time.Hour), Latitude: -90, Longitude: 180},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, fix := range tt.payload.Fixes {
+				fix.DeviceID = tt.payload.DeviceID
+			}
+
+			data, err := encodeBinaryPayload(tt.payload)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if !isBinaryPayload(data) {
+				t.Fatalf("encoded payload starts with %#x, not the version byte", data[0])
+			}
+
+			got, err := decodeBinaryPayload(data)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.payload) {
+				t.Errorf("decode(encode(x)) = %+v, want %+v", got, tt.payload)
+				for i := range got.Fixes {
+					t.Logf("fix %d: got %+v, want %+v", i, got.Fixes[i], tt.payload.Fixes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeBinaryPayloadTruncated(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	data, err := encodeBinaryPayload(&Payload{
+		DeviceID: "tracker-001",
+		Sequence: uint64Ptr(300),
+		Fixes: []*LocationPacket{
+			{Timestamp: start, Latitude: 51.5072178, Longitude: -0.1275862, Speed: float64Ptr(12), HDOP: float64Ptr(1.2)},
+			{Timestamp: start.Add(5 * time.Second), Latitude: 51.5073, Longitude: -0.1276, BatteryVoltage: float64Ptr(4.1)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	for n := 0; n < len(data); n++ {
+		if _, err := decodeBinaryPayload(data[:n]); err == nil {
+			t.Errorf("decoding the first %d of %d bytes succeeded", n, len(data))
+		}
+	}
+}
+
+func TestDecodeBinaryPayloadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"wrong version", []byte{0x02, 0x00, 0x01, 'a', 0x01, 0x00, 0x00, 0x00}, "unsupported binary payload version"},
+		{"empty device id", []byte{0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}, "empty device id"},
+		{"device id longer than payload", []byte{0x01, 0x00, 0x10, 'a', 'b'}, "truncated payload"},
+		{"zero fixes", []byte{0x01, 0x00, 0x01, 'a', 0x00}, "invalid fix count 0"},
+		{"more fixes than bytes", []byte{0x01, 0x02, 0x01, 'a', 0x05, 0x00, 0x00, 0x00, 0x00}, "invalid fix count 5"},
+		{"batch without timestamps", []byte{0x01, 0x00, 0x01, 'a', 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, "batched fixes need timestamps"},
+		{"trailing bytes", []byte{0x01, 0x00, 0x01, 'a', 0x01, 0x00, 0x00, 0x00, 0xff}, "1 trailing bytes"},
+		// lat = zigzag(2e9) = 4e9, beyond 90 degrees
+		{"latitude out of range", []byte{0x01, 0x00, 0x01, 'a', 0x01, 0x00, 0x80, 0xd0, 0xac, 0xf3, 0x0e, 0x00}, "out-of-range coordinates"},
+		// heading 3600 (360.0 degrees)
+		{"heading out of range", []byte{0x01, 0x00, 0x01, 'a', 0x01, binaryFieldHeading, 0x00, 0x00, 0x90, 0x1c}, "heading out of range"},
+		{"malformed varint", []byte{0x01, 0x00, 0x01, 'a', 0x01, 0x00, 0xff, 0xff, 0xff}, "malformed varint"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeBinaryPayload(tt.data)
+			if err == nil {
+				t.Fatalf("decode succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeBinaryPayloadInvalid(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		payload *Payload
+	}{
+		{"empty device id", &Payload{Fixes: []*LocationPacket{{}}}},
+		{"no fixes", &Payload{DeviceID: "a"}},
+		{"mixed timestamps", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{Timestamp: now}, {}}}},
+		{"batch without timestamps", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{}, {}}}},
+		{"negative speed", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{Speed: float64Ptr(-1)}}}},
+		{"negative heading", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{Heading: float64Ptr(-0.5)}}}},
+		{"heading rounding to 360", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{Heading: float64Ptr(359.96)}}}},
+		{"negative hdop", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{HDOP: float64Ptr(-0.01)}}}},
+		{"negative battery", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{BatteryVoltage: float64Ptr(-3.7)}}}},
+		{"negative satellites", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{Satellites: intPtr(-1)}}}},
+		{"NaN speed", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{Speed: float64Ptr(math.NaN())}}}},
+		{"infinite altitude", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{Altitude: float64Ptr(math.Inf(1))}}}},
+		{"latitude out of range", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{Latitude: 91}}}},
+		{"timestamp before 1970", &Payload{DeviceID: "a", Fixes: []*LocationPacket{{Timestamp: time.Unix(-1, 0)}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := encodeBinaryPayload(tt.payload); err == nil {
+				t.Error("encode succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Downlink commands are queued per device and delivered in the reply to the
+// device's next native uplink, sealed with the key the device used:
+//
+//	cmd,<id>,<command>[,<param>...]   (one line per command)
+//
+// The device confirms in a later packet with cack=<id> (or cack=<id>:<result>,
+// where any result other than "ok" marks the command failed). Commands not
+// confirmed within commandResendInterval are redelivered with a following
+// uplink, up to maxCommandAttempts times.
+const (
+	commandPending      = "pending"
+	commandSent         = "sent"
+	commandAcknowledged = "acknowledged"
+	commandFailed       = "failed"
+	commandCancelled    = "cancelled"
+
+	maxCommandAttempts    = 5
+	maxCommandsPerSend    = 8
+	commandResendInterval = 30 * time.Second
+)
+
+// Command names and parameters travel inside CSV lines
+var (
+	commandNamePattern  = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+	commandParamPattern = regexp.MustCompile(`^[^,\n]{0,64}$`)
+)
+
+type DeviceCommand struct {
+	ID             int        `json:"id"`
+	DeviceID       string     `json:"device_id"`
+	Command        string     `json:"command"`
+	Params         []string   `json:"params"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	Result         *string    `json:"result,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+}
+
+// CommandAck is a device's confirmation of a command, from cack=<id>[:<result>].
+type CommandAck struct {
+	ID     int
+	OK     bool
+	Result string
+}
+
+func parseCommandAck(value string) (CommandAck, error) {
+	idStr, result, _ := strings.Cut(value, ":")
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id <= 0 {
+		return CommandAck{}, fmt.Errorf("invalid cack: %q", value)
+	}
+	if result == "" {
+		result = "ok"
+	}
+	return CommandAck{ID: id, OK: result == "ok", Result: result}, nil
+}
+
+const deviceCommandColumns = `id, device_id, command, params, status, attempts, result,
+	created_at, sent_at, acknowledged_at`
+
+func scanDeviceCommand(row rowScanner) (*DeviceCommand, error) {
+	var cmd DeviceCommand
+	var params []byte
+	var result sql.NullString
+	var sentAt, acknowledgedAt sql.NullTime
+	if err := row.Scan(&cmd.ID, &cmd.DeviceID, &cmd.Command, &params, &cmd.Status, &cmd.Attempts,
+		&result, &cmd.CreatedAt, &sentAt, &acknowledgedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(params, &cmd.Params); err != nil {
+		return nil, err
+	}
+	if cmd.Params == nil {
+		cmd.Params = []string{}
+	}
+	if result.Valid {
+		cmd.Result = &result.String
+	}
+	cmd.SentAt = nullTimePtr(sentAt)
+	cmd.AcknowledgedAt = nullTimePtr(acknowledgedAt)
+	return &cmd, nil
+}
+
+// CommandQueue delivers queued commands and records their outcome. Every
+// state change is pushed to WebSocket clients as a message with
+// "type": "command".
+type CommandQueue struct {
+	db    *Database
+	wsHub *WebSocketHub
+}
+
+func NewCommandQueue(db *Database, wsHub *WebSocketHub) *CommandQueue {
+	return &CommandQueue{db: db, wsHub: wsHub}
+}
+
+func (cq *CommandQueue) broadcast(cmd *DeviceCommand) {
+	cq.wsHub.Broadcast(struct {
+		Type string `json:"type"`
+		*DeviceCommand
+	}{"command", cmd})
+}
+
+// queryCommands runs a statement returning deviceCommandColumns and
+// broadcasts every returned command.
+func (cq *CommandQueue) queryCommands(query string, args ...interface{}) ([]*DeviceCommand, error) {
+	rows, err := cq.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []*DeviceCommand
+	for rows.Next() {
+		cmd, err := scanDeviceCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range commands {
+		cq.broadcast(cmd)
+	}
+	return commands, nil
+}
+
+// deliver marks the device's outstanding commands as sent and returns them,
+// oldest first. Commands that used up their attempts fail instead.
+func (cq *CommandQueue) deliver(deviceID string) ([]*DeviceCommand, error) {
+	failed, err := cq.queryCommands(fmt.Sprintf(`
+		UPDATE device_commands
+		SET status = $3, result = 'no acknowledgement after %d attempts'
+		WHERE device_id = $1 AND status = $2 AND attempts >= %d
+		RETURNING %s
+	`, maxCommandAttempts, maxCommandAttempts, deviceCommandColumns), deviceID, commandSent, commandFailed)
+	if err != nil {
+		return nil, err
+	}
+	for _, cmd := range failed {
+		log.Printf("⚠️  Command %d (%s) for %s failed: no acknowledgement", cmd.ID, cmd.Command, deviceID)
+	}
+
+	commands, err := cq.queryCommands(fmt.Sprintf(`
+		UPDATE device_commands
+		SET status = $2, attempts = attempts + 1, sent_at = NOW()
+		WHERE id IN (
+			SELECT id FROM device_commands
+			WHERE device_id = $1 AND attempts < %d
+			  AND (status = $3 OR (status = $2 AND sent_at < NOW() - INTERVAL '%d seconds'))
+			ORDER BY id
+			LIMIT %d
+		)
+		RETURNING %s
+	`, maxCommandAttempts, int(commandResendInterval.Seconds()), maxCommandsPerSend, deviceCommandColumns),
+		deviceID, commandSent, commandPending)
+	if err != nil {
+		return nil, err
+	}
+
+	// UPDATE ... RETURNING does not preserve the subquery order
+	sort.Slice(commands, func(i, j int) bool { return commands[i].ID < commands[j].ID })
+	return commands, nil
+}
+
+// acknowledge records the device's confirmations. Acks for commands that are
+// not outstanding (cancelled, already confirmed, another device's) are ignored.
+func (cq *CommandQueue) acknowledge(deviceID string, acks []CommandAck) {
+	for _, ack := range acks {
+		status := commandAcknowledged
+		if !ack.OK {
+			status = commandFailed
+		}
+
+		commands, err := cq.queryCommands(fmt.Sprintf(`
+			UPDATE device_commands
+			SET status = $3, result = $4, acknowledged_at = NOW()
+			WHERE id = $1 AND device_id = $2 AND status IN ($5, $6)
+			RETURNING %s
+		`, deviceCommandColumns), ack.ID, deviceID, status, ack.Result, commandPending, commandSent)
+		if err != nil {
+			log.Printf("Error acknowledging command %d for %s: %v", ack.ID, deviceID, err)
+			continue
+		}
+		if len(commands) > 0 {
+			log.Printf("📬 Command %d (%s) %s by %s", ack.ID, commands[0].Command, status, deviceID)
+		}
+	}
+}
+
+// commandDownlink returns the device's outstanding commands sealed with the
+// key its packet used, or nil when there is nothing to send.
+func (ing *Ingestor) commandDownlink(payload *Payload) []byte {
+	if payload.key == nil {
+		return nil
+	}
+
+	commands, err := ing.commands.deliver(payload.DeviceID)
+	if err != nil {
+		log.Printf("Error loading commands for %s: %v", payload.DeviceID, err)
+		return nil
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+
+	sealed, err := payload.key.seal(encodeCommands(commands))
+	if err != nil {
+		log.Printf("Error sealing commands for %s: %v", payload.DeviceID, err)
+		return nil
+	}
+	log.Printf("📤 Sending %d command(s) to %s", len(commands), payload.DeviceID)
+	return sealed
+}
+
+// encodeCommands renders commands in the downlink wire format.
+func encodeCommands(commands []*DeviceCommand) []byte {
+	lines := make([]string, len(commands))
+	for i, cmd := range commands {
+		fields := append([]string{"cmd", strconv.Itoa(cmd.ID), cmd.Command}, cmd.Params...)
+		lines[i] = strings.Join(fields, ",")
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// API handlers
+
+func (api *APIServer) createCommandHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		DeviceID string   `json:"device_id"`
+		Command  string   `json:"command"`
+		Params   []string `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if input.DeviceID == "" || input.Command == "" {
+		http.Error(w, "device_id and command are required", http.StatusBadRequest)
+		return
+	}
+	if !commandNamePattern.MatchString(input.Command) {
+		http.Error(w, "command must be lower case letters, digits and underscores", http.StatusBadRequest)
+		return
+	}
+	for _, param := range input.Params {
+		if !commandParamPattern.MatchString(param) {
+			http.Error(w, "params must be at most 64 characters without commas or newlines", http.StatusBadRequest)
+			return
+		}
+	}
+	if input.Params == nil {
+		input.Params = []string{}
+	}
+	params, _ := json.Marshal(input.Params)
+
+	cmd, err := scanDeviceCommand(api.db.QueryRow(fmt.Sprintf(`
+		INSERT INTO device_commands (device_id, command, params, status)
+		VALUES ($1, $2, $3, $4)
+		RETURNING %s
+	`, deviceCommandColumns), input.DeviceID, input.Command, params, commandPending))
+	if err != nil {
+		log.Printf("Error creating command: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	api.commands.broadcast(cmd)
+
+	log.Printf("📮 Queued command %d (%s) for %s", cmd.ID, cmd.Command, cmd.DeviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cmd)
+}
+
+func (api *APIServer) getCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	query := fmt.Sprintf("SELECT %s FROM device_commands WHERE 1=1", deviceCommandColumns)
+	args := []interface{}{}
+	if deviceID := r.URL.Query().Get("device_id"); deviceID != "" {
+		args = append(args, deviceID)
+		query += fmt.Sprintf(" AND device_id = $%d", len(args))
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		args = append(args, status)
+		query += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+
+	rows, err := api.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying commands: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var commands []*DeviceCommand
+	for rows.Next() {
+		cmd, err := scanDeviceCommand(rows)
+		if err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		commands = append(commands, cmd)
+	}
+
+	if commands == nil {
+		commands = []*DeviceCommand{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commands)
+}
+
+func (api *APIServer) getCommandHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid command id", http.StatusBadRequest)
+		return
+	}
+
+	cmd, err := scanDeviceCommand(api.db.QueryRow(fmt.Sprintf(
+		"SELECT %s FROM device_commands WHERE id = $1", deviceCommandColumns), id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Command not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error querying command: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmd)
+}
+
+// cancelCommandHandler withdraws a command the device has not confirmed yet.
+// A command already sent may still be executed by the device.
+func (api *APIServer) cancelCommandHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid command id", http.StatusBadRequest)
+		return
+	}
+
+	cmd, err := scanDeviceCommand(api.db.QueryRow(fmt.Sprintf(`
+		UPDATE device_commands
+		SET status = $2
+		WHERE id = $1 AND status IN ($3, $4)
+		RETURNING %s
+	`, deviceCommandColumns), id, commandCancelled, commandPending, commandSent))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Command not found or already finished", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error cancelling command: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	api.commands.broadcast(cmd)
+
+	log.Printf("Cancelled command %d (%s) for %s", cmd.ID, cmd.Command, cmd.DeviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmd)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// FixCompactor keeps a parked device from filling the locations table with
+// copies of the same point. Each plausible, in-order fix opens a dwell at its
+// position; later fixes within COMPACTION_RADIUS meters of it are not
+// inserted but extend that row instead, moving last_seen forward and counting
+// them in samples. The row keeps the position and telemetry of the fix that
+// opened it, and its timestamp is when the dwell began.
+//
+// Outliers and out-of-order fixes neither join nor end a dwell; the first
+// fix outside the radius opens a new one. A late fix inside the radius and
+// inside the open dwell's span is already described by it, so Absorb counts
+// it in the dwell instead of storing a row of its own. The keys of compacted
+// fixes go to a side table, so a resend is still found after its dwell
+// closed. The open dwell is reloaded from the table after a restart, so it
+// carries on where it stopped.
+type FixCompactor struct {
+	db        *Database
+	locations string
+	radius    float64 // meters, 0 disables compaction
+
+	mutex  sync.Mutex
+	dwells map[string]*openDwell
+}
+
+type openDwell struct {
+	latitude, longitude float64
+	Dwell
+}
+
+// Dwell is the time span a compacted row stands for. FirstSeen is the row's
+// timestamp.
+type Dwell struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Samples   int       `json:"samples"`
+}
+
+func NewFixCompactor(db *Database, config *Config) *FixCompactor {
+	locations := "locations"
+	if config.TablePrefix != "" {
+		locations = config.TablePrefix + "_locations"
+	}
+	return &FixCompactor{
+		db:        db,
+		locations: locations,
+		radius:    config.CompactionRadius,
+		dwells:    make(map[string]*openDwell),
+	}
+}
+
+// Compact decides whether a fix joins its device's open dwell, in which case
+// packet.Dwell is set to the extended span and the fix must be stored with
+// extendDwell rather than inserted. Fixes must be passed in the order they
+// are stored.
+func (fc *FixCompactor) Compact(packet *LocationPacket) {
+	if fc.radius <= 0 || packet.Outlier != "" {
+		return
+	}
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	dwell, ok := fc.dwells[packet.DeviceID]
+	if !ok {
+		dwell = fc.loadDwell(packet.DeviceID)
+		fc.dwells[packet.DeviceID] = dwell
+	}
+	if packet.OutOfOrder {
+		return
+	}
+
+	if dwell.within(packet, fc.radius) {
+		dwell.LastSeen = packet.Timestamp
+		dwell.Samples++
+		span := dwell.Dwell
+		packet.Dwell = &span
+		return
+	}
+
+	fc.dwells[packet.DeviceID] = &openDwell{
+		latitude:  packet.Latitude,
+		longitude: packet.Longitude,
+		Dwell: Dwell{
+			FirstSeen: packet.Timestamp,
+			LastSeen:  packet.Timestamp,
+			Samples:   1,
+		},
+	}
+}
+
+// Absorb counts a fix that falls inside its device's open dwell, in place
+// and in time, in that dwell without extending it: such a fix is a late one
+// the dwell already stands for. It sets packet.Dwell like Compact and runs
+// before the stateful stages, which the fix then skips.
+func (fc *FixCompactor) Absorb(packet *LocationPacket) bool {
+	if fc.radius <= 0 || packet.Duplicate {
+		return false
+	}
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	dwell, ok := fc.dwells[packet.DeviceID]
+	if !ok {
+		dwell = fc.loadDwell(packet.DeviceID)
+		fc.dwells[packet.DeviceID] = dwell
+	}
+	if !dwell.within(packet, fc.radius) ||
+		packet.Timestamp.Before(dwell.FirstSeen) || packet.Timestamp.After(dwell.LastSeen) {
+		return false
+	}
+
+	dwell.Samples++
+	span := dwell.Dwell
+	packet.Dwell = &span
+	// Older than the device's newest fix, so not its live position
+	packet.OutOfOrder = packet.Timestamp.Before(dwell.LastSeen)
+	return true
+}
+
+// within reports whether a fix is inside the dwell's radius.
+func (dwell *openDwell) within(packet *LocationPacket, radius float64) bool {
+	return dwell != nil &&
+		haversineKm(dwell.latitude, dwell.longitude, packet.Latitude, packet.Longitude)*1000 <= radius
+}
+
+// Forget drops the open dwells of these devices, so they are reloaded from
+// the table after a failed store left the in-memory state ahead of it.
+func (fc *FixCompactor) Forget(deviceIDs []string) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	for _, deviceID := range deviceIDs {
+		delete(fc.dwells, deviceID)
+	}
+}
+
+// Reset drops every open dwell.
+func (fc *FixCompactor) Reset() {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.dwells = make(map[string]*openDwell)
+}
+
+// loadDwell returns the device's newest plausible, in-order row as its open
+// dwell, or nil for a device without one.
+func (fc *FixCompactor) loadDwell(deviceID string) *openDwell {
+	var dwell openDwell
+	err := fc.db.QueryRow(fmt.Sprintf(`
+		SELECT ST_Y(location::geometry), ST_X(location::geometry),
+		       timestamp, COALESCE(last_seen, timestamp), samples
+		FROM %s
+		WHERE device_id = $1 AND outlier IS NULL AND NOT out_of_order
+		ORDER BY COALESCE(last_seen, timestamp) DESC
+		LIMIT 1
+	`, fc.locations), deviceID).Scan(&dwell.latitude, &dwell.longitude,
+		&dwell.FirstSeen, &dwell.LastSeen, &dwell.Samples)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading open dwell for %s: %v", deviceID, err)
+		}
+		return nil
+	}
+	return &dwell
+}
+
+// extendDwell moves the row a compacted fix joined to the fix's span and
+// records the fix's key. A key another instance recorded first marks the fix
+// Duplicate and leaves the row alone.
+func extendDwell(tx *sql.Tx, tableName string, packet *LocationPacket) error {
+	if packet.fixKey != "" {
+		result, err := tx.Exec(fmt.Sprintf(`
+			INSERT INTO %s_fix_keys (device_id, fix_key, first_seen)
+			VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING
+		`, tableName), packet.DeviceID, packet.fixKey, packet.Dwell.FirstSeen)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			packet.Duplicate = true
+			return nil
+		}
+	}
+
+	_, err := tx.Exec(fmt.Sprintf(`
+		UPDATE %s
+		SET last_seen = GREATEST(COALESCE(last_seen, timestamp), $3), samples = GREATEST(samples, $4)
+		WHERE device_id = $1 AND timestamp = $2
+	`, tableName), packet.DeviceID, packet.Dwell.FirstSeen, packet.Dwell.LastSeen, packet.Dwell.Samples)
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFixCompactorAbsorbsLateFixInsideDwell(t *testing.T) {
+	fc := NewFixCompactor(nil, &Config{CompactionRadius: 10})
+	at := time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC)
+	fix := func(offset time.Duration, lat float64) *LocationPacket {
+		return &LocationPacket{DeviceID: "truck-7", Timestamp: at.Add(offset), Latitude: lat, Longitude: -3.7038}
+	}
+
+	fc.dwells["truck-7"] = nil // no stored dwell yet
+	fc.Compact(fix(0, 40.4168))
+	extend := fix(time.Hour, 40.4168)
+	fc.Compact(extend)
+	if extend.Dwell == nil || extend.Dwell.Samples != 2 {
+		t.Fatalf("fix in place did not extend the dwell: %+v", extend.Dwell)
+	}
+
+	// Late, in place and inside the span: counted in the dwell, which
+	// keeps its span
+	late := fix(30*time.Minute, 40.4168)
+	if !fc.Absorb(late) {
+		t.Fatal("late fix inside the dwell not absorbed")
+	}
+	if late.Duplicate {
+		t.Error("late fix inside the dwell marked Duplicate")
+	}
+	if !late.OutOfOrder {
+		t.Error("absorbed late fix not out of order")
+	}
+	if late.Dwell.Samples != 3 || !late.Dwell.LastSeen.Equal(at.Add(time.Hour)) {
+		t.Errorf("absorbed fix span %+v, want 3 samples until %s", late.Dwell, at.Add(time.Hour))
+	}
+
+	// Elsewhere, or outside the span: left to the stateful stages
+	if fc.Absorb(fix(30*time.Minute, 40.5)) {
+		t.Error("late fix away from the dwell absorbed")
+	}
+	if fc.Absorb(fix(2*time.Hour, 40.4168)) {
+		t.Error("fix after the dwell's span absorbed")
+	}
+
+	// Compact no longer decides about resends
+	again := fix(30*time.Minute, 40.4168)
+	again.OutOfOrder = true
+	fc.Compact(again)
+	if again.Duplicate || again.Dwell != nil {
+		t.Errorf("out-of-order fix compacted: duplicate=%t dwell=%+v", again.Duplicate, again.Dwell)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DeadLetterStore keeps native packets that failed to decrypt or parse, with
+// where they came from and why they were rejected, so firmware problems can
+// be debugged from the server and the packets reprocessed once a key or the
+// parser is fixed. Only the newest limit packets are kept.
+//
+// Packets are written by a background goroutine so a flood of garbage does
+// not slow down the listeners; when its queue is full they are only logged.
+type DeadLetterStore struct {
+	db      *Database
+	limit   int
+	pending chan *DeadLetter
+}
+
+type DeadLetter struct {
+	ID            int        `json:"id"`
+	Source        string     `json:"source"`
+	Data          []byte     `json:"-"`
+	Size          int        `json:"size"`
+	Reason        string     `json:"reason"`
+	ReceivedAt    time.Time  `json:"received_at"`
+	ReprocessedAt *time.Time `json:"reprocessed_at,omitempty"`
+}
+
+// deadLetterQueueSize bounds the packets waiting to be written.
+const deadLetterQueueSize = 256
+
+func NewDeadLetterStore(db *Database, limit int) *DeadLetterStore {
+	store := &DeadLetterStore{db: db, limit: limit}
+	if limit > 0 {
+		store.pending = make(chan *DeadLetter, deadLetterQueueSize)
+		go store.run()
+	}
+	return store
+}
+
+// Record queues a rejected packet for storage.
+func (ds *DeadLetterStore) Record(source string, data []byte, reason error) {
+	if ds.limit <= 0 {
+		return
+	}
+
+	letter := &DeadLetter{
+		Source:     source,
+		Data:       append([]byte(nil), data...),
+		Reason:     reason.Error(),
+		ReceivedAt: time.Now(),
+	}
+	select {
+	case ds.pending <- letter:
+	default:
+		log.Println("Dead-letter queue full, dropping rejected packet")
+	}
+}
+
+func (ds *DeadLetterStore) run() {
+	for letter := range ds.pending {
+		if err := ds.store(letter); err != nil {
+			log.Printf("Error storing dead letter from %s: %v", letter.Source, err)
+		}
+	}
+}
+
+func (ds *DeadLetterStore) store(letter *DeadLetter) error {
+	_, err := ds.db.Exec(`
+		INSERT INTO dead_letters (source, data, reason, received_at)
+		VALUES ($1, $2, $3, $4)
+	`, letter.Source, letter.Data, letter.Reason, letter.ReceivedAt)
+	if err != nil {
+		return err
+	}
+
+	// Drop everything older than the newest limit rows
+	_, err = ds.db.Exec(`
+		DELETE FROM dead_letters
+		WHERE id <= (SELECT id FROM dead_letters ORDER BY id DESC OFFSET $1 LIMIT 1)
+	`, ds.limit)
+	return err
+}
+
+const deadLetterColumns = "id, source, data, reason, received_at, reprocessed_at"
+
+func scanDeadLetter(row rowScanner) (*DeadLetter, error) {
+	var letter DeadLetter
+	var reprocessedAt sql.NullTime
+	if err := row.Scan(&letter.ID, &letter.Source, &letter.Data, &letter.Reason,
+		&letter.ReceivedAt, &reprocessedAt); err != nil {
+		return nil, err
+	}
+	letter.Size = len(letter.Data)
+	letter.ReprocessedAt = nullTimePtr(reprocessedAt)
+	return &letter, nil
+}
+
+// API handlers
+
+func (api *APIServer) getDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	query := fmt.Sprintf("SELECT %s FROM dead_letters WHERE 1=1", deadLetterColumns)
+	args := []interface{}{}
+	if source := r.URL.Query().Get("source"); source != "" {
+		args = append(args, source+"%")
+		query += fmt.Sprintf(" AND source LIKE $%d", len(args))
+	}
+	if r.URL.Query().Get("pending") == "true" {
+		query += " AND reprocessed_at IS NULL"
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+
+	rows, err := api.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying dead letters: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	letters := []*DeadLetter{}
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letters)
+}
+
+// loadDeadLetter writes the error response itself when it returns nil.
+func (api *APIServer) loadDeadLetter(w http.ResponseWriter, r *http.Request) *DeadLetter {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid dead letter id", http.StatusBadRequest)
+		return nil
+	}
+
+	letter, err := scanDeadLetter(api.db.QueryRow(fmt.Sprintf(
+		"SELECT %s FROM dead_letters WHERE id = $1", deadLetterColumns), id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("Error querying dead letter: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil
+	}
+	return letter
+}
+
+// getDeadLetterHandler includes the raw packet, hex encoded.
+func (api *APIServer) getDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	letter := api.loadDeadLetter(w, r)
+	if letter == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*DeadLetter
+		Hex string `json:"hex"`
+	}{letter, hex.EncodeToString(letter.Data)})
+}
+
+// reprocessDeadLetterHandler runs a stored packet through decryption and
+// parsing again and stores its fixes. Replay protection is skipped: the
+// device has usually sent newer packets since, which moved the window past
+// this one. A packet that still fails keeps its entry with the new reason.
+func (api *APIServer) reprocessDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	letter := api.loadDeadLetter(w, r)
+	if letter == nil {
+		return
+	}
+	if letter.ReprocessedAt != nil {
+		http.Error(w, "Dead letter already reprocessed", http.StatusConflict)
+		return
+	}
+
+	log.Printf("📦 Reprocessing dead letter %d from %s (%d bytes)", letter.ID, letter.Source, letter.Size)
+	payload, err := api.ingestor.decodePacket(letter.Data)
+	if err != nil {
+		if _, dbErr := api.db.Exec("UPDATE dead_letters SET reason = $2 WHERE id = $1", letter.ID, err.Error()); dbErr != nil {
+			log.Printf("Error updating dead letter %d: %v", letter.ID, dbErr)
+		}
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Claim the entry first so concurrent requests cannot store it twice
+	err = api.db.QueryRow(`
+		UPDATE dead_letters SET reprocessed_at = NOW()
+		WHERE id = $1 AND reprocessed_at IS NULL
+		RETURNING reprocessed_at
+	`, letter.ID).Scan(&letter.ReprocessedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Dead letter already reprocessed", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error updating dead letter %d: %v", letter.ID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	payload.skipReplay = true
+	if err := api.pipeline.Ingest(payload); err != nil {
+		if _, dbErr := api.db.Exec("UPDATE dead_letters SET reprocessed_at = NULL WHERE id = $1", letter.ID); dbErr != nil {
+			log.Printf("Error updating dead letter %d: %v", letter.ID, dbErr)
+		}
+		if errors.Is(err, errDeviceNotAdmitted) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Failed to store location", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✓ Reprocessed dead letter %d: %d fix(es) from %s", letter.ID, len(payload.Fixes), payload.DeviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*DeadLetter
+		DeviceID string `json:"device_id"`
+		Fixes    int    `json:"fixes"`
+	}{letter, payload.DeviceID, len(payload.Fixes)})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Ingestion policies (DEVICE_POLICY) for device ids not in the registry:
+//
+//	open       accept them and register them as approved (default)
+//	register   register them as pending and drop their fixes until an
+//	           operator approves them
+//	allowlist  drop their fixes; only devices registered through the API
+//	           are accepted
+//
+// Fixes from pending or rejected devices are dropped under every policy.
+// They are not acknowledged, so trackers that buffer unacknowledged fixes
+// resend them once approved.
+const (
+	devicePolicyOpen      = "open"
+	devicePolicyRegister  = "register"
+	devicePolicyAllowlist = "allowlist"
+)
+
+const (
+	deviceStatusApproved = "approved"
+	deviceStatusPending  = "pending"
+	deviceStatusRejected = "rejected"
+)
+
+// errDeviceNotAdmitted marks fixes dropped by the registry, which are not
+// worth retrying until an operator acts.
+var errDeviceNotAdmitted = errors.New("device not admitted")
+
+// deviceCacheTTL bounds how long a status changed outside this process (e.g.
+// by another instance) can take to apply.
+const deviceCacheTTL = 30 * time.Second
+
+type Device struct {
+	DeviceID        string     `json:"device_id"`
+	Name            *string    `json:"name,omitempty"`
+	Status          string     `json:"status"`
+	RejectedPackets int64      `json:"rejected_packets"`
+	DuplicateFixes  int64      `json:"duplicate_fixes"` // already stored, not inserted again
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	LastRejectedAt  *time.Time `json:"last_rejected_at,omitempty"`
+	LastDuplicateAt *time.Time `json:"last_duplicate_at,omitempty"`
+	HasIngestToken  bool       `json:"has_ingest_token"`
+}
+
+const deviceColumns = `device_id, name, status, rejected_packets, duplicate_fixes,
+	created_at, updated_at, last_rejected_at, last_duplicate_at, ingest_token_hash IS NOT NULL`
+
+func scanDevice(row rowScanner) (*Device, error) {
+	var device Device
+	var name sql.NullString
+	var lastRejectedAt, lastDuplicateAt sql.NullTime
+	if err := row.Scan(&device.DeviceID, &name, &device.Status, &device.RejectedPackets, &device.DuplicateFixes,
+		&device.CreatedAt, &device.UpdatedAt, &lastRejectedAt, &lastDuplicateAt, &device.HasIngestToken); err != nil {
+		return nil, err
+	}
+	if name.Valid {
+		device.Name = &name.String
+	}
+	device.LastRejectedAt = nullTimePtr(lastRejectedAt)
+	device.LastDuplicateAt = nullTimePtr(lastDuplicateAt)
+	return &device, nil
+}
+
+// DeviceRegistry decides which device ids may store fixes. Statuses are
+// cached so the check costs no query for known devices.
+type DeviceRegistry struct {
+	db     *Database
+	policy string
+
+	mutex sync.Mutex
+	cache map[string]cachedDeviceStatus
+}
+
+// cachedDeviceStatus holds "" for a device that is not registered.
+type cachedDeviceStatus struct {
+	status   string
+	loadedAt time.Time
+}
+
+func NewDeviceRegistry(db *Database, policy string) (*DeviceRegistry, error) {
+	switch policy {
+	case devicePolicyOpen, devicePolicyRegister, devicePolicyAllowlist:
+	default:
+		return nil, fmt.Errorf("unknown device policy %q (expected %s, %s or %s)",
+			policy, devicePolicyOpen, devicePolicyRegister, devicePolicyAllowlist)
+	}
+	return &DeviceRegistry{
+		db:     db,
+		policy: policy,
+		cache:  make(map[string]cachedDeviceStatus),
+	}, nil
+}
+
+// Admit reports whether fixes from deviceID may be stored, registering the
+// device first if the policy says so.
+func (dr *DeviceRegistry) Admit(deviceID string) error {
+	status, err := dr.status(deviceID)
+	if err != nil {
+		return err
+	}
+
+	if status == "" {
+		switch dr.policy {
+		case devicePolicyOpen:
+			status, err = dr.register(deviceID, deviceStatusApproved)
+		case devicePolicyRegister:
+			status, err = dr.register(deviceID, deviceStatusPending)
+		default:
+			return fmt.Errorf("%w: %s is not registered", errDeviceNotAdmitted, deviceID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if status == deviceStatusApproved {
+		return nil
+	}
+
+	_, err = dr.db.Exec(`
+		UPDATE devices
+		SET rejected_packets = rejected_packets + 1, last_rejected_at = NOW()
+		WHERE device_id = $1
+	`, deviceID)
+	if err != nil {
+		log.Printf("Error counting rejected packet for %s: %v", deviceID, err)
+	}
+	return fmt.Errorf("%w: %s is %s", errDeviceNotAdmitted, deviceID, status)
+}
+
+// CountDuplicates adds fixes that were not stored again, because the same
+// fix already was, to their devices' counters.
+func (dr *DeviceRegistry) CountDuplicates(counts map[string]int) {
+	for deviceID, n := range counts {
+		_, err := dr.db.Exec(`
+			UPDATE devices
+			SET duplicate_fixes = duplicate_fixes + $2, last_duplicate_at = NOW()
+			WHERE device_id = $1
+		`, deviceID, n)
+		if err != nil {
+			log.Printf("Error counting duplicate fixes for %s: %v", deviceID, err)
+		}
+	}
+}
+
+// Authenticate returns the device an HTTP ingestion token was issued to.
+// Only a hash of each token is stored.
+func (dr *DeviceRegistry) Authenticate(token string) (string, error) {
+	hash := sha256.Sum256([]byte(token))
+	var deviceID string
+	err := dr.db.QueryRow("SELECT device_id FROM devices WHERE ingest_token_hash = $1", hash[:]).Scan(&deviceID)
+	return deviceID, err
+}
+
+func (dr *DeviceRegistry) status(deviceID string) (string, error) {
+	dr.mutex.Lock()
+	cached, ok := dr.cache[deviceID]
+	dr.mutex.Unlock()
+	if ok && time.Since(cached.loadedAt) < deviceCacheTTL {
+		return cached.status, nil
+	}
+
+	var status string
+	err := dr.db.QueryRow("SELECT status FROM devices WHERE device_id = $1", deviceID).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("error loading device %s: %w", deviceID, err)
+	}
+	dr.remember(deviceID, status)
+	return status, nil
+}
+
+func (dr *DeviceRegistry) remember(deviceID, status string) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	dr.cache[deviceID] = cachedDeviceStatus{status: status, loadedAt: time.Now()}
+}
+
+// register adds a device seen for the first time and returns its status,
+// which is another instance's choice if it registered the device first.
+func (dr *DeviceRegistry) register(deviceID, status string) (string, error) {
+	result, err := dr.db.Exec(`
+		INSERT INTO devices (device_id, status) VALUES ($1, $2)
+		ON CONFLICT (device_id) DO NOTHING
+	`, deviceID, status)
+	if err != nil {
+		return "", fmt.Errorf("error registering device %s: %w", deviceID, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		dr.forget(deviceID)
+		return dr.status(deviceID)
+	}
+	dr.remember(deviceID, status)
+
+	if status == deviceStatusPending {
+		log.Printf("🆕 Device %s quarantined until approved", deviceID)
+		notification := &Notification{
+			DeviceID: deviceID,
+			Message:  fmt.Sprintf("New device %s is waiting for approval", deviceID),
+			Type:     "warning",
+		}
+		if err := dr.db.createNotification(notification); err != nil {
+			log.Printf("Error creating notification for %s: %v", deviceID, err)
+		}
+	} else {
+		log.Printf("🆕 Device %s registered", deviceID)
+	}
+	return status, nil
+}
+
+func (dr *DeviceRegistry) forget(deviceID string) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	delete(dr.cache, deviceID)
+}
+
+// API handlers
+
+func (api *APIServer) getRegisteredDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	query := fmt.Sprintf("SELECT %s FROM devices", deviceColumns)
+	args := []interface{}{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " WHERE status = $1"
+		args = append(args, status)
+	}
+	query += " ORDER BY device_id"
+
+	rows, err := api.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying devices: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	devices := []*Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		devices = append(devices, device)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"policy":  api.devices.policy,
+		"devices": devices,
+	})
+}
+
+// registerDeviceHandler adds a device to the allow-list, approving it if it
+// was already pending or rejected.
+func (api *APIServer) registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		DeviceID string  `json:"device_id"`
+		Name     *string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if input.DeviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+
+	device, err := scanDevice(api.db.QueryRow(fmt.Sprintf(`
+		INSERT INTO devices (device_id, name, status) VALUES ($1, $2, $3)
+		ON CONFLICT (device_id) DO UPDATE
+		SET name = COALESCE(EXCLUDED.name, devices.name),
+		    status = EXCLUDED.status,
+		    updated_at = NOW()
+		RETURNING %s
+	`, deviceColumns), input.DeviceID, input.Name, deviceStatusApproved))
+	if err != nil {
+		log.Printf("Error registering device: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	api.devices.remember(device.DeviceID, device.Status)
+
+	log.Printf("✓ Device %s registered", device.DeviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(device)
+}
+
+func (api *APIServer) approveDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	api.setDeviceStatus(w, r, deviceStatusApproved)
+}
+
+func (api *APIServer) rejectDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	api.setDeviceStatus(w, r, deviceStatusRejected)
+}
+
+func (api *APIServer) setDeviceStatus(w http.ResponseWriter, r *http.Request, status string) {
+	deviceID := mux.Vars(r)["deviceId"]
+
+	device, err := scanDevice(api.db.QueryRow(fmt.Sprintf(`
+		UPDATE devices SET status = $2, updated_at = NOW()
+		WHERE device_id = $1
+		RETURNING %s
+	`, deviceColumns), deviceID, status))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error updating device: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	api.devices.remember(deviceID, status)
+
+	log.Printf("Device %s %s", deviceID, status)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
+
+// issueIngestTokenHandler creates the token a phone app sends to the HTTP
+// ingestion routes, registering the device as approved if it is new. The
+// token can only post fixes for this device and is returned once, in this
+// response only; issuing another replaces it.
+func (api *APIServer) issueIngestTokenHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(token))
+
+	device, err := scanDevice(api.db.QueryRow(fmt.Sprintf(`
+		INSERT INTO devices (device_id, status, ingest_token_hash) VALUES ($1, $2, $3)
+		ON CONFLICT (device_id) DO UPDATE
+		SET ingest_token_hash = EXCLUDED.ingest_token_hash, updated_at = NOW()
+		RETURNING %s
+	`, deviceColumns), deviceID, deviceStatusApproved, hash[:]))
+	if err != nil {
+		log.Printf("Error issuing ingestion token: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	api.devices.remember(device.DeviceID, device.Status)
+
+	log.Printf("🔑 Issued HTTP ingestion token for device %s", device.DeviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		*Device
+		Token string `json:"token"`
+	}{device, token})
+}
+
+func (api *APIServer) revokeIngestTokenHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+
+	result, err := api.db.Exec(`
+		UPDATE devices SET ingest_token_hash = NULL, updated_at = NOW()
+		WHERE device_id = $1 AND ingest_token_hash IS NOT NULL
+	`, deviceID)
+	if err != nil {
+		log.Printf("Error revoking ingestion token: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Device has no token", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("🔒 Revoked HTTP ingestion token for device %s", deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteRegisteredDeviceHandler removes a device from the registry; under the
+// open and register policies it is registered again on its next packet.
+func (api *APIServer) deleteRegisteredDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+
+	result, err := api.db.Exec("DELETE FROM devices WHERE device_id = $1", deviceID)
+	if err != nil {
+		log.Printf("Error deleting device: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	api.devices.forget(deviceID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
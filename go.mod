@@ -3,10 +3,15 @@ module location-tracker
 go 1.25.1
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.5.1
 	github.com/gorilla/mux v1.8.1
 	github.com/gorilla/websocket v1.5.3
 	github.com/lib/pq v1.10.9
 	github.com/paulmach/orb v0.12.0
 )
 
-require go.mongodb.org/mongo-driver v1.11.4 // indirect
+require (
+	go.mongodb.org/mongo-driver v1.11.4 // indirect
+	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
+)
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// GT06 / Concox trackers over TCP. Every packet is framed as:
+//
+//	[0x78 0x78][length uint8]  or  [0x79 0x79][length uint16]
+//	[protocol uint8][content...][serial uint16][CRC-ITU uint16]
+//	[0x0D 0x0A]
+//
+// where length counts protocol through CRC and the CRC covers length through
+// serial. The device logs in with its IMEI, then sends heartbeats, GPS and
+// alarm packets. Login, heartbeat and alarm packets must be acknowledged by
+// echoing the protocol number and serial, or the device reconnects.
+
+const (
+	gt06Login         = 0x01
+	gt06GPS           = 0x12
+	gt06Heartbeat     = 0x13
+	gt06Alarm         = 0x16
+	gt06GPSExtended   = 0x22
+	gt06AlarmExtended = 0x26
+)
+
+// GPS course/status word
+const (
+	gt06Positioned = 0x1000
+	gt06West       = 0x0800
+	gt06North      = 0x0400
+	gt06CourseMask = 0x03FF
+)
+
+// Terminal information byte of heartbeat and alarm packets
+const (
+	gt06TerminalACC      = 0x02
+	gt06TerminalCharging = 0x04
+)
+
+var gt06AlarmNames = map[byte]string{
+	0x01: "SOS",
+	0x02: "Power cut",
+	0x03: "Vibration",
+	0x04: "Entered fence",
+	0x05: "Left fence",
+	0x06: "Overspeed",
+	0x09: "Displacement",
+	0x0E: "Low external battery",
+	0x13: "Tampering",
+}
+
+type gt06Decoder struct{}
+
+func (gt06Decoder) Name() string { return "gt06" }
+
+func (gt06Decoder) Detect(head []byte) bool {
+	return len(head) >= 2 && (head[0] == 0x78 && head[1] == 0x78 || head[0] == 0x79 && head[1] == 0x79)
+}
+
+func (gt06Decoder) NewSession(source string) DecoderSession {
+	return &gt06Session{source: source}
+}
+
+type gt06Session struct {
+	source string
+	imei   string
+
+	// Last decoded packet, for Ack
+	extended bool
+	protocol byte
+	serial   uint16
+}
+
+func (s *gt06Session) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	var start [2]byte
+	if _, err := io.ReadFull(r, start[:]); err != nil {
+		return nil, err
+	}
+
+	var lengthField []byte
+	switch {
+	case start[0] == 0x78 && start[1] == 0x78:
+		lengthField = make([]byte, 1)
+	case start[0] == 0x79 && start[1] == 0x79:
+		lengthField = make([]byte, 2)
+	default:
+		return nil, fmt.Errorf("invalid GT06 start bytes %x", start)
+	}
+	if _, err := io.ReadFull(r, lengthField); err != nil {
+		return nil, err
+	}
+
+	length := int(lengthField[0])
+	if len(lengthField) == 2 {
+		length = int(binary.BigEndian.Uint16(lengthField))
+	}
+	if length < 5 { // protocol + serial + CRC
+		return nil, fmt.Errorf("invalid GT06 length %d", length)
+	}
+
+	frame := make([]byte, 2+len(lengthField)+length+2)
+	copy(frame, start[:])
+	copy(frame[2:], lengthField)
+	if _, err := io.ReadFull(r, frame[2+len(lengthField):]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (s *gt06Session) Decode(frame []byte) (*Payload, error) {
+	s.protocol = 0
+	s.extended = frame[0] == 0x79
+
+	headerSize := 3
+	if s.extended {
+		headerSize = 4
+	}
+	if frame[len(frame)-2] != 0x0D || frame[len(frame)-1] != 0x0A {
+		return nil, fmt.Errorf("missing GT06 stop bytes")
+	}
+
+	body := frame[headerSize : len(frame)-2] // protocol .. CRC
+	crc := binary.BigEndian.Uint16(body[len(body)-2:])
+	if sum := crc16ITU(frame[2 : len(frame)-4]); sum != crc {
+		return nil, fmt.Errorf("CRC mismatch: got %04X, want %04X", sum, crc)
+	}
+
+	protocol := body[0]
+	content := body[1 : len(body)-4]
+	serial := binary.BigEndian.Uint16(body[len(body)-4:])
+
+	if protocol == gt06Login {
+		if len(content) < 8 {
+			return nil, fmt.Errorf("%w: short login packet", errCloseSession)
+		}
+		// Terminal id is the IMEI as 8 BCD bytes with a leading zero digit
+		s.imei = strings.TrimPrefix(hex.EncodeToString(content[:8]), "0")
+		s.protocol, s.serial = protocol, serial
+		log.Printf("📟 GT06 device %s logged in from %s", s.imei, s.source)
+		return nil, nil
+	}
+	if s.imei == "" {
+		return nil, fmt.Errorf("%w: packet 0x%02X before login", errCloseSession, protocol)
+	}
+	s.protocol, s.serial = protocol, serial
+
+	payload := &Payload{DeviceID: s.imei}
+	switch protocol {
+	case gt06Heartbeat:
+		if len(content) >= 3 {
+			log.Printf("💓 GT06 heartbeat from %s (voltage level %d, GSM %d)", s.imei, content[1], content[2])
+		}
+		return nil, nil
+
+	case gt06GPS, gt06GPSExtended:
+		packet, err := decodeGT06Position(s.imei, content, false)
+		if err != nil {
+			return nil, err
+		}
+		if packet != nil {
+			if protocol == gt06GPSExtended && len(content) > 26 {
+				packet.Attributes["ignition"] = content[26] != 0
+			}
+			payload.Fixes = append(payload.Fixes, packet)
+		}
+		return payload, nil
+
+	case gt06Alarm, gt06AlarmExtended:
+		if len(content) < 19 {
+			return nil, fmt.Errorf("short alarm packet")
+		}
+		packet, err := decodeGT06Position(s.imei, content, true)
+		if err != nil {
+			return nil, err
+		}
+		// LBS block, then terminal info, voltage, GSM signal, alarm
+		status := 18 + max(int(content[18]), 1)
+		if len(content) < status+4 {
+			return nil, fmt.Errorf("short alarm packet")
+		}
+		terminal, alarm := content[status], content[status+3]
+
+		name, ok := gt06AlarmNames[alarm]
+		if !ok {
+			name = fmt.Sprintf("Alarm 0x%02X", alarm)
+		}
+		notification := &Notification{
+			DeviceID: s.imei,
+			Message:  fmt.Sprintf("%s alarm from %s", name, s.imei),
+			Type:     "alert",
+		}
+		if packet != nil {
+			packet.Attributes["alarm"] = strings.ToLower(strings.ReplaceAll(name, " ", "_"))
+			packet.Attributes["ignition"] = terminal&gt06TerminalACC != 0
+			packet.Attributes["charging"] = terminal&gt06TerminalCharging != 0
+			payload.Fixes = append(payload.Fixes, packet)
+			notification.Latitude, notification.Longitude = packet.Latitude, packet.Longitude
+		}
+		if alarm != 0 {
+			payload.Notifications = append(payload.Notifications, notification)
+		}
+		return payload, nil
+	}
+
+	log.Printf("GT06 device %s sent unsupported packet 0x%02X", s.imei, protocol)
+	return nil, nil
+}
+
+func (s *gt06Session) Ack(err error) []byte {
+	if err != nil {
+		return nil
+	}
+	switch s.protocol {
+	case gt06Login, gt06Heartbeat, gt06Alarm, gt06AlarmExtended:
+	default:
+		return nil
+	}
+
+	var reply []byte
+	if s.extended {
+		reply = []byte{0x79, 0x79, 0x00, 0x05}
+	} else {
+		reply = []byte{0x78, 0x78, 0x05}
+	}
+	reply = append(reply, s.protocol)
+	reply = binary.BigEndian.AppendUint16(reply, s.serial)
+	reply = binary.BigEndian.AppendUint16(reply, crc16ITU(reply[2:]))
+	return append(reply, 0x0D, 0x0A)
+}
+
+// decodeGT06Position reads the date/time and GPS blocks shared by GPS and
+// alarm packets, plus the cell tower that follows them (length-prefixed in
+// alarm packets). It returns nil when the device has no GPS fix.
+//
+//	[YY MM DD hh mm ss][info: length<<4 | satellites]
+//	[latitude uint32][longitude uint32]   (minutes × 30000)
+//	[speed uint8 km/h][course/status uint16]
+//	[MCC uint16][MNC uint8][LAC uint16][cell id uint24]
+func decodeGT06Position(imei string, content []byte, lbsLength bool) (*LocationPacket, error) {
+	if len(content) < 18 {
+		return nil, fmt.Errorf("short GPS block")
+	}
+
+	timestamp := time.Date(2000+int(content[0]), time.Month(content[1]), int(content[2]),
+		int(content[3]), int(content[4]), int(content[5]), 0, time.UTC)
+	satellites := int(content[6] & 0x0F)
+	lat := float64(binary.BigEndian.Uint32(content[7:])) / 1800000
+	lng := float64(binary.BigEndian.Uint32(content[11:])) / 1800000
+	speed := float64(content[15])
+	status := binary.BigEndian.Uint16(content[16:])
+
+	if status&gt06Positioned == 0 {
+		return nil, nil
+	}
+	if status&gt06North == 0 {
+		lat = -lat
+	}
+	if status&gt06West != 0 {
+		lng = -lng
+	}
+	if lat > 90 || lat < -90 || lng > 180 || lng < -180 {
+		return nil, fmt.Errorf("out-of-range coordinates: lat=%f, lng=%f", lat, lng)
+	}
+
+	course := float64(status & gt06CourseMask)
+	if course >= 360 {
+		course = 0
+	}
+	packet := &LocationPacket{
+		DeviceID:   imei,
+		Latitude:   lat,
+		Longitude:  lng,
+		Timestamp:  timestamp,
+		Speed:      &speed,
+		Heading:    &course,
+		Satellites: &satellites,
+		Attributes: map[string]interface{}{},
+	}
+
+	cell := content[18:]
+	if lbsLength {
+		// Length byte counting itself; 0 when the device sent no cell
+		if len(cell) == 0 || cell[0] < 9 {
+			return packet, nil
+		}
+		cell = cell[1:]
+	}
+	if len(cell) >= 8 {
+		packet.Attributes["mcc"] = binary.BigEndian.Uint16(cell)
+		packet.Attributes["mnc"] = cell[2]
+		packet.Attributes["lac"] = binary.BigEndian.Uint16(cell[3:])
+		packet.Attributes["cell_id"] = uint32(cell[5])<<16 | uint32(cell[6])<<8 | uint32(cell[7])
+	}
+	return packet, nil
+}
+
+// crc16ITU is CRC-16/X-25 (poly 0x8408 reflected, init and xorout 0xFFFF),
+// which the GT06 documentation calls CRC-ITU.
+func crc16ITU(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
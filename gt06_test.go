@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Frames from the GT06 protocol documentation and captured devices. The
+// login and its reply are the documentation's own example.
+const (
+	gt06LoginFrame     = "78780D01012345678901234500018CDD0D0A"
+	gt06LoginReply     = "787805010001D9DC0D0A"
+	gt06HeartbeatFrame = "78780A134004040001000FDCEE0D0A"
+	gt06GPSFrame       = "78781f1210020e14061dcc0476fcd0003e3faf3e14b20000000000000000044ef6740d0a"
+	gt06AlarmFrame     = "787825160B0B0F0E241DCF027AC8870C4657E60014020901CC00287D001F726506040101003656A40D0A"
+)
+
+func TestCRC16ITU(t *testing.T) {
+	// Check value of CRC-16/X-25
+	if got := crc16ITU([]byte("123456789")); got != 0x906E {
+		t.Errorf("crc16ITU(123456789) = %04X, want 906E", got)
+	}
+	login := mustHex(t, gt06LoginFrame)
+	if got := crc16ITU(login[2 : len(login)-4]); got != 0x8CDD {
+		t.Errorf("login frame CRC = %04X, want 8CDD", got)
+	}
+}
+
+// gt06Step is one frame sent by the device and what the server makes of it.
+type gt06Step struct {
+	frame string
+	ack   string // hex, "" for no reply
+	check func(t *testing.T, payload *Payload)
+}
+
+func runGT06Session(t *testing.T, steps []gt06Step) {
+	t.Helper()
+
+	var stream []byte
+	for _, step := range steps {
+		stream = append(stream, mustHex(t, step.frame)...)
+	}
+	r := bufio.NewReader(bytes.NewReader(stream))
+	session := gt06Decoder{}.NewSession("test")
+
+	for i, step := range steps {
+		frame, err := session.ReadFrame(r)
+		if err != nil {
+			t.Fatalf("frame %d: read: %v", i, err)
+		}
+		payload, err := session.Decode(frame)
+		if err != nil {
+			t.Fatalf("frame %d: decode: %v", i, err)
+		}
+		if ack := session.Ack(nil); !bytes.Equal(ack, mustHex(t, step.ack)) {
+			t.Errorf("frame %d: ack %X, want %s", i, ack, step.ack)
+		}
+		if step.check != nil {
+			step.check(t, payload)
+		} else if payload != nil {
+			t.Errorf("frame %d: unexpected payload %+v", i, payload)
+		}
+	}
+}
+
+func TestGT06Session(t *testing.T) {
+	runGT06Session(t, []gt06Step{
+		{frame: gt06LoginFrame, ack: gt06LoginReply},
+		{frame: gt06HeartbeatFrame, ack: "78780513000F008F0D0A"},
+		{frame: gt06GPSFrame, check: func(t *testing.T, payload *Payload) {
+			if payload.DeviceID != "123456789012345" || len(payload.Fixes) != 1 {
+				t.Fatalf("payload %+v", payload)
+			}
+			fix := payload.Fixes[0]
+			if want := time.Date(2016, 2, 14, 20, 6, 29, 0, time.UTC); !fix.Timestamp.Equal(want) {
+				t.Errorf("timestamp %s, want %s", fix.Timestamp, want)
+			}
+			if fix.Latitude != 74906832.0/1800000 || fix.Longitude != 4079535.0/1800000 {
+				t.Errorf("position %f,%f", fix.Latitude, fix.Longitude)
+			}
+			if *fix.Speed != 62 || *fix.Heading != 178 || *fix.Satellites != 12 {
+				t.Errorf("speed %v, heading %v, satellites %v, want 62, 178, 12", *fix.Speed, *fix.Heading, *fix.Satellites)
+			}
+		}},
+		{frame: gt06AlarmFrame, ack: "78780516003695700D0A", check: func(t *testing.T, payload *Payload) {
+			if len(payload.Fixes) != 1 || len(payload.Notifications) != 1 {
+				t.Fatalf("payload %+v", payload)
+			}
+			fix := payload.Fixes[0]
+			if fix.Latitude != 41601159.0/1800000 || fix.Longitude != 205936614.0/1800000 {
+				t.Errorf("position %f,%f", fix.Latitude, fix.Longitude)
+			}
+			if fix.Attributes["alarm"] != "sos" || fix.Attributes["charging"] != true || fix.Attributes["ignition"] != false {
+				t.Errorf("attributes %v", fix.Attributes)
+			}
+			if fix.Attributes["mcc"] != uint16(460) || fix.Attributes["lac"] != uint16(10365) || fix.Attributes["cell_id"] != uint32(8050) {
+				t.Errorf("cell %v", fix.Attributes)
+			}
+			n := payload.Notifications[0]
+			if n.Message != "SOS alarm from 123456789012345" || n.Type != "alert" || n.Latitude != fix.Latitude {
+				t.Errorf("notification %+v", n)
+			}
+		}},
+	})
+}
+
+func TestGT06PacketBeforeLogin(t *testing.T) {
+	session := gt06Decoder{}.NewSession("test")
+	frame, err := session.ReadFrame(bufio.NewReader(bytes.NewReader(mustHex(t, gt06GPSFrame))))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if _, err := session.Decode(frame); !errors.Is(err, errCloseSession) {
+		t.Errorf("error %v, want errCloseSession", err)
+	}
+}
+
+func TestGT06CorruptFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func([]byte)
+	}{
+		{"CRC mismatch", func(f []byte) { f[len(f)-3] ^= 0xFF }},
+		{"corrupted serial", func(f []byte) { f[len(f)-5] ^= 0x01 }},
+		{"missing stop bytes", func(f []byte) { f[len(f)-1] = 0x00 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := mustHex(t, gt06LoginFrame)
+			tt.modify(frame)
+
+			session := gt06Decoder{}.NewSession("test")
+			read, err := session.ReadFrame(bufio.NewReader(bytes.NewReader(frame)))
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			_, err = session.Decode(read)
+			if err == nil {
+				t.Fatal("decode succeeded")
+			}
+			if ack := session.Ack(err); ack != nil {
+				t.Errorf("ack %X for a rejected frame", ack)
+			}
+		})
+	}
+}
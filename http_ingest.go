@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP ingestion lets phones report without custom firmware. Each phone
+// authenticates with its own token, issued through the device registry (see
+// issueIngestTokenHandler), so a leaked token can only post fixes for its
+// device. The token goes in the Authorization header, as a Bearer token or as
+// the Basic auth password (OwnTracks). Only the OsmAnd route also takes it as
+// a token parameter, because the stock OsmAnd app cannot send headers; there
+// it may end up in proxy access logs, which is why it is confined to one
+// device.
+//
+// The LoRaWAN network server webhooks carry every device of the fleet, so
+// they are authenticated with the shared HTTP_INGEST_TOKEN instead, as a
+// Bearer token; without one they are disabled.
+
+func (api *APIServer) authorizeIngest(w http.ResponseWriter, r *http.Request) bool {
+	if api.ingestToken == "" {
+		http.Error(w, "HTTP ingestion disabled", http.StatusServiceUnavailable)
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.ingestToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="location-tracker"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// ingestCredentials returns the token of a phone request and the user name
+// it came with, if sent with Basic auth. The Authorization header wins; with
+// queryToken set, a token query or form parameter is accepted without one.
+func ingestCredentials(r *http.Request, queryToken bool) (token, user string, ok bool) {
+	if token, ok = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token, "", true
+	}
+	if user, token, ok = r.BasicAuth(); ok {
+		return token, user, true
+	}
+	if queryToken {
+		if token = r.FormValue("token"); token != "" {
+			return token, "", true
+		}
+	}
+	return "", "", false
+}
+
+// authorizeDevice checks a phone's token and returns the device it belongs
+// to. A device id named in the request must match it.
+func (api *APIServer) authorizeDevice(w http.ResponseWriter, r *http.Request, claimed string, queryToken bool) (string, bool) {
+	token, user, ok := ingestCredentials(r, queryToken)
+	if ok && claimed == "" {
+		claimed = user
+	}
+
+	deviceID := ""
+	err := sql.ErrNoRows
+	if ok && token != "" {
+		deviceID, err = api.devices.Authenticate(token)
+	}
+	if err == sql.ErrNoRows {
+		w.Header().Set("WWW-Authenticate", `Basic realm="location-tracker"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	} else if err != nil {
+		log.Printf("Error checking ingestion token: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return "", false
+	}
+
+	if claimed != "" && claimed != deviceID {
+		log.Printf("❌ Token of %s used to post fixes for %s", deviceID, claimed)
+		http.Error(w, "Token does not belong to this device", http.StatusForbidden)
+		return "", false
+	}
+	return deviceID, true
+}
+
+// osmandIngestHandler accepts the OsmAnd online-tracking protocol, as query
+// string or form parameters:
+//
+//	id, lat, lon, timestamp, speed (m/s), bearing, altitude, accuracy (m),
+//	hdop, batt (%)
+//
+// id may be omitted; it defaults to the device the token belongs to. The
+// token may be passed as a token parameter too (see ingestCredentials).
+func (api *APIServer) osmandIngestHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	deviceID := r.Form.Get("id")
+	if deviceID == "" {
+		deviceID = r.Form.Get("deviceid")
+	}
+	deviceID, ok := api.authorizeDevice(w, r, deviceID, true)
+	if !ok {
+		return
+	}
+	lngStr := r.Form.Get("lon")
+	if lngStr == "" {
+		lngStr = r.Form.Get("lng")
+	}
+
+	packet, err := parseCoordinates(deviceID, r.Form.Get("lat"), lngStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ts := r.Form.Get("timestamp"); ts != "" {
+		if packet.Timestamp, err = parseFixTime(ts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	optional := []struct {
+		name  string
+		scale float64
+		dest  **float64
+	}{
+		{"speed", 3.6, &packet.Speed}, // m/s -> km/h
+		{"bearing", 1, &packet.Heading},
+		{"altitude", 1, &packet.Altitude},
+		{"accuracy", 1, &packet.Accuracy},
+		{"hdop", 1, &packet.HDOP},
+		{"batt", 1, &packet.BatteryLevel},
+	}
+	for _, field := range optional {
+		value := r.Form.Get(field.name)
+		if value == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s", field.name), http.StatusBadRequest)
+			return
+		}
+		v *= field.scale
+		*field.dest = &v
+	}
+	if err := validateTelemetry(packet); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := api.ingestHTTPFix(packet, "osmand"); errors.Is(err, errDeviceNotAdmitted) {
+		http.Error(w, "Device not approved", http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to store location", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// owntracksIngestHandler accepts OwnTracks HTTP-mode messages. Only
+// "location" messages carry fixes; anything else is acknowledged and ignored.
+// Fixes belong to the device the token was issued to; an X-Limit-D header
+// (set by the app) or Basic auth user naming another device is rejected.
+func (api *APIServer) owntracksIngestHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := api.authorizeDevice(w, r, r.Header.Get("X-Limit-D"), false)
+	if !ok {
+		return
+	}
+
+	var msg struct {
+		Type string   `json:"_type"`
+		Lat  *float64 `json:"lat"`
+		Lon  *float64 `json:"lon"`
+		Tst  int64    `json:"tst"`
+		Acc  *float64 `json:"acc"`
+		Alt  *float64 `json:"alt"`
+		Batt *float64 `json:"batt"`
+		Vel  *float64 `json:"vel"` // km/h
+		Cog  *float64 `json:"cog"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// OwnTracks expects a JSON array of messages back, even when empty
+	w.Header().Set("Content-Type", "application/json")
+	if msg.Type != "location" {
+		w.Write([]byte("[]"))
+		return
+	}
+	if msg.Lat == nil || msg.Lon == nil {
+		http.Error(w, "lat and lon are required", http.StatusBadRequest)
+		return
+	}
+
+	packet, err := parseCoordinates(deviceID,
+		strconv.FormatFloat(*msg.Lat, 'f', -1, 64), strconv.FormatFloat(*msg.Lon, 'f', -1, 64))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if msg.Tst > 0 {
+		packet.Timestamp = time.Unix(msg.Tst, 0).UTC()
+	}
+	packet.Accuracy = msg.Acc
+	packet.Altitude = msg.Alt
+	packet.BatteryLevel = msg.Batt
+	packet.Speed = msg.Vel
+	packet.Heading = msg.Cog
+	if err := validateTelemetry(packet); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := api.ingestHTTPFix(packet, "owntracks"); errors.Is(err, errDeviceNotAdmitted) {
+		http.Error(w, "Device not approved", http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to store location", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("[]"))
+}
+
+func (api *APIServer) ingestHTTPFix(packet *LocationPacket, protocol string) error {
+	payload := &Payload{DeviceID: packet.DeviceID, Fixes: []*LocationPacket{packet}}
+	api.ingestor.stampReceived(payload)
+
+	log.Printf("📱 %s fix from %s", protocol, packet.DeviceID)
+	return api.pipeline.Ingest(payload)
+}
+
+// validateTelemetry applies the range checks of the native grammar to values
+// that arrived through other protocols.
+func validateTelemetry(packet *LocationPacket) error {
+	switch {
+	case packet.Speed != nil && *packet.Speed < 0:
+		return fmt.Errorf("negative speed: %f", *packet.Speed)
+	case packet.Heading != nil && (*packet.Heading < 0 || *packet.Heading >= 360):
+		return fmt.Errorf("heading out of range: %f", *packet.Heading)
+	case packet.HDOP != nil && *packet.HDOP < 0:
+		return fmt.Errorf("negative hdop: %f", *packet.HDOP)
+	case packet.Accuracy != nil && *packet.Accuracy < 0:
+		return fmt.Errorf("negative accuracy: %f", *packet.Accuracy)
+	case packet.BatteryLevel != nil && (*packet.BatteryLevel < 0 || *packet.BatteryLevel > 100):
+		return fmt.Errorf("battery level out of range: %f", *packet.BatteryLevel)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIngestCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    func() *http.Request
+		queryToken bool
+		token      string
+		user       string
+		ok         bool
+	}{
+		{
+			name: "bearer header",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/api/ingest/osmand?lat=1&lon=1", nil)
+				r.Header.Set("Authorization", "Bearer secret")
+				return r
+			},
+			token: "secret", ok: true,
+		},
+		{
+			name: "basic auth",
+			request: func() *http.Request {
+				r := httptest.NewRequest("POST", "/api/ingest/owntracks", nil)
+				r.SetBasicAuth("PHONE01", "secret")
+				return r
+			},
+			token: "secret", user: "PHONE01", ok: true,
+		},
+		{
+			name: "osmand query token",
+			request: func() *http.Request {
+				return httptest.NewRequest("GET", "/api/ingest/osmand?token=secret&id=PHONE01&lat=1&lon=1", nil)
+			},
+			queryToken: true, token: "secret", ok: true,
+		},
+		{
+			name: "osmand form token",
+			request: func() *http.Request {
+				r := httptest.NewRequest("POST", "/api/ingest/osmand", strings.NewReader("token=secret&lat=1&lon=1"))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return r
+			},
+			queryToken: true, token: "secret", ok: true,
+		},
+		{
+			name: "header wins over query token",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/api/ingest/osmand?token=other", nil)
+				r.Header.Set("Authorization", "Bearer secret")
+				return r
+			},
+			queryToken: true, token: "secret", ok: true,
+		},
+		{
+			name: "query token on another route",
+			request: func() *http.Request {
+				return httptest.NewRequest("POST", "/api/ingest/owntracks?token=secret", nil)
+			},
+		},
+		{
+			name: "no credentials",
+			request: func() *http.Request {
+				return httptest.NewRequest("GET", "/api/ingest/osmand?lat=1&lon=1", nil)
+			},
+			queryToken: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, user, ok := ingestCredentials(tt.request(), tt.queryToken)
+			if token != tt.token || user != tt.user || ok != tt.ok {
+				t.Errorf("ingestCredentials = %q, %q, %t; want %q, %q, %t", token, user, ok, tt.token, tt.user, tt.ok)
+			}
+		})
+	}
+}
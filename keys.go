@@ -0,0 +1,762 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Packets encrypted with a registered device key carry a 5-byte header naming
+// the key: [keyedFrameMarker][KeyID uint32 big-endian]. The header is passed
+// to GCM as additional data so it cannot be swapped onto another packet.
+const (
+	keyedFrameMarker = 0xD1
+	keyedHeaderSize  = 5
+	gcmIVSize        = 12
+	gcmTagSize       = 16
+)
+
+// Key lifecycle: a staged key is registered but not yet accepted (unless its
+// activates_at has passed); an active key is accepted until its expires_at;
+// retired and revoked keys are never accepted. Rotating a device means staging
+// the new key, flashing it, activating it, and letting the old key run out its
+// grace window.
+const (
+	keyStatusStaged  = "staged"
+	keyStatusActive  = "active"
+	keyStatusRetired = "retired"
+	keyStatusRevoked = "revoked"
+)
+
+// DeviceKey is an AES key registered for a single tracker. The key material
+// never leaves the server except in the response that creates it.
+type DeviceKey struct {
+	ID          int        `json:"key_id"`
+	DeviceID    string     `json:"device_id"`
+	Status      string     `json:"status"`
+	KeyBits     int        `json:"key_bits"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatesAt *time.Time `json:"activates_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	UsageCount  int64      `json:"usage_count"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	Valid       bool       `json:"valid"`
+
+	material []byte
+}
+
+// validAt reports whether packets under this key are accepted at time t.
+func (k *DeviceKey) validAt(t time.Time) bool {
+	if k.ExpiresAt != nil && !t.Before(*k.ExpiresAt) {
+		return false
+	}
+	switch k.Status {
+	case keyStatusActive:
+		return k.ActivatesAt == nil || !t.Before(*k.ActivatesAt)
+	case keyStatusStaged:
+		return k.ActivatesAt != nil && !t.Before(*k.ActivatesAt)
+	default:
+		return false
+	}
+}
+
+// keyUsage accumulates uses between flushes to the database.
+type keyUsage struct {
+	count    int64
+	lastUsed time.Time
+}
+
+// KeyStore caches the device_keys table. Lookups miss through to the database
+// so keys created on another instance work immediately; revocations made
+// elsewhere are picked up by the periodic reload.
+//
+// Key ids the database does not know are remembered for keyMissTTL, so a
+// flood of packets naming random key ids costs one query per id rather than
+// one per datagram. Past keyMissLimit remembered ids, unknown ids are not
+// looked up at all until the next reload.
+type KeyStore struct {
+	db          *Database
+	gracePeriod time.Duration
+	mutex       sync.RWMutex
+	keys        map[int]*DeviceKey
+	misses      map[int]time.Time
+	usage       map[int]*keyUsage
+}
+
+const (
+	keyMissTTL   = time.Minute
+	keyMissLimit = 10000
+)
+
+func NewKeyStore(db *Database, gracePeriod time.Duration) *KeyStore {
+	return &KeyStore{
+		db:          db,
+		gracePeriod: gracePeriod,
+		keys:        make(map[int]*DeviceKey),
+		misses:      make(map[int]time.Time),
+		usage:       make(map[int]*keyUsage),
+	}
+}
+
+func validateAESKey(key []byte) error {
+	if len(key) != 16 && len(key) != 32 {
+		return fmt.Errorf("la clave AES debe ser de 16 o 32 bytes, obtenido: %d", len(key))
+	}
+	return nil
+}
+
+func (ks *KeyStore) Run(ctx context.Context) {
+	if err := ks.Reload(); err != nil {
+		log.Printf("Error loading device keys: %v", err)
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ks.flushUsage()
+			return
+		case <-ticker.C:
+			ks.flushUsage()
+			if err := ks.Reload(); err != nil {
+				log.Printf("Error reloading device keys: %v", err)
+			}
+		}
+	}
+}
+
+const deviceKeyColumns = `key_id, device_id, key_material, status, created_at,
+	activates_at, expires_at, revoked_at, usage_count, last_used_at`
+
+func scanDeviceKey(row rowScanner) (*DeviceKey, error) {
+	var key DeviceKey
+	var activatesAt, expiresAt, revokedAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&key.ID, &key.DeviceID, &key.material, &key.Status, &key.CreatedAt,
+		&activatesAt, &expiresAt, &revokedAt, &key.UsageCount, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	key.ActivatesAt = nullTimePtr(activatesAt)
+	key.ExpiresAt = nullTimePtr(expiresAt)
+	key.RevokedAt = nullTimePtr(revokedAt)
+	key.LastUsedAt = nullTimePtr(lastUsedAt)
+	key.KeyBits = len(key.material) * 8
+	key.Valid = key.validAt(time.Now())
+	return &key, nil
+}
+
+func nullTimePtr(v sql.NullTime) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Time
+}
+
+func (ks *KeyStore) Reload() error {
+	rows, err := ks.db.Query(fmt.Sprintf("SELECT %s FROM device_keys", deviceKeyColumns))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	keys := make(map[int]*DeviceKey)
+	for rows.Next() {
+		key, err := scanDeviceKey(rows)
+		if err != nil {
+			return err
+		}
+		keys[key.ID] = key
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ks.mutex.Lock()
+	ks.keys = keys
+	ks.misses = make(map[int]time.Time)
+	ks.mutex.Unlock()
+	return nil
+}
+
+func (ks *KeyStore) lookup(id int) (*DeviceKey, error) {
+	now := time.Now()
+
+	ks.mutex.RLock()
+	key, ok := ks.keys[id]
+	missed, isMiss := ks.misses[id]
+	saturated := len(ks.misses) >= keyMissLimit
+	ks.mutex.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if (isMiss && now.Sub(missed) < keyMissTTL) || (!isMiss && saturated) {
+		return nil, sql.ErrNoRows
+	}
+
+	key, err := scanDeviceKey(ks.db.QueryRow(
+		fmt.Sprintf("SELECT %s FROM device_keys WHERE key_id = $1", deviceKeyColumns), id))
+	if err == sql.ErrNoRows {
+		ks.recordMiss(id, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ks.put(key)
+	return key, nil
+}
+
+// recordMiss remembers that the database has no key with this id, making
+// room by dropping expired misses when the limit is reached.
+func (ks *KeyStore) recordMiss(id int, now time.Time) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	if len(ks.misses) >= keyMissLimit {
+		for missID, missed := range ks.misses {
+			if now.Sub(missed) >= keyMissTTL {
+				delete(ks.misses, missID)
+			}
+		}
+	}
+	ks.misses[id] = now
+}
+
+func (ks *KeyStore) put(key *DeviceKey) {
+	ks.mutex.Lock()
+	ks.keys[key.ID] = key
+	delete(ks.misses, key.ID)
+	ks.mutex.Unlock()
+}
+
+// hasValidDeviceKey reports whether a cached key of the device is accepted
+// at time t, counting keys still inside their grace window. Keys created on
+// another instance count from the next reload.
+func (ks *KeyStore) hasValidDeviceKey(deviceID string, t time.Time) bool {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	for _, key := range ks.keys {
+		if key.DeviceID == deviceID && key.validAt(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ks *KeyStore) recordUse(keyID int) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	u, ok := ks.usage[keyID]
+	if !ok {
+		u = &keyUsage{}
+		ks.usage[keyID] = u
+	}
+	u.count++
+	u.lastUsed = time.Now()
+}
+
+// pendingUsage is the number of uses not yet flushed to the database.
+func (ks *KeyStore) pendingUsage(keyID int) int64 {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	if u, ok := ks.usage[keyID]; ok {
+		return u.count
+	}
+	return 0
+}
+
+func (ks *KeyStore) flushUsage() {
+	ks.mutex.Lock()
+	usage := ks.usage
+	ks.usage = make(map[int]*keyUsage)
+	ks.mutex.Unlock()
+
+	for keyID, u := range usage {
+		_, err := ks.db.Exec(`
+			UPDATE device_keys
+			SET usage_count = usage_count + $2,
+			    last_used_at = GREATEST(last_used_at, $3)
+			WHERE key_id = $1
+		`, keyID, u.count, u.lastUsed)
+		if err != nil {
+			log.Printf("Error flushing usage for key %d: %v", keyID, err)
+		}
+	}
+}
+
+// decryptPacket descifra un paquete AES-GCM.
+// Formatos aceptados:
+//
+//	clave de dispositivo: [0xD1][KeyID(4 bytes)] + [IV(12)] + [Ciphertext] + [Tag(16)]
+//	clave compartida:     [IV(12)] + [Ciphertext] + [Tag(16)]
+//
+// Returns the key that opened the packet, so replies can be sealed with it.
+// A legacy IV can start with the marker byte by chance, so headers naming an
+// unknown key fall back to the shared keys before failing. During a shared key
+// rotation both AES_KEY and AES_KEY_PREVIOUS are tried until the previous one
+// expires.
+func (ks *KeyStore) decryptPacket(encryptedData []byte) ([]byte, *packetKey, error) {
+	now := time.Now()
+
+	var keyedErr error
+	if len(encryptedData) >= keyedHeaderSize && encryptedData[0] == keyedFrameMarker {
+		header := encryptedData[:keyedHeaderSize]
+		keyID := int(binary.BigEndian.Uint32(header[1:]))
+
+		key, err := ks.lookup(keyID)
+		switch {
+		case err == sql.ErrNoRows:
+			keyedErr = fmt.Errorf("clave %d desconocida", keyID)
+		case err != nil:
+			return nil, nil, fmt.Errorf("error buscando clave %d: %w", keyID, err)
+		case !key.validAt(now):
+			keyedErr = fmt.Errorf("clave %d no válida (%s)", keyID, key.Status)
+		default:
+			plaintext, err := openGCM(key.material, header, encryptedData[keyedHeaderSize:])
+			if err == nil {
+				ks.recordUse(key.ID)
+				return plaintext, &packetKey{Device: key}, nil
+			}
+			keyedErr = fmt.Errorf("clave %d: %w", keyID, err)
+		}
+	}
+
+	tried := 0
+	for _, shared := range sharedKeys {
+		if !shared.validAt(now) {
+			continue
+		}
+		tried++
+		plaintext, err := openGCM(shared.material, nil, encryptedData)
+		if err == nil {
+			shared.recordUse()
+			return plaintext, &packetKey{shared: shared}, nil
+		}
+	}
+
+	switch {
+	case tried == 0 && keyedErr == nil:
+		return nil, nil, fmt.Errorf("paquete sin cabecera de clave y ninguna clave compartida vigente")
+	case tried == 0:
+		return nil, nil, keyedErr
+	case keyedErr != nil:
+		return nil, nil, fmt.Errorf("%v; claves compartidas (%d): tag inválido o datos corruptos", keyedErr, tried)
+	default:
+		return nil, nil, fmt.Errorf("error descifrando con %d clave(s) compartida(s) (tag inválido o datos corruptos)", tried)
+	}
+}
+
+// packetKey is the key that opened a packet: a device key, or a shared key
+// when Device is nil.
+type packetKey struct {
+	Device *DeviceKey
+	shared *SharedKey
+}
+
+// seal cifra una respuesta al dispositivo en el mismo formato que usó él:
+// con cabecera de clave si llegó con clave de dispositivo, sin ella si no.
+func (k *packetKey) seal(plaintext []byte) ([]byte, error) {
+	if k.Device == nil {
+		return sealGCM(k.shared.material, nil, nil, plaintext)
+	}
+
+	header := make([]byte, keyedHeaderSize)
+	header[0] = keyedFrameMarker
+	binary.BigEndian.PutUint32(header[1:], uint32(k.Device.ID))
+	return sealGCM(k.Device.material, header, header, plaintext)
+}
+
+// sealGCM appends [IV(12)][Ciphertext][Tag(16)] to dst, authenticating
+// additionalData as well.
+func sealGCM(key, dst, additionalData, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creando cipher AES: %w", err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creando GCM: %w", err)
+	}
+
+	iv := make([]byte, gcmIVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	return aesgcm.Seal(append(dst, iv...), iv, plaintext, additionalData), nil
+}
+
+// openGCM opens [IV(12)][Ciphertext][Tag(16)] with the given key and
+// additional authenticated data.
+func openGCM(key, additionalData, data []byte) ([]byte, error) {
+	// Validar tamaño mínimo: IV(12) + Tag(16) = 28 bytes
+	if len(data) < gcmIVSize+gcmTagSize {
+		return nil, fmt.Errorf("paquete demasiado pequeño: %d bytes (mínimo %d)", len(data), gcmIVSize+gcmTagSize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creando cipher AES: %w", err)
+	}
+
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creando GCM: %w", err)
+	}
+
+	// Ciphertext y tag van contiguos, tal como los espera Open
+	plaintext, err := aesgcm.Open(nil, data[:gcmIVSize], data[gcmIVSize:], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("error descifrando (tag inválido o datos corruptos): %w", err)
+	}
+	return plaintext, nil
+}
+
+// API handlers
+
+// requireAdmin guards routes that weaken device authentication, starting with
+// the key registry: whoever can register or change keys can impersonate any
+// device. They need ADMIN_TOKEN as a Bearer token and are disabled without one.
+func (api *APIServer) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.adminToken == "" {
+			http.Error(w, "Admin API disabled (ADMIN_TOKEN not set)", http.StatusServiceUnavailable)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="location-tracker"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (api *APIServer) getKeysHandler(w http.ResponseWriter, r *http.Request) {
+	query := fmt.Sprintf("SELECT %s FROM device_keys", deviceKeyColumns)
+	args := []interface{}{}
+	if deviceID := r.URL.Query().Get("device_id"); deviceID != "" {
+		query += " WHERE device_id = $1"
+		args = append(args, deviceID)
+	}
+	query += " ORDER BY created_at DESC"
+
+	rows, err := api.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying device keys: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var keys []*DeviceKey
+	for rows.Next() {
+		key, err := scanDeviceKey(rows)
+		if err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		key.UsageCount += api.keys.pendingUsage(key.ID)
+		keys = append(keys, key)
+	}
+
+	if keys == nil {
+		keys = []*DeviceKey{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// createKeyHandler registers a key for a device. The caller either supplies
+// hex key material or lets the server generate a 128 or 256-bit key; the
+// material is returned once, in this response only. With "stage" (or an
+// activates_at time) the key is registered as staged for a later rotation,
+// otherwise it is active immediately.
+func (api *APIServer) createKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		DeviceID    string     `json:"device_id"`
+		Key         string     `json:"key"`
+		Bits        int        `json:"bits"`
+		Stage       bool       `json:"stage"`
+		ActivatesAt *time.Time `json:"activates_at"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if input.DeviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var material []byte
+	if input.Key != "" {
+		var err error
+		material, err = hex.DecodeString(input.Key)
+		if err != nil {
+			http.Error(w, "key must be hex encoded", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if input.Bits == 0 {
+			input.Bits = 128
+		}
+		material = make([]byte, input.Bits/8)
+		if _, err := rand.Read(material); err != nil {
+			http.Error(w, "Failed to generate key", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := validateAESKey(material); err != nil {
+		http.Error(w, "Key must be 128 or 256 bits", http.StatusBadRequest)
+		return
+	}
+
+	status := keyStatusActive
+	if input.Stage || input.ActivatesAt != nil {
+		status = keyStatusStaged
+	}
+
+	key, err := scanDeviceKey(api.db.QueryRow(fmt.Sprintf(`
+		INSERT INTO device_keys (device_id, key_material, status, activates_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING %s
+	`, deviceKeyColumns), input.DeviceID, material, status, input.ActivatesAt, input.ExpiresAt))
+	if err != nil {
+		log.Printf("Error creating device key: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	api.keys.put(key)
+
+	log.Printf("🔑 Registered %s key %d for device %s (%d bits)", key.Status, key.ID, key.DeviceID, key.KeyBits)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		*DeviceKey
+		Key string `json:"key"`
+	}{key, hex.EncodeToString(material)})
+}
+
+func (api *APIServer) revokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid key id", http.StatusBadRequest)
+		return
+	}
+
+	key, err := scanDeviceKey(api.db.QueryRow(fmt.Sprintf(`
+		UPDATE device_keys
+		SET status = $2, revoked_at = COALESCE(revoked_at, NOW())
+		WHERE key_id = $1
+		RETURNING %s
+	`, deviceKeyColumns), keyID, keyStatusRevoked))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error revoking device key: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	api.keys.put(key)
+
+	log.Printf("🔒 Revoked key %d for device %s", key.ID, key.DeviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
+
+// activateKeyHandler makes a staged key active now and starts the grace
+// window on the device's other active keys: they keep working until
+// now + grace (KEY_GRACE_PERIOD unless the request overrides it), which gives
+// the fleet time to pick up the new key.
+func (api *APIServer) activateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid key id", http.StatusBadRequest)
+		return
+	}
+
+	grace, ok := parseGrace(w, r, api.keys.gracePeriod)
+	if !ok {
+		return
+	}
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	key, err := scanDeviceKey(tx.QueryRow(fmt.Sprintf(`
+		UPDATE device_keys
+		SET status = $2, activates_at = NOW(), expires_at = NULL
+		WHERE key_id = $1 AND status IN ($3, $2)
+		RETURNING %s
+	`, deviceKeyColumns), keyID, keyStatusActive, keyStatusStaged))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Key not found or not activatable", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error activating device key: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(`
+		UPDATE device_keys
+		SET expires_at = LEAST(COALESCE(expires_at, 'infinity'), NOW() + make_interval(secs => $3))
+		WHERE device_id = $1 AND key_id <> $2 AND status = $4
+		RETURNING %s
+	`, deviceKeyColumns), key.DeviceID, key.ID, grace.Seconds(), keyStatusActive)
+	if err != nil {
+		log.Printf("Error starting key grace window: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var previous []*DeviceKey
+	for rows.Next() {
+		prev, err := scanDeviceKey(rows)
+		if err != nil {
+			continue
+		}
+		previous = append(previous, prev)
+	}
+	rows.Close()
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error activating device key: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	api.keys.put(key)
+	for _, prev := range previous {
+		api.keys.put(prev)
+	}
+
+	log.Printf("🔑 Activated key %d for device %s (%d previous key(s) expire in %s)",
+		key.ID, key.DeviceID, len(previous), grace)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":      key,
+		"retiring": previous,
+	})
+}
+
+// retireKeyHandler ends a key's life. Without a grace period the key stops
+// working immediately; with one it keeps working until the grace runs out.
+func (api *APIServer) retireKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid key id", http.StatusBadRequest)
+		return
+	}
+
+	grace, ok := parseGrace(w, r, 0)
+	if !ok {
+		return
+	}
+
+	query := `
+		UPDATE device_keys
+		SET status = $2, expires_at = NOW()
+		WHERE key_id = $1 AND status <> $3
+		RETURNING %s
+	`
+	args := []interface{}{keyID, keyStatusRetired, keyStatusRevoked}
+	if grace > 0 {
+		query = `
+		UPDATE device_keys
+		SET expires_at = NOW() + make_interval(secs => $2)
+		WHERE key_id = $1 AND status <> $3
+		RETURNING %s
+	`
+		args = []interface{}{keyID, grace.Seconds(), keyStatusRevoked}
+	}
+
+	key, err := scanDeviceKey(api.db.QueryRow(fmt.Sprintf(query, deviceKeyColumns), args...))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Key not found or revoked", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retiring device key: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	api.keys.put(key)
+
+	log.Printf("🔑 Retiring key %d for device %s (grace %s)", key.ID, key.DeviceID, grace)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
+
+// parseGrace reads an optional {"grace": "<duration>"} body.
+func parseGrace(w http.ResponseWriter, r *http.Request, defaultGrace time.Duration) (time.Duration, bool) {
+	var input struct {
+		Grace string `json:"grace"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil && err != io.EOF {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return 0, false
+		}
+	}
+	if input.Grace == "" {
+		return defaultGrace, true
+	}
+
+	grace, err := time.ParseDuration(input.Grace)
+	if err != nil || grace < 0 {
+		http.Error(w, "Invalid grace duration", http.StatusBadRequest)
+		return 0, false
+	}
+	return grace, true
+}
+
+// sharedKeysHandler reports the shared (headerless) keys without their material.
+func (api *APIServer) sharedKeysHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	keys := []map[string]interface{}{}
+	for _, shared := range sharedKeys {
+		keys = append(keys, map[string]interface{}{
+			"name":        shared.Name,
+			"key_bits":    len(shared.material) * 8,
+			"expires_at":  shared.ExpiresAt,
+			"valid":       shared.validAt(now),
+			"usage_count": shared.uses.Load(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodePacketRejectsSharedKeyForKeyedDevice(t *testing.T) {
+	shared := &SharedKey{Name: "current", material: make([]byte, 16)}
+	defer func(keys []*SharedKey) { sharedKeys = keys }(sharedKeys)
+	sharedKeys = []*SharedKey{shared}
+
+	ks := NewKeyStore(nil, time.Hour)
+	grace := time.Now().Add(time.Hour)
+	ks.put(&DeviceKey{ID: 1, DeviceID: "truck-7", Status: keyStatusActive, ExpiresAt: &grace, material: make([]byte, 32)})
+	ks.put(&DeviceKey{ID: 2, DeviceID: "truck-8", Status: keyStatusStaged, material: make([]byte, 32)})
+	ing := &Ingestor{keys: ks, maxClockSkew: time.Hour}
+
+	decode := func(plaintext string) error {
+		t.Helper()
+		packet, err := sealGCM(shared.material, nil, nil, []byte(plaintext))
+		if err != nil {
+			t.Fatalf("sealGCM: %v", err)
+		}
+		_, err = ing.decodePacket(packet)
+		return err
+	}
+
+	// truck-7's key is in its grace window, so it still counts
+	if err := decode("truck-7,40.4,-3.7"); err == nil || !strings.Contains(err.Error(), "has its own key") {
+		t.Errorf("shared-key packet for a keyed device: err = %v, want rejection", err)
+	}
+	// A staged key is not in use yet
+	if err := decode("truck-8,40.4,-3.7"); err != nil {
+		t.Errorf("shared-key packet for a device with a staged key: %v", err)
+	}
+	if err := decode("truck-9,40.4,-3.7"); err != nil {
+		t.Errorf("shared-key packet for a device without keys: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// LeaderElector makes sure only one instance of a group runs the listeners
+// that would otherwise ingest the same data twice (UDP and MQTT). Instances
+// compete for a lease row in leader_leases: the holder renews it every third
+// of its TTL, and anyone may take it over once it has expired. All lease
+// times come from the database clock, so instance clocks do not matter.
+//
+// A leader that cannot renew steps down within five sixths of a TTL after its
+// last successful renewal (renewals time out after half an interval), before
+// any other instance can take over; a crashed leader is replaced at most TTL
+// plus one renewal interval later. A leader shutting down deletes its lease
+// so the handover is immediate, and so does a leader whose listeners stopped
+// on their own (e.g. the UDP port could not be bound); it then sits out one
+// TTL so another instance can take over.
+type LeaderElector struct {
+	db         *Database
+	group      string
+	instanceID string
+	ttl        time.Duration
+	enabled    bool
+
+	mutex     sync.Mutex
+	status    LeaderStatus
+	renewedAt time.Time // local time of the last successful renewal attempt
+}
+
+// minLeaderLeaseTTL leaves a deposed leader time to stop its listeners (the
+// UDP reader notices within its 2 s read deadline) before the lease expires.
+const minLeaderLeaseTTL = 10 * time.Second
+
+// LeaderStatus is reported by /api/health.
+type LeaderStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Group      string     `json:"group"`
+	InstanceID string     `json:"instance_id"`
+	IsLeader   bool       `json:"is_leader"`
+	Leader     string     `json:"leader,omitempty"`
+	LeaderFrom *time.Time `json:"leader_since,omitempty"`
+	ExpiresAt  *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+func NewLeaderElector(db *Database, config *Config) *LeaderElector {
+	instanceID := config.InstanceID
+	if instanceID == "" {
+		hostname, _ := os.Hostname()
+		instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	ttl := config.LeaderLeaseTTL
+	if ttl < minLeaderLeaseTTL {
+		log.Printf("Leader lease TTL %s too short, using %s", ttl, minLeaderLeaseTTL)
+		ttl = minLeaderLeaseTTL
+	}
+
+	return &LeaderElector{
+		db:         db,
+		group:      config.LeaderGroup,
+		instanceID: instanceID,
+		ttl:        ttl,
+		enabled:    config.LeaderElection,
+		status: LeaderStatus{
+			Enabled:    config.LeaderElection,
+			Group:      config.LeaderGroup,
+			InstanceID: instanceID,
+		},
+	}
+}
+
+// Run calls lead with a context that is cancelled when leadership is lost or
+// ctx is done, every time this instance becomes leader. If lead returns
+// before that, the lease is released. Run returns once lead has returned
+// after ctx is done.
+func (le *LeaderElector) Run(ctx context.Context, lead func(context.Context)) {
+	if !le.enabled {
+		le.mutex.Lock()
+		le.status.IsLeader = true
+		le.status.Leader = le.instanceID
+		le.mutex.Unlock()
+		lead(ctx)
+		return
+	}
+
+	log.Printf("Leader election for group %q as %s (lease %s)", le.group, le.instanceID, le.ttl)
+
+	interval := le.ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// stopLeading and leading are set while lead runs
+	var stopLeading func()
+	var leading <-chan struct{}
+	// Set after lead returned on its own, so another instance can take over
+	var sitOutUntil time.Time
+
+	for {
+		isLeader := !time.Now().Before(sitOutUntil) && le.renew(ctx)
+		switch {
+		case isLeader && stopLeading == nil:
+			log.Printf("👑 %s is now the leader of %q", le.instanceID, le.group)
+			stopLeading, leading = startLeading(ctx, lead)
+		case !isLeader && stopLeading != nil:
+			log.Printf("⚠️  %s lost leadership of %q, stopping ingestion", le.instanceID, le.group)
+			stopLeading()
+			stopLeading, leading = nil, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if stopLeading != nil {
+				stopLeading()
+			}
+			le.release()
+			return
+		case <-leading:
+			log.Printf("⚠️  %s stopped leading %q on its own, releasing the lease", le.instanceID, le.group)
+			stopLeading()
+			stopLeading, leading = nil, nil
+			le.release()
+			sitOutUntil = time.Now().Add(le.ttl)
+		case <-ticker.C:
+		}
+	}
+}
+
+// startLeading runs lead in the background. The returned function cancels it
+// and waits for it to return; the channel is closed once it has returned.
+func startLeading(ctx context.Context, lead func(context.Context)) (func(), <-chan struct{}) {
+	leadCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(leadCtx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, done
+}
+
+// renew acquires or extends the lease and reports whether this instance may
+// act as leader.
+func (le *LeaderElector) renew(ctx context.Context) bool {
+	attempt := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, le.ttl/6)
+	defer cancel()
+
+	var holder string
+	var since, expires time.Time
+	err := le.db.QueryRowContext(ctx, `
+		INSERT INTO leader_leases (name, holder, acquired_at, expires_at)
+		VALUES ($1, $2, NOW(), NOW() + $3 * INTERVAL '1 millisecond')
+		ON CONFLICT (name) DO UPDATE
+		SET holder = EXCLUDED.holder,
+		    acquired_at = CASE WHEN leader_leases.holder = EXCLUDED.holder
+		                       THEN leader_leases.acquired_at ELSE NOW() END,
+		    expires_at = EXCLUDED.expires_at
+		WHERE leader_leases.holder = EXCLUDED.holder OR leader_leases.expires_at < NOW()
+		RETURNING holder, acquired_at, expires_at
+	`, le.group, le.instanceID, le.ttl.Milliseconds()).Scan(&holder, &since, &expires)
+	if err == sql.ErrNoRows {
+		// Someone else holds a live lease
+		err = le.db.QueryRowContext(ctx, `
+			SELECT holder, acquired_at, expires_at FROM leader_leases WHERE name = $1
+		`, le.group).Scan(&holder, &since, &expires)
+	}
+
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Error renewing leader lease: %v", err)
+		// Keep leading on a database hiccup, but stop well before the
+		// lease can expire and another instance take over
+		stillValid := le.status.IsLeader && time.Since(le.renewedAt) < le.ttl/2
+		le.status.IsLeader = stillValid
+		return stillValid
+	}
+
+	le.status.IsLeader = holder == le.instanceID
+	le.status.Leader = holder
+	le.status.LeaderFrom = &since
+	le.status.ExpiresAt = &expires
+	if le.status.IsLeader {
+		le.renewedAt = attempt
+	}
+	return le.status.IsLeader
+}
+
+func (le *LeaderElector) release() {
+	_, err := le.db.Exec("DELETE FROM leader_leases WHERE name = $1 AND holder = $2", le.group, le.instanceID)
+	if err != nil {
+		log.Printf("Error releasing leader lease: %v", err)
+	}
+
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	le.status.IsLeader = false
+}
+
+func (le *LeaderElector) Status() LeaderStatus {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return le.status
+}
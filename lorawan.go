@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoRaWAN trackers reach us through the HTTP integrations of their network
+// server. The Things Stack and ChirpStack post each uplink as JSON with the
+// application payload (FRMPayload) base64 encoded; it is turned into fixes by
+// a payload decoder chosen per device model:
+//
+//	native   the compact binary payload of binary_codec.go
+//	cayenne  Cayenne LPP (GPS channels become fixes, the rest attributes)
+//	decoded  the network server's own decoded object, read for latitude,
+//	         longitude, altitude, speed, heading, hdop, satellites, battery
+//
+// LORAWAN_DECODER picks the default and LORAWAN_MODEL_DECODERS overrides it
+// per model ("rak7200:cayenne,my-tracker:native"). The model is the TTS
+// model_id or the ChirpStack device profile name. Devices are identified by
+// their DevEUI; the strongest gateway's RSSI and SNR are kept as attributes.
+
+type loraPayloadDecoder func(frm []byte, decoded map[string]interface{}) ([]*LocationPacket, error)
+
+var loraPayloadDecoders = map[string]loraPayloadDecoder{
+	"native":  decodeLoRaBinary,
+	"cayenne": decodeCayenneLPP,
+	"decoded": decodeLoRaObject,
+}
+
+// LoRaWANDecoders resolves the payload decoder for a device model.
+type LoRaWANDecoders struct {
+	fallback string
+	models   map[string]string
+}
+
+func NewLoRaWANDecoders(config *Config) (*LoRaWANDecoders, error) {
+	d := &LoRaWANDecoders{fallback: config.LoRaWANDecoder, models: make(map[string]string)}
+	if _, ok := loraPayloadDecoders[d.fallback]; !ok {
+		return nil, fmt.Errorf("unknown LoRaWAN decoder %q", d.fallback)
+	}
+
+	for _, entry := range strings.Split(config.LoRaWANModelDecoders, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, decoder, ok := strings.Cut(entry, ":")
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid model decoder %q, expected <model>:<decoder>", entry)
+		}
+		if _, ok := loraPayloadDecoders[decoder]; !ok {
+			return nil, fmt.Errorf("unknown LoRaWAN decoder %q for model %s", decoder, model)
+		}
+		d.models[model] = decoder
+	}
+	return d, nil
+}
+
+func (d *LoRaWANDecoders) forModel(model string) (string, loraPayloadDecoder) {
+	name, ok := d.models[model]
+	if !ok {
+		name = d.fallback
+	}
+	return name, loraPayloadDecoders[name]
+}
+
+// loraUplink is what both network servers' formats boil down to.
+type loraUplink struct {
+	DevEUI     string
+	Model      string
+	FPort      int
+	FCnt       uint32
+	Payload    []byte
+	Decoded    map[string]interface{}
+	ReceivedAt time.Time
+	Gateways   []loraGateway
+}
+
+type loraGateway struct {
+	ID   string
+	RSSI float64
+	SNR  float64
+}
+
+// ttsUplinkHandler accepts The Things Stack (v3) webhook uplink messages.
+func (api *APIServer) ttsUplinkHandler(w http.ResponseWriter, r *http.Request) {
+	if !api.authorizeIngest(w, r) {
+		return
+	}
+
+	var msg struct {
+		EndDeviceIDs struct {
+			DevEUI string `json:"dev_eui"`
+		} `json:"end_device_ids"`
+		ReceivedAt    time.Time `json:"received_at"`
+		UplinkMessage *struct {
+			FPort          int                    `json:"f_port"`
+			FCnt           uint32                 `json:"f_cnt"`
+			FRMPayload     []byte                 `json:"frm_payload"` // base64
+			DecodedPayload map[string]interface{} `json:"decoded_payload"`
+			RxMetadata     []struct {
+				GatewayIDs struct {
+					GatewayID string `json:"gateway_id"`
+				} `json:"gateway_ids"`
+				RSSI float64 `json:"rssi"`
+				SNR  float64 `json:"snr"`
+			} `json:"rx_metadata"`
+			VersionIDs struct {
+				ModelID string `json:"model_id"`
+			} `json:"version_ids"`
+		} `json:"uplink_message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if msg.UplinkMessage == nil {
+		// Join accepts, downlink events... nothing to store
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	uplink := &loraUplink{
+		DevEUI:     msg.EndDeviceIDs.DevEUI,
+		Model:      msg.UplinkMessage.VersionIDs.ModelID,
+		FPort:      msg.UplinkMessage.FPort,
+		FCnt:       msg.UplinkMessage.FCnt,
+		Payload:    msg.UplinkMessage.FRMPayload,
+		Decoded:    msg.UplinkMessage.DecodedPayload,
+		ReceivedAt: msg.ReceivedAt,
+	}
+	for _, rx := range msg.UplinkMessage.RxMetadata {
+		uplink.Gateways = append(uplink.Gateways, loraGateway{ID: rx.GatewayIDs.GatewayID, RSSI: rx.RSSI, SNR: rx.SNR})
+	}
+	api.ingestLoRaUplink(w, uplink, "tts")
+}
+
+// chirpstackUplinkHandler accepts ChirpStack (v4) HTTP integration events.
+// Only "up" events carry fixes; the others are acknowledged and ignored.
+func (api *APIServer) chirpstackUplinkHandler(w http.ResponseWriter, r *http.Request) {
+	if !api.authorizeIngest(w, r) {
+		return
+	}
+	if event := r.URL.Query().Get("event"); event != "" && event != "up" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var msg struct {
+		Time       time.Time `json:"time"`
+		DeviceInfo struct {
+			DevEUI            string `json:"devEui"`
+			DeviceProfileName string `json:"deviceProfileName"`
+		} `json:"deviceInfo"`
+		FPort  int                    `json:"fPort"`
+		FCnt   uint32                 `json:"fCnt"`
+		Data   []byte                 `json:"data"` // base64
+		Object map[string]interface{} `json:"object"`
+		RxInfo []struct {
+			GatewayID string  `json:"gatewayId"`
+			RSSI      float64 `json:"rssi"`
+			SNR       float64 `json:"snr"`
+		} `json:"rxInfo"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	uplink := &loraUplink{
+		DevEUI:     msg.DeviceInfo.DevEUI,
+		Model:      msg.DeviceInfo.DeviceProfileName,
+		FPort:      msg.FPort,
+		FCnt:       msg.FCnt,
+		Payload:    msg.Data,
+		Decoded:    msg.Object,
+		ReceivedAt: msg.Time,
+	}
+	for _, rx := range msg.RxInfo {
+		uplink.Gateways = append(uplink.Gateways, loraGateway{ID: rx.GatewayID, RSSI: rx.RSSI, SNR: rx.SNR})
+	}
+	api.ingestLoRaUplink(w, uplink, "chirpstack")
+}
+
+func (api *APIServer) ingestLoRaUplink(w http.ResponseWriter, uplink *loraUplink, source string) {
+	if uplink.DevEUI == "" {
+		http.Error(w, "Missing DevEUI", http.StatusBadRequest)
+		return
+	}
+	deviceID := strings.ToUpper(uplink.DevEUI)
+
+	name, decode := api.lorawan.forModel(uplink.Model)
+	fixes, err := decode(uplink.Payload, uplink.Decoded)
+	if err != nil {
+		log.Printf("❌ LoRaWAN %s uplink from %s rejected by %s decoder: %v", source, deviceID, name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(fixes) == 0 {
+		// Status-only uplink (no GPS fix yet)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	metadata := map[string]interface{}{
+		"f_port":   uplink.FPort,
+		"f_cnt":    uplink.FCnt,
+		"gateways": len(uplink.Gateways),
+	}
+	// The strongest gateway describes the link best
+	if len(uplink.Gateways) > 0 {
+		best := uplink.Gateways[0]
+		for _, gw := range uplink.Gateways[1:] {
+			if gw.RSSI > best.RSSI {
+				best = gw
+			}
+		}
+		metadata["rssi"], metadata["snr"], metadata["gateway"] = best.RSSI, best.SNR, best.ID
+	}
+
+	payload := &Payload{DeviceID: deviceID}
+	for _, packet := range fixes {
+		// A payload naming another device must not be filed under this one
+		if packet.DeviceID != "" && !strings.EqualFold(packet.DeviceID, deviceID) {
+			log.Printf("❌ LoRaWAN %s uplink from %s carries device id %s", source, deviceID, packet.DeviceID)
+			http.Error(w, "Payload device id does not match DevEUI", http.StatusBadRequest)
+			return
+		}
+		packet.DeviceID = deviceID
+		if packet.Timestamp.IsZero() && !uplink.ReceivedAt.IsZero() {
+			packet.Timestamp = uplink.ReceivedAt.UTC()
+		}
+		if packet.Attributes == nil {
+			packet.Attributes = make(map[string]interface{}, len(metadata))
+		}
+		for k, v := range metadata {
+			packet.Attributes[k] = v
+		}
+		if err := validateTelemetry(packet); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload.Fixes = append(payload.Fixes, packet)
+	}
+	api.ingestor.stampReceived(payload)
+
+	log.Printf("📶 LoRaWAN %s uplink from %s (%d fixes, %s decoder)", source, deviceID, len(payload.Fixes), name)
+	// Quarantined devices still get 204: network servers suspend webhooks
+	// that keep failing, which would cut off every other device
+	if err := api.pipeline.Ingest(payload); err != nil && !errors.Is(err, errDeviceNotAdmitted) {
+		http.Error(w, "Failed to store location", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeLoRaBinary reads the compact binary payload. Its device id may be
+// left empty to save airtime, since the DevEUI identifies the device; a
+// device id that is set is kept on the fixes, so ingestLoRaUplink can check
+// it against the DevEUI.
+func decodeLoRaBinary(frm []byte, _ map[string]interface{}) ([]*LocationPacket, error) {
+	if len(frm) == 0 {
+		return nil, nil
+	}
+	payload, err := decodeBinary(frm, true)
+	if err != nil {
+		return nil, err
+	}
+	return payload.Fixes, nil
+}
+
+// Cayenne LPP data types: size in bytes and attribute name. GPS (0x88) is
+// handled separately.
+var cayenneTypes = map[byte]struct {
+	size  int
+	name  string
+	scale float64
+	sign  bool
+}{
+	0x00: {1, "digital_in", 1, false},
+	0x01: {1, "digital_out", 1, false},
+	0x02: {2, "analog_in", 0.01, true},
+	0x03: {2, "analog_out", 0.01, true},
+	0x65: {2, "illuminance", 1, false},
+	0x66: {1, "presence", 1, false},
+	0x67: {2, "temperature", 0.1, true},
+	0x68: {1, "humidity", 0.5, false},
+	0x73: {2, "barometer", 0.1, false},
+}
+
+const (
+	cayenneGPS           = 0x88
+	cayenneAccelerometer = 0x71
+	cayenneGyrometer     = 0x86
+)
+
+// decodeCayenneLPP reads [channel][type][value] records. Each GPS record
+// (lat, lng: 3 bytes signed × 0.0001°, alt: 3 bytes signed × 0.01 m) becomes
+// a fix; other values are attached to every fix as "<name>_<channel>".
+func decodeCayenneLPP(frm []byte, _ map[string]interface{}) ([]*LocationPacket, error) {
+	var fixes []*LocationPacket
+	attributes := make(map[string]interface{})
+
+	for len(frm) > 0 {
+		if len(frm) < 2 {
+			return nil, fmt.Errorf("truncated Cayenne LPP record")
+		}
+		channel, dataType, data := frm[0], frm[1], frm[2:]
+
+		switch dataType {
+		case cayenneGPS:
+			if len(data) < 9 {
+				return nil, fmt.Errorf("truncated Cayenne LPP GPS record")
+			}
+			alt := float64(int24(data[6:])) / 100
+			fixes = append(fixes, &LocationPacket{
+				Latitude:  float64(int24(data[0:])) / 10000,
+				Longitude: float64(int24(data[3:])) / 10000,
+				Altitude:  &alt,
+			})
+			frm = data[9:]
+
+		case cayenneAccelerometer, cayenneGyrometer:
+			if len(data) < 6 {
+				return nil, fmt.Errorf("truncated Cayenne LPP record")
+			}
+			frm = data[6:]
+
+		default:
+			t, ok := cayenneTypes[dataType]
+			if !ok {
+				return nil, fmt.Errorf("unsupported Cayenne LPP type 0x%02X", dataType)
+			}
+			if len(data) < t.size {
+				return nil, fmt.Errorf("truncated Cayenne LPP %s record", t.name)
+			}
+			var raw int64
+			if t.size == 2 {
+				raw = int64(binary.BigEndian.Uint16(data))
+				if t.sign {
+					raw = int64(int16(raw))
+				}
+			} else {
+				raw = int64(data[0])
+			}
+			attributes[t.name+"_"+strconv.Itoa(int(channel))] = float64(raw) * t.scale
+			frm = data[t.size:]
+		}
+	}
+
+	for _, packet := range fixes {
+		if packet.Latitude < -90 || packet.Latitude > 90 || packet.Longitude < -180 || packet.Longitude > 180 {
+			return nil, fmt.Errorf("out-of-range coordinates: lat=%f, lng=%f", packet.Latitude, packet.Longitude)
+		}
+		packet.Attributes = make(map[string]interface{}, len(attributes))
+		for k, v := range attributes {
+			packet.Attributes[k] = v
+		}
+	}
+	return fixes, nil
+}
+
+func int24(b []byte) int32 {
+	v := int32(b[0])<<16 | int32(b[1])<<8 | int32(b[2])
+	if v&0x800000 != 0 {
+		v -= 1 << 24
+	}
+	return v
+}
+
+// decodeLoRaObject reads the object decoded by the network server's payload
+// formatter. Uplinks without coordinates yield no fix.
+func decodeLoRaObject(_ []byte, decoded map[string]interface{}) ([]*LocationPacket, error) {
+	number := func(keys ...string) *float64 {
+		for _, key := range keys {
+			if v, ok := decoded[key].(float64); ok {
+				return &v
+			}
+		}
+		return nil
+	}
+
+	lat, lng := number("latitude", "lat"), number("longitude", "lng", "lon")
+	if lat == nil || lng == nil {
+		return nil, nil
+	}
+	if *lat < -90 || *lat > 90 || *lng < -180 || *lng > 180 {
+		return nil, fmt.Errorf("out-of-range coordinates: lat=%f, lng=%f", *lat, *lng)
+	}
+	if *lat == 0 && *lng == 0 {
+		return nil, nil // trackers without a fix commonly report 0,0
+	}
+
+	packet := &LocationPacket{
+		Latitude:       *lat,
+		Longitude:      *lng,
+		Altitude:       number("altitude", "alt"),
+		Speed:          number("speed"),
+		Heading:        number("heading", "course"),
+		HDOP:           number("hdop"),
+		Accuracy:       number("accuracy"),
+		BatteryVoltage: number("battery", "batV"),
+	}
+	if sats := number("satellites", "sats"); sats != nil {
+		n := int(*sats)
+		packet.Satellites = &n
+	}
+	return []*LocationPacket{packet}, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeLoRaBinaryDeviceID(t *testing.T) {
+	fix := &LocationPacket{Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Latitude: 52.52, Longitude: 13.405}
+
+	named, err := encodeBinaryPayload(&Payload{DeviceID: "70B3D57ED005A1B2", Fixes: []*LocationPacket{fix}})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	// The same payload with a zero-length device id, as firmware sends it
+	// to save airtime
+	anonymous := append([]byte{named[0], named[1], 0x00}, named[3+len("70B3D57ED005A1B2"):]...)
+
+	tests := []struct {
+		name   string
+		frm    []byte
+		device string
+	}{
+		{"device id left empty", anonymous, ""},
+		{"device id set", named, "70B3D57ED005A1B2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixes, err := decodeLoRaBinary(tt.frm, nil)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if len(fixes) != 1 || fixes[0].DeviceID != tt.device || fixes[0].Latitude != 52.52 {
+				t.Errorf("fixes %+v", fixes)
+			}
+		})
+	}
+
+	// Outside LoRaWAN nothing else identifies the device
+	if _, err := decodeBinaryPayload(anonymous); err == nil {
+		t.Error("decodeBinaryPayload accepted an empty device id")
+	}
+}
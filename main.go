@@ -2,93 +2,106 @@ package main
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	_ "github.com/paulmach/orb"
 	_ "github.com/paulmach/orb/encoding/wkt"
 	_ "github.com/paulmach/orb/geojson"
 )
 
 // ========== CONFIGURACIÓN DE ENCRIPTACIÓN ==========
-// La clave AES-128 se lee desde variable de entorno
-var aesKey []byte
+// Las claves compartidas AES-128/256 se leen desde variables de entorno. Son
+// opcionales: los dispositivos con clave propia se registran en device_keys
+// (ver keys.go) y estas claves solo descifran paquetes sin cabecera de clave.
+//
+// Para rotar la clave compartida sin reprogramar toda la flota a la vez:
+// AES_KEY pasa a ser la nueva clave y la anterior se mueve a AES_KEY_PREVIOUS,
+// que se sigue aceptando hasta AES_KEY_PREVIOUS_EXPIRES (RFC3339, opcional).
+type SharedKey struct {
+	Name      string
+	ExpiresAt *time.Time
+
+	material []byte
+	uses     atomic.Int64
+}
+
+func (k *SharedKey) validAt(t time.Time) bool {
+	return k.ExpiresAt == nil || t.Before(*k.ExpiresAt)
+}
+
+func (k *SharedKey) recordUse() {
+	k.uses.Add(1)
+}
+
+// Claves compartidas en orden de preferencia (la actual primero)
+var sharedKeys []*SharedKey
 
 func initEncryption() error {
-	// Leer la clave desde variable de entorno
-	aesKeyHex := os.Getenv("AES_KEY")
-	if aesKeyHex == "" {
-		return fmt.Errorf("AES_KEY requerida pero no encontrada")
+	current, err := loadSharedKey("AES_KEY", "current")
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		log.Printf("⚠️  AES_KEY no definida: solo se aceptan paquetes con clave de dispositivo")
+		return nil
 	}
+	sharedKeys = append(sharedKeys, current)
+	log.Printf("✅ Clave compartida AES-%d-GCM inicializada correctamente", len(current.material)*8)
 
-	var err error
-	aesKey, err = hex.DecodeString(aesKeyHex)
+	previous, err := loadSharedKey("AES_KEY_PREVIOUS", "previous")
 	if err != nil {
-		return fmt.Errorf("error decodificando clave AES: %w", err)
+		return err
 	}
-	if len(aesKey) != 16 {
-		return fmt.Errorf("la clave AES debe ser de 16 bytes, obtenido: %d", len(aesKey))
+	if previous != nil {
+		if expires := os.Getenv("AES_KEY_PREVIOUS_EXPIRES"); expires != "" {
+			t, err := time.Parse(time.RFC3339, expires)
+			if err != nil {
+				return fmt.Errorf("AES_KEY_PREVIOUS_EXPIRES inválida: %w", err)
+			}
+			previous.ExpiresAt = &t
+		}
+		sharedKeys = append(sharedKeys, previous)
+		log.Printf("✅ Clave compartida anterior aceptada durante la rotación (expira: %v)", previous.ExpiresAt)
 	}
-	log.Printf("✅ Clave AES-128-GCM inicializada correctamente")
 	return nil
 }
 
-// Descifra un paquete AES-GCM
-// Formato esperado: [IV(12 bytes)] + [Ciphertext(N bytes)] + [Tag(16 bytes)]
-func decryptPacket(encryptedData []byte) ([]byte, error) {
-	// Validar tamaño mínimo: IV(12) + Tag(16) = 28 bytes
-	if len(encryptedData) < 28 {
-		return nil, fmt.Errorf("paquete demasiado pequeño: %d bytes (mínimo 28)", len(encryptedData))
-	}
-
-	// Extraer componentes
-	iv := encryptedData[:12]
-	tag := encryptedData[len(encryptedData)-16:]
-	ciphertext := encryptedData[12 : len(encryptedData)-16]
-
-	log.Printf("Descifrando: IV=%d bytes, Ciphertext=%d bytes, Tag=%d bytes",
-		len(iv), len(ciphertext), len(tag))
-
-	// Crear cipher AES
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return nil, fmt.Errorf("error creando cipher AES: %w", err)
+func loadSharedKey(envVar, name string) (*SharedKey, error) {
+	// Leer la clave desde variable de entorno
+	keyHex := os.Getenv(envVar)
+	if keyHex == "" {
+		return nil, nil
 	}
 
-	// Crear GCM
-	aesgcm, err := cipher.NewGCM(block)
+	material, err := hex.DecodeString(keyHex)
 	if err != nil {
-		return nil, fmt.Errorf("error creando GCM: %w", err)
+		return nil, fmt.Errorf("error decodificando %s: %w", envVar, err)
 	}
-
-	// Combinar ciphertext + tag para Open
-	combined := append(ciphertext, tag...)
-
-	// Descifrar
-	plaintext, err := aesgcm.Open(nil, iv, combined, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error descifrando (tag inválido o datos corruptos): %w", err)
+	if err := validateAESKey(material); err != nil {
+		return nil, fmt.Errorf("%s: %w", envVar, err)
 	}
-
-	return plaintext, nil
+	return &SharedKey{Name: name, material: material}, nil
 }
 
 // ========== RESTO DEL CÓDIGO ORIGINAL ==========
@@ -102,10 +115,99 @@ type Config struct {
 	DBSSLMode   string
 	Port        string
 	UDPPort     string
+	TCPPort     string
 	LogFile     string
 	CertFile    string
 	KeyFile     string
 	TablePrefix string
+
+	// Fixes received more than LateFixThreshold after their device timestamp
+	// are flagged late. Device timestamps further than MaxClockSkew in the
+	// future are distrusted and replaced by the receive time.
+	LateFixThreshold time.Duration
+	MaxClockSkew     time.Duration
+
+	// How long a device's previous key keeps working after a new one is
+	// activated
+	KeyGracePeriod time.Duration
+
+	// Replay protection: width of the sequence reordering window and whether
+	// packets without a sequence number are rejected
+	ReplayWindow    int
+	RequireSequence bool
+
+	// Shared secret for the LoRaWAN network server webhooks (disabled when
+	// empty); phone apps use per-device tokens instead
+	HTTPIngestToken string
+
+	// Bearer token for the device key registry (disabled when empty)
+	AdminToken string
+
+	// TCP ingestion: TCP_PORT=off disables the native listener; TCP_LISTENERS
+	// adds ports for other protocols ("5027:teltonika,5100:auto")
+	TCPListeners      string
+	TCPMaxConnections int
+	TCPReadTimeout    time.Duration
+
+	// MQTT ingestion (disabled when MQTT_BROKER is empty)
+	MQTTBroker   string
+	MQTTTopics   string
+	MQTTClientID string
+	MQTTUsername string
+	MQTTPassword string
+	MQTTQoS      int
+
+	// Ingestion pipeline: store workers (sharded by device), total queue
+	// capacity in packets, rows per INSERT and the longest a fix waits
+	PipelineWorkers       int
+	PipelineQueueSize     int
+	PipelineBatchSize     int
+	PipelineFlushInterval time.Duration
+
+	// Acknowledge stored UDP packets that carry a sequence number
+	UDPAck bool
+
+	// LoRaWAN payload decoders: the default and per-model overrides
+	LoRaWANDecoder       string
+	LoRaWANModelDecoders string
+
+	// Rejected packets kept for inspection (0 disables the store)
+	DeadLetterLimit int
+
+	// UDP flood protection: token buckets per source IP and per device
+	// (packets per second, burst; rate 0 disables), and throttling of
+	// sources after consecutive decryption failures (0 disables)
+	UDPSourceRate       float64
+	UDPSourceBurst      int
+	UDPDeviceRate       float64
+	UDPDeviceBurst      int
+	UDPThrottleAfter    int
+	UDPThrottleDuration time.Duration
+	UDPThrottleRate     float64
+
+	// Ingestion policy for unregistered devices: open, register or allowlist
+	DevicePolicy string
+
+	// Leader election: instances of the same group share one UDP/MQTT
+	// ingester
+	LeaderElection bool
+	LeaderGroup    string
+	LeaderLeaseTTL time.Duration
+	InstanceID     string
+
+	// Plausibility filter: off, flag or reject, and its thresholds (km/h,
+	// HDOP; 0 disables a check)
+	OutlierAction   string
+	OutlierMaxSpeed float64
+	OutlierMaxHDOP  float64
+
+	// Track smoothing (see smoother.go) and its process noise in m/s²
+	Smoothing             bool
+	SmoothingAcceleration float64
+
+	// Fixes within this many meters of a parked device's open dwell extend
+	// it instead of adding rows (0 disables compaction)
+	CompactionRadius float64
 }
 
 func loadConfig() *Config {
@@ -117,10 +219,70 @@ func loadConfig() *Config {
 		DBSSLMode:   getEnv("DB_SSLMODE", "disable"),
 		Port:        getEnv("PORT", "80"),
 		UDPPort:     getEnv("UDP_PORT", "5051"),
+		TCPPort:     getEnv("TCP_PORT", getEnv("UDP_PORT", "5051")),
 		LogFile:     getEnv("LOG_FILE", ""),
 		CertFile:    getEnv("CERT_FILE", "certs/server.crt"),
 		KeyFile:     getEnv("KEY_FILE", "certs/server.key"),
 		TablePrefix: getEnv("TABLE_PREFIX", ""),
+
+		LateFixThreshold: getEnvDuration("LATE_FIX_THRESHOLD", 2*time.Minute),
+		MaxClockSkew:     getEnvDuration("MAX_CLOCK_SKEW", 5*time.Minute),
+
+		KeyGracePeriod: getEnvDuration("KEY_GRACE_PERIOD", 72*time.Hour),
+
+		ReplayWindow:    getEnvInt("REPLAY_WINDOW", 64),
+		RequireSequence: getEnvBool("REQUIRE_SEQUENCE", false),
+
+		HTTPIngestToken: getEnv("HTTP_INGEST_TOKEN", ""),
+
+		AdminToken: getEnv("ADMIN_TOKEN", ""),
+
+		TCPListeners:      getEnv("TCP_LISTENERS", ""),
+		TCPMaxConnections: getEnvInt("TCP_MAX_CONNECTIONS", 1000),
+		TCPReadTimeout:    getEnvDuration("TCP_READ_TIMEOUT", 5*time.Minute),
+
+		MQTTBroker:   getEnv("MQTT_BROKER", ""),
+		MQTTTopics:   getEnv("MQTT_TOPICS", "trackers/+/location"),
+		MQTTClientID: getEnv("MQTT_CLIENT_ID", "location-tracker"+getEnv("TABLE_PREFIX", "")),
+		MQTTUsername: getEnv("MQTT_USERNAME", ""),
+		MQTTPassword: getEnv("MQTT_PASSWORD", ""),
+		MQTTQoS:      getEnvInt("MQTT_QOS", 1),
+
+		PipelineWorkers:       getEnvInt("PIPELINE_WORKERS", 4),
+		PipelineQueueSize:     getEnvInt("PIPELINE_QUEUE_SIZE", 4096),
+		PipelineBatchSize:     getEnvInt("PIPELINE_BATCH_SIZE", 500),
+		PipelineFlushInterval: getEnvDuration("PIPELINE_FLUSH_INTERVAL", 200*time.Millisecond),
+
+		UDPAck: getEnvBool("UDP_ACK", true),
+
+		LoRaWANDecoder:       getEnv("LORAWAN_DECODER", "decoded"),
+		LoRaWANModelDecoders: getEnv("LORAWAN_MODEL_DECODERS", ""),
+
+		DeadLetterLimit: getEnvInt("DEAD_LETTER_LIMIT", 10000),
+
+		UDPSourceRate:       getEnvFloat("UDP_SOURCE_RATE", 50),
+		UDPSourceBurst:      getEnvInt("UDP_SOURCE_BURST", 100),
+		UDPDeviceRate:       getEnvFloat("UDP_DEVICE_RATE", 2),
+		UDPDeviceBurst:      getEnvInt("UDP_DEVICE_BURST", 20),
+		UDPThrottleAfter:    getEnvInt("UDP_THROTTLE_AFTER", 20),
+		UDPThrottleDuration: getEnvDuration("UDP_THROTTLE_DURATION", 15*time.Minute),
+		UDPThrottleRate:     getEnvFloat("UDP_THROTTLE_RATE", 1),
+
+		DevicePolicy: getEnv("DEVICE_POLICY", devicePolicyOpen),
+
+		LeaderElection: getEnvBool("LEADER_ELECTION", true),
+		LeaderGroup:    getEnv("LEADER_GROUP", "location-tracker"+getEnv("TABLE_PREFIX", "")),
+		LeaderLeaseTTL: getEnvDuration("LEADER_LEASE_TTL", 15*time.Second),
+		InstanceID:     getEnv("INSTANCE_ID", ""),
+
+		OutlierAction:   getEnv("OUTLIER_ACTION", outlierActionFlag),
+		OutlierMaxSpeed: getEnvFloat("OUTLIER_MAX_SPEED", 300),
+		OutlierMaxHDOP:  getEnvFloat("OUTLIER_MAX_HDOP", 10),
+
+		Smoothing:             getEnvBool("SMOOTHING", true),
+		SmoothingAcceleration: getEnvFloat("SMOOTHING_ACCELERATION", 2),
+
+		CompactionRadius: getEnvFloat("COMPACTION_RADIUS", 10),
 	}
 }
 
@@ -131,6 +293,58 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s (%q), using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid number for %s (%q), using %g", key, value, defaultValue)
+		return defaultValue
+	}
+	return f
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s (%q), using %t", key, value, defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s (%q), using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
 // Database wrapper
 type Database struct {
 	*sql.DB
@@ -171,6 +385,11 @@ func (db *Database) InitializeSchema(prefix string) error {
 		routesTableName = prefix + "_routes"
 	}
 
+	rejectedTableName := "rejected_fixes"
+	if prefix != "" {
+		rejectedTableName = prefix + "_rejected_fixes"
+	}
+
 	// 1. Enable PostGIS
 	_, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS postgis;`)
 	if err != nil {
@@ -249,6 +468,106 @@ func (db *Database) InitializeSchema(prefix string) error {
 		return err
 	}
 
+	// Extended telemetry columns (nullable, only v1 packets fill them)
+	_, err = db.Exec(fmt.Sprintf(`
+    ALTER TABLE %s
+        ADD COLUMN IF NOT EXISTS speed DOUBLE PRECISION,
+        ADD COLUMN IF NOT EXISTS heading DOUBLE PRECISION,
+        ADD COLUMN IF NOT EXISTS altitude DOUBLE PRECISION,
+        ADD COLUMN IF NOT EXISTS hdop DOUBLE PRECISION,
+        ADD COLUMN IF NOT EXISTS satellites SMALLINT,
+        ADD COLUMN IF NOT EXISTS battery_voltage DOUBLE PRECISION,
+        ADD COLUMN IF NOT EXISTS accuracy DOUBLE PRECISION,
+        ADD COLUMN IF NOT EXISTS battery_level DOUBLE PRECISION,
+        ADD COLUMN IF NOT EXISTS fix_quality SMALLINT,
+        ADD COLUMN IF NOT EXISTS attributes JSONB;
+    `, tableName))
+	if err != nil {
+		return fmt.Errorf("failed to add telemetry columns: %w", err)
+	}
+
+	// Server receive time, kept apart from the device fix time in "timestamp"
+	_, err = db.Exec(fmt.Sprintf(`
+    ALTER TABLE %s
+        ADD COLUMN IF NOT EXISTS received_at TIMESTAMP WITH TIME ZONE,
+        ADD COLUMN IF NOT EXISTS late BOOLEAN NOT NULL DEFAULT FALSE,
+        ADD COLUMN IF NOT EXISTS out_of_order BOOLEAN NOT NULL DEFAULT FALSE;
+    `, tableName))
+	if err != nil {
+		return fmt.Errorf("failed to add receive time columns: %w", err)
+	}
+
+	// Plausibility filter: the check a flagged fix failed, and a table with
+	// the same layout for fixes rejected outright
+	_, err = db.Exec(fmt.Sprintf(`
+    ALTER TABLE %s ADD COLUMN IF NOT EXISTS outlier VARCHAR(20);
+
+    CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING DEFAULTS);
+    CREATE INDEX IF NOT EXISTS idx_%s_device_timestamp ON %s(device_id, timestamp DESC);
+    `, tableName, rejectedTableName, tableName, rejectedTableName, rejectedTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create outlier columns: %w", err)
+	}
+
+	// Kalman-smoothed position next to the raw one, and the track a route
+	// was built from
+	_, err = db.Exec(fmt.Sprintf(`
+    ALTER TABLE %s ADD COLUMN IF NOT EXISTS smoothed_location GEOGRAPHY(POINT, 4326);
+    ALTER TABLE %s ADD COLUMN IF NOT EXISTS smoothed_location GEOGRAPHY(POINT, 4326);
+    ALTER TABLE %s ADD COLUMN IF NOT EXISTS track VARCHAR(10) NOT NULL DEFAULT 'raw';
+    `, tableName, rejectedTableName, routesTableName))
+	if err != nil {
+		return fmt.Errorf("failed to add smoothing columns: %w", err)
+	}
+
+	// Stationary compaction: the span and number of fixes a row stands for
+	// (last_seen is NULL for rows that were never extended). A dwell row's
+	// timestamp is when it began, so "newest" means newest last activity,
+	// COALESCE(last_seen, timestamp), which gets indexes of its own.
+	_, err = db.Exec(fmt.Sprintf(`
+    ALTER TABLE %s
+        ADD COLUMN IF NOT EXISTS last_seen TIMESTAMP WITH TIME ZONE,
+        ADD COLUMN IF NOT EXISTS samples INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE %s
+        ADD COLUMN IF NOT EXISTS last_seen TIMESTAMP WITH TIME ZONE,
+        ADD COLUMN IF NOT EXISTS samples INTEGER NOT NULL DEFAULT 1;
+    CREATE INDEX IF NOT EXISTS idx_%s_seen ON %s((COALESCE(last_seen, timestamp)) DESC);
+    CREATE INDEX IF NOT EXISTS idx_%s_device_seen ON %s(device_id, (COALESCE(last_seen, timestamp)) DESC);
+    `, tableName, rejectedTableName, tableName, tableName, tableName, tableName))
+	if err != nil {
+		return fmt.Errorf("failed to add compaction columns: %w", err)
+	}
+
+	// Idempotency key (see assignFixKey), so a resent fix is not stored
+	// twice. Rows stored before it existed keep a NULL key, which never
+	// conflicts, so no existing row is touched. The earlier unique index on
+	// (device_id, timestamp) is dropped: it merged distinct fixes that share
+	// a second-resolution time.
+	_, err = db.Exec(fmt.Sprintf(`
+    ALTER TABLE %s ADD COLUMN IF NOT EXISTS fix_key TEXT;
+    ALTER TABLE %s ADD COLUMN IF NOT EXISTS fix_key TEXT;
+    DROP INDEX IF EXISTS idx_%s_device_fix;
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_%s_device_fix_key ON %s(device_id, fix_key);
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_%s_device_fix_key ON %s(device_id, fix_key);
+    `, tableName, rejectedTableName, tableName, tableName, tableName, rejectedTableName, rejectedTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create fix idempotency key: %w", err)
+	}
+
+	// Keys of fixes compacted into a dwell, which have no row of their own
+	// (first_seen is the dwell's row timestamp)
+	_, err = db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s_fix_keys (
+        device_id VARCHAR(255) NOT NULL,
+        fix_key TEXT NOT NULL,
+        first_seen TIMESTAMP WITH TIME ZONE NOT NULL,
+        PRIMARY KEY (device_id, fix_key)
+    );
+    `, tableName))
+	if err != nil {
+		return fmt.Errorf("failed to create compacted fix keys table: %w", err)
+	}
+
 	// 4. Geofences Table
 	_, err = db.Exec(`
     CREATE TABLE IF NOT EXISTS geofences (
@@ -330,7 +649,135 @@ func (db *Database) InitializeSchema(prefix string) error {
 		}
 	}
 
-	log.Printf("✅ Schema initialized for tables: %s, %s, geofences, notifications", tableName, routesTableName)
+	// 7. Device key registry (shared by all table prefixes)
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS device_keys (
+        key_id SERIAL PRIMARY KEY,
+        device_id VARCHAR(255) NOT NULL,
+        key_material BYTEA NOT NULL,
+        status VARCHAR(20) NOT NULL DEFAULT 'active', -- 'staged', 'active', 'retired', 'revoked'
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+        revoked_at TIMESTAMP WITH TIME ZONE
+    );
+    CREATE INDEX IF NOT EXISTS idx_device_keys_device ON device_keys(device_id);
+
+    -- Rotation: validity window and usage counters
+    ALTER TABLE device_keys
+        ADD COLUMN IF NOT EXISTS activates_at TIMESTAMP WITH TIME ZONE,
+        ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE,
+        ADD COLUMN IF NOT EXISTS usage_count BIGINT NOT NULL DEFAULT 0,
+        ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP WITH TIME ZONE;
+    `)
+	if err != nil {
+		return err
+	}
+
+	// 8. Replay protection state (highest accepted sequence per device)
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS device_sequences (
+        device_id VARCHAR(255) PRIMARY KEY,
+        highest_sequence BIGINT NOT NULL,
+        window_bitmap BIGINT NOT NULL DEFAULT 0,
+        updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    );
+    `)
+	if err != nil {
+		return err
+	}
+
+	// 9. Downlink command queue
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS device_commands (
+        id SERIAL PRIMARY KEY,
+        device_id VARCHAR(255) NOT NULL,
+        command VARCHAR(50) NOT NULL,
+        params JSONB NOT NULL DEFAULT '[]',
+        status VARCHAR(20) NOT NULL DEFAULT 'pending'
+            CHECK (status IN ('pending', 'sent', 'acknowledged', 'failed', 'cancelled')),
+        attempts INTEGER NOT NULL DEFAULT 0,
+        result TEXT,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+        sent_at TIMESTAMP WITH TIME ZONE,
+        acknowledged_at TIMESTAMP WITH TIME ZONE
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_device_commands_device_status
+    ON device_commands(device_id, status);
+    `)
+	if err != nil {
+		return err
+	}
+
+	// 10. Dead letters (native packets that failed to decrypt or parse)
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS dead_letters (
+        id SERIAL PRIMARY KEY,
+        source VARCHAR(255) NOT NULL,
+        data BYTEA NOT NULL,
+        reason TEXT NOT NULL,
+        received_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+        reprocessed_at TIMESTAMP WITH TIME ZONE
+    );
+    `)
+	if err != nil {
+		return err
+	}
+
+	// 11. Device registry (ingestion allow-list)
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS devices (
+        device_id VARCHAR(255) PRIMARY KEY,
+        name VARCHAR(255),
+        status VARCHAR(20) NOT NULL DEFAULT 'approved'
+            CHECK (status IN ('approved', 'pending', 'rejected')),
+        rejected_packets BIGINT NOT NULL DEFAULT 0,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+        updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+        last_rejected_at TIMESTAMP WITH TIME ZONE
+    );
+    CREATE INDEX IF NOT EXISTS idx_devices_status ON devices(status);
+
+    ALTER TABLE devices
+        ADD COLUMN IF NOT EXISTS duplicate_fixes BIGINT NOT NULL DEFAULT 0,
+        ADD COLUMN IF NOT EXISTS last_duplicate_at TIMESTAMP WITH TIME ZONE,
+        ADD COLUMN IF NOT EXISTS ingest_token_hash BYTEA,
+        ADD COLUMN IF NOT EXISTS fix_version BIGINT NOT NULL DEFAULT 0;
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_devices_ingest_token ON devices(ingest_token_hash);
+    `)
+	if err != nil {
+		return err
+	}
+
+	// A new registry starts with every device that already has data or a
+	// key, so switching to the allow-list policy does not lock them out
+	_, err = db.Exec(fmt.Sprintf(`
+    INSERT INTO devices (device_id)
+    SELECT device_id FROM (
+        SELECT device_id FROM %s
+        UNION
+        SELECT device_id FROM device_keys
+    ) known
+    WHERE NOT EXISTS (SELECT 1 FROM devices)
+    ON CONFLICT (device_id) DO NOTHING
+    `, tableName))
+	if err != nil {
+		return err
+	}
+
+	// 12. Leader election leases
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS leader_leases (
+        name VARCHAR(255) PRIMARY KEY,
+        holder VARCHAR(255) NOT NULL,
+        acquired_at TIMESTAMP WITH TIME ZONE NOT NULL,
+        expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+    );
+    `)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("✅ Schema initialized for tables: %s, %s, %s, geofences, notifications, device_keys, device_sequences, device_commands, dead_letters, devices, leader_leases", tableName, routesTableName, rejectedTableName)
 	return nil
 }
 
@@ -339,7 +786,130 @@ type LocationPacket struct {
 	DeviceID  string    `json:"device_id"`
 	Latitude  float64   `json:"latitude"`
 	Longitude float64   `json:"longitude"`
-	Timestamp time.Time `json:"timestamp"`
+	Timestamp time.Time `json:"timestamp"` // fix time reported by the device (receive time if absent)
+
+	// ReceivedAt is when the server got the fix. Late marks fixes that arrived
+	// well after they were taken (e.g. flushed after a coverage gap) and
+	// OutOfOrder marks fixes older than one already stored for the device.
+	ReceivedAt time.Time `json:"received_at"`
+	Late       bool      `json:"late,omitempty"`
+	OutOfOrder bool      `json:"out_of_order,omitempty"`
+
+	// Outlier names the plausibility check the fix failed (see outliers.go)
+	Outlier string `json:"outlier,omitempty"`
+
+	// Position estimated by the TrackSmoother, stored in smoothed_location.
+	// Queries return it in Latitude/Longitude when they ask for the smoothed
+	// track.
+	SmoothedLatitude  *float64 `json:"-"`
+	SmoothedLongitude *float64 `json:"-"`
+
+	// Dwell is set on rows that stand for several fixes of a parked device
+	// (see compaction.go), and on fixes that were compacted into one.
+	Dwell *Dwell `json:"dwell,omitempty"`
+
+	// Duplicate marks a fix that was already stored (same device and fix
+	// key), so storing it again was a no-op.
+	Duplicate bool `json:"-"`
+	// fixKey identifies the fix across resends of its packet (see
+	// assignFixKey); "" when nothing does, so it is always stored.
+	fixKey string
+	// receiveTimed marks fixes stamped with the receive time for lack of a
+	// usable device timestamp.
+	receiveTimed bool
+
+	// Optional telemetry (v1 packets). Nil when the device did not report it.
+	Speed          *float64 `json:"speed,omitempty"`           // km/h
+	Heading        *float64 `json:"heading,omitempty"`         // degrees from true north
+	Altitude       *float64 `json:"altitude,omitempty"`        // meters above sea level
+	HDOP           *float64 `json:"hdop,omitempty"`            // horizontal dilution of precision
+	Satellites     *int     `json:"satellites,omitempty"`      // satellites used in the fix
+	BatteryVoltage *float64 `json:"battery_voltage,omitempty"` // volts
+
+	// Reported by phone apps (OsmAnd, OwnTracks) rather than trackers
+	Accuracy     *float64 `json:"accuracy,omitempty"`      // meters
+	BatteryLevel *float64 `json:"battery_level,omitempty"` // percent
+
+	// GGA fix quality (1 = GPS, 2 = DGPS, 4 = RTK...), from NMEA payloads
+	FixQuality *int `json:"fix_quality,omitempty"`
+
+	// Protocol-specific extras with no column of their own (IO elements,
+	// ignition, odometer...)
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// locationColumns is the select list shared by every location query; rows
+// selected with it must be read back with scanLocation.
+const locationColumns = `device_id,
+		       ST_Y(location::geometry) as latitude,
+		       ST_X(location::geometry) as longitude,` + locationDetailColumns
+
+// smoothedLocationColumns reads the same rows with the smoothed position
+// where one was stored.
+const smoothedLocationColumns = `device_id,
+		       ST_Y(COALESCE(smoothed_location, location)::geometry) as latitude,
+		       ST_X(COALESCE(smoothed_location, location)::geometry) as longitude,` + locationDetailColumns
+
+const locationDetailColumns = `
+		       timestamp,
+		       COALESCE(received_at, timestamp), late, out_of_order,
+		       speed, heading, altitude, hdop, satellites, battery_voltage,
+		       accuracy, battery_level, fix_quality, attributes, outlier,
+		       COALESCE(last_seen, timestamp), samples`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanLocation(row rowScanner, location *LocationPacket) error {
+	var speed, heading, altitude, hdop, battery, accuracy, batteryLevel sql.NullFloat64
+	var satellites, fixQuality sql.NullInt64
+	var attributes []byte
+	var outlier sql.NullString
+	var lastSeen time.Time
+	var samples int
+
+	err := row.Scan(&location.DeviceID, &location.Latitude, &location.Longitude, &location.Timestamp,
+		&location.ReceivedAt, &location.Late, &location.OutOfOrder,
+		&speed, &heading, &altitude, &hdop, &satellites, &battery,
+		&accuracy, &batteryLevel, &fixQuality, &attributes, &outlier,
+		&lastSeen, &samples)
+	if err != nil {
+		return err
+	}
+	location.Outlier = outlier.String
+	if samples > 1 {
+		location.Dwell = &Dwell{FirstSeen: location.Timestamp, LastSeen: lastSeen, Samples: samples}
+	}
+
+	location.Speed = nullFloatPtr(speed)
+	location.Heading = nullFloatPtr(heading)
+	location.Altitude = nullFloatPtr(altitude)
+	location.HDOP = nullFloatPtr(hdop)
+	location.BatteryVoltage = nullFloatPtr(battery)
+	location.Accuracy = nullFloatPtr(accuracy)
+	location.BatteryLevel = nullFloatPtr(batteryLevel)
+	if satellites.Valid {
+		sats := int(satellites.Int64)
+		location.Satellites = &sats
+	}
+	if fixQuality.Valid {
+		quality := int(fixQuality.Int64)
+		location.FixQuality = &quality
+	}
+	if attributes != nil {
+		if err := json.Unmarshal(attributes, &location.Attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullFloatPtr(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
 }
 
 type Geofence struct {
@@ -362,6 +932,7 @@ type Route struct {
 	StartTime      time.Time   `json:"start_time"`
 	EndTime        time.Time   `json:"end_time"`
 	DistanceMeters float64     `json:"distance_meters"`
+	Track          string      `json:"track"` // raw or smoothed fixes
 	CreatedAt      time.Time   `json:"created_at"`
 }
 
@@ -437,230 +1008,1283 @@ func (h *WebSocketHub) Run(ctx context.Context) {
 					}
 				}
 			}
-			h.mutex.RUnlock()
+			h.mutex.RUnlock()
+		}
+	}
+}
+
+func (h *WebSocketHub) closeAllClients() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for client := range h.clients {
+		client.Close()
+	}
+	h.clients = make(map[*websocket.Conn]bool)
+}
+
+func (h *WebSocketHub) ClientCount() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.clients)
+}
+
+func (h *WebSocketHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+
+	h.register <- conn
+
+	// Handle client messages
+	go func() {
+		defer func() {
+			h.unregister <- conn
+		}()
+
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					log.Printf("WebSocket unexpected close error: %v", err)
+				}
+				break
+			}
+
+			// Handle ping-pong messages
+			if messageType == websocket.TextMessage {
+				messageStr := string(message)
+				if messageStr == "ping" {
+					// Respond with pong
+					err = conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+					if err != nil {
+						log.Printf("WebSocket pong write error: %v", err)
+						break
+					}
+					continue
+				}
+			}
+		}
+	}()
+
+	// Send initial ping to establish connection
+	go func() {
+		time.Sleep(2 * time.Second) // Wait a bit before first ping
+		err := conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+		if err != nil {
+			log.Printf("Initial ping failed: %v", err)
+		}
+	}()
+}
+
+func (h *WebSocketHub) Broadcast(data interface{}) {
+	select {
+	case h.broadcast <- data:
+	default:
+		log.Println("WebSocket broadcast channel full, dropping message")
+	}
+}
+
+// Ingestor is the decrypt → parse → store → broadcast pipeline shared by
+// every listener that receives native (AES-GCM) packets.
+type Ingestor struct {
+	db               *Database
+	wsHub            *WebSocketHub
+	keys             *KeyStore
+	replay           *ReplayGuard
+	commands         *CommandQueue
+	deadLetters      *DeadLetterStore
+	devices          *DeviceRegistry
+	outliers         *OutlierFilter
+	smoother         *TrackSmoother
+	compactor        *FixCompactor
+	tablePrefix      string
+	lateFixThreshold time.Duration
+	maxClockSkew     time.Duration
+
+	// Newest fix time stored per device, used to detect out-of-order arrivals
+	lastFixMutex sync.Mutex
+	lastFix      map[string]time.Time
+
+	// The devices.fix_version the per-device state reflects (see
+	// syncFixVersions)
+	fixVersionMutex sync.Mutex
+	fixVersions     map[string]int64
+}
+
+func NewIngestor(db *Database, wsHub *WebSocketHub, keys *KeyStore, replay *ReplayGuard, commands *CommandQueue, deadLetters *DeadLetterStore, devices *DeviceRegistry, outliers *OutlierFilter, smoother *TrackSmoother, compactor *FixCompactor, config *Config) *Ingestor {
+	return &Ingestor{
+		db:               db,
+		wsHub:            wsHub,
+		keys:             keys,
+		replay:           replay,
+		commands:         commands,
+		deadLetters:      deadLetters,
+		devices:          devices,
+		outliers:         outliers,
+		smoother:         smoother,
+		compactor:        compactor,
+		tablePrefix:      config.TablePrefix,
+		lateFixThreshold: config.LateFixThreshold,
+		maxClockSkew:     config.MaxClockSkew,
+		lastFix:          make(map[string]time.Time),
+		fixVersions:      make(map[string]int64),
+	}
+}
+
+// errDecryptionFailed marks packets no key could open, which the UDP listener
+// counts towards throttling the source.
+var errDecryptionFailed = errors.New("decryption failed")
+
+// DecodePacket decrypts and parses a native packet without storing it.
+// Failures are logged with one line and kept, raw bytes included, in the
+// dead-letter store; the error is returned for listeners that report status
+// back to the device.
+func (ing *Ingestor) DecodePacket(data []byte, source string) (*Payload, error) {
+	payload, err := ing.decodePacket(data)
+	if err != nil {
+		log.Printf("❌ Rejected packet from %s (%d bytes): %v", source, len(data), err)
+		ing.deadLetters.Record(source, data, err)
+		return nil, err
+	}
+	return payload, nil
+}
+
+// decodePacket leaves logging its errors to the caller.
+func (ing *Ingestor) decodePacket(data []byte) (*Payload, error) {
+	// ✅ Descifrar el paquete
+	plaintext, key, err := ing.keys.decryptPacket(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errDecryptionFailed, err)
+	}
+
+	if isBinaryPayload(plaintext) {
+		log.Printf("✓ Decrypted: binary payload (%d bytes)", len(plaintext))
+	} else {
+		log.Printf("✓ Decrypted: %s", string(plaintext))
+	}
+
+	// ✅ Parsear el mensaje descifrado
+	payload, err := ing.parsePacket(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if key.Device != nil && payload.DeviceID != key.Device.DeviceID {
+		return nil, fmt.Errorf("device %s sent a packet with key %d, which belongs to %s",
+			payload.DeviceID, key.Device.ID, key.Device.DeviceID)
+	}
+	// Otherwise a leaked shared key would still speak for every device
+	if key.shared != nil && ing.keys.hasValidDeviceKey(payload.DeviceID, time.Now()) {
+		return nil, fmt.Errorf("device %s has its own key but sent a packet with the %s shared key",
+			payload.DeviceID, key.shared.Name)
+	}
+	payload.key = key
+	return payload, nil
+}
+
+// IngestBatch stores several payloads with one multi-row insert, pushes
+// their fixes to WebSocket clients and returns the outcome of each. Payloads
+// rejected by the device registry or replay protection do not affect the
+// others; a failed insert fails every accepted payload.
+//
+// Listeners do not call it directly but go through the IngestPipeline, which
+// keeps each device's payloads in order.
+func (ing *Ingestor) IngestBatch(payloads []*Payload) []error {
+	errs := make([]error, len(payloads))
+
+	var accepted []*Payload
+	for i, payload := range payloads {
+		err := ing.devices.Admit(payload.DeviceID)
+		if err == nil && payload.key != nil && !payload.skipReplay {
+			err = ing.replay.Reserve(payload.DeviceID, payload.Sequence)
+		}
+		if err != nil {
+			log.Printf("❌ Rejected packet from %s: %v", payload.DeviceID, err)
+			errs[i] = err
+			continue
+		}
+		accepted = append(accepted, payload)
+	}
+
+	// fail fails every accepted payload, undoing what they changed so the
+	// device's resend is judged afresh
+	fail := func(err error, deviceIDs []string) []error {
+		ing.forgetDevices(deviceIDs)
+		for _, payload := range accepted {
+			if payload.key != nil {
+				ing.replay.Release(payload.DeviceID, payload.Sequence)
+			}
+		}
+		for i := range payloads {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+
+	deviceIDs := make([]string, len(accepted))
+	for i, payload := range accepted {
+		deviceIDs[i] = payload.DeviceID
+	}
+
+	// Every instance ingests (TCP, HTTP, LoRaWAN), so another may have
+	// stored fixes for these devices since this one last did
+	versions, err := ing.loadFixVersions(deviceIDs)
+	if err != nil {
+		log.Printf("Error loading device fix versions: %v", err)
+		return fail(err, nil)
+	}
+	ing.syncFixVersions(deviceIDs, versions, 0)
+
+	// Resent fixes, and late ones an open dwell already covers, are found
+	// before the stateful stages, so they cannot move a device's outlier
+	// reference, smoother or dwell
+	if err := ing.markStoredFixes(accepted); err != nil {
+		log.Printf("Error looking up stored fixes: %v", err)
+		return fail(err, nil)
+	}
+
+	var fixes, rejected []*LocationPacket
+	newest := make(map[string]time.Time)
+	for _, payload := range accepted {
+		for _, packet := range payload.Fixes {
+			if packet.Duplicate || packet.Dwell != nil {
+				fixes = append(fixes, packet)
+				continue
+			}
+			ing.classifyFix(packet, newest)
+			packet.Outlier = ing.outliers.Check(packet)
+			ing.smoother.Smooth(packet)
+			ing.compactor.Compact(packet)
+			if packet.Outlier != "" && ing.outliers.rejects() {
+				rejected = append(rejected, packet)
+			} else {
+				fixes = append(fixes, packet)
+			}
+		}
+	}
+
+	written, err := ing.storeLocations(fixes)
+	if err != nil {
+		log.Printf("Error storing locations: %v", err)
+		return fail(err, deviceIDs)
+	}
+	ing.advanceLastFix(newest)
+	// Another instance storing for the same devices meanwhile shows as a
+	// version that moved by more than this batch's own bump
+	stored := make([]string, 0, len(written))
+	for deviceID := range written {
+		stored = append(stored, deviceID)
+	}
+	ing.syncFixVersions(stored, written, 1)
+
+	duplicates := make(map[string]int)
+	for _, packet := range fixes {
+		if packet.Duplicate {
+			duplicates[packet.DeviceID]++
+		}
+	}
+	ing.devices.CountDuplicates(duplicates)
+
+	// Rejected fixes are kept for diagnostics only, so failing to keep
+	// them does not fail the packet
+	if err := ing.storeLocationsIn(ing.outliers.rejectedTable, rejected, nil); err != nil {
+		log.Printf("Error storing rejected fixes: %v", err)
+	}
+
+	for _, payload := range accepted {
+		if payload.key != nil {
+			ing.replay.Commit(payload.DeviceID, payload.Sequence)
+		}
+
+		if len(payload.CommandAcks) > 0 {
+			ing.commands.acknowledge(payload.DeviceID, payload.CommandAcks)
+		}
+
+		for _, notification := range payload.Notifications {
+			if err := ing.db.createNotification(notification); err != nil {
+				log.Printf("Error creating notification for %s: %v", notification.DeviceID, err)
+				continue
+			}
+			log.Printf("🚨 %s", notification.Message)
+		}
+
+		for _, packet := range payload.Fixes {
+			if packet.Duplicate {
+				log.Printf("↺ Duplicate fix from %s at %s, already stored",
+					packet.DeviceID, packet.Timestamp.Format(time.RFC3339))
+				continue
+			}
+			if packet.Outlier != "" {
+				log.Printf("⚠️  Implausible fix (%s) from %s: Lat=%.6f, Lng=%.6f, Time=%s (rejected=%t)",
+					packet.Outlier, packet.DeviceID, packet.Latitude, packet.Longitude,
+					packet.Timestamp.Format(time.RFC3339), ing.outliers.rejects())
+				continue
+			}
+			// An out-of-order fix is history, not the device's current
+			// position, so it must not move the live marker back.
+			if !packet.OutOfOrder {
+				ing.wsHub.Broadcast(packet)
+			}
+			if packet.Dwell != nil {
+				log.Printf("✓ Extended dwell: Device=%s, Lat=%.6f, Lng=%.6f, Time=%s (%d fixes since %s)",
+					packet.DeviceID, packet.Latitude, packet.Longitude, packet.Timestamp.Format(time.RFC3339),
+					packet.Dwell.Samples, packet.Dwell.FirstSeen.Format(time.RFC3339))
+				continue
+			}
+			log.Printf("✓ Stored location: Device=%s, Lat=%.6f, Lng=%.6f, Time=%s (late=%t, out_of_order=%t)",
+				packet.DeviceID, packet.Latitude, packet.Longitude,
+				packet.Timestamp.Format(time.RFC3339), packet.Late, packet.OutOfOrder)
+		}
+	}
+	return errs
+}
+
+// UDP Sniffer - MODIFICADO PARA DESCIFRADO
+//
+// The read loop only decrypts and parses; storing happens in the pipeline's
+// workers so a slow database does not stall the socket. Datagrams over the
+// RateLimiter's limits are dropped before decryption.
+//
+// Stored packets that carry a sequence number are acknowledged with an
+// encrypted "ack,<seq>,<server unix ms>" datagram, sealed with the key the
+// device used, so trackers can drop the fixes from their resend buffer and
+// correct their clock. Pending downlink commands follow in a separate
+// datagram sealed the same way.
+//
+// A packet whose sequence was already stored is most likely a resend after a
+// lost ACK, so it gets the ACK again, but nothing else, and only when it
+// comes from the address the device's last stored packet came from: a
+// captured packet replayed from elsewhere gets no reply at all.
+type UDPSniffer struct {
+	ingestor *Ingestor
+	pipeline *IngestPipeline
+	limiter  *RateLimiter
+	port     string
+	ack      bool
+
+	mutex sync.Mutex
+	addrs map[string]string // device id -> source of its last stored packet
+}
+
+func NewUDPSniffer(ingestor *Ingestor, pipeline *IngestPipeline, limiter *RateLimiter, port string, ack bool) *UDPSniffer {
+	return &UDPSniffer{
+		ingestor: ingestor,
+		pipeline: pipeline,
+		limiter:  limiter,
+		port:     port,
+		ack:      ack,
+	}
+}
+
+func (us *UDPSniffer) Run(ctx context.Context) {
+	log.Println("Starting UDP sniffer service with AES-GCM decryption")
+
+	addr, err := net.ResolveUDPAddr("udp", ":"+us.port)
+	if err != nil {
+		log.Printf("Error resolving UDP address: %v", err)
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Printf("Error starting UDP listener: %v", err)
+		return
+	}
+
+	// Addresses seen in an earlier term may be long gone
+	us.mutex.Lock()
+	us.addrs = make(map[string]string)
+	us.mutex.Unlock()
+
+	// Packets still in the pipeline are acknowledged through this socket,
+	// so it stays open until they are handled
+	var inflight sync.WaitGroup
+	defer func() {
+		inflight.Wait()
+		conn.Close()
+	}()
+
+	log.Printf("✓ UDP listening on port %s (AES-GCM encrypted)", us.port)
+
+	// Batched payloads can fill a whole datagram
+	buffer := make([]byte, maxUDPPacketSize)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue // Timeout is expected
+				}
+				log.Printf("UDP read error: %v", err)
+				continue
+			}
+
+			// Floods are dropped before they cost a decryption attempt
+			ip := addr.IP.String()
+			if !us.limiter.AllowSource(ip) {
+				continue
+			}
+
+			payload, err := us.ingestor.DecodePacket(buffer[:n], addr.String())
+			if err != nil {
+				if errors.Is(err, errDecryptionFailed) {
+					us.limiter.RecordDecryptFailure(ip)
+				}
+				continue
+			}
+			if !us.limiter.AllowDevice(payload.DeviceID) {
+				continue
+			}
+			inflight.Add(1)
+			payload.done = func(err error) {
+				defer inflight.Done()
+				switch {
+				case err == nil:
+					// Decrypting is not enough to trust the source: a
+					// replayed capture decrypts too, but stores nothing new
+					if payload.storedNewFix() {
+						us.limiter.RecordSuccess(ip)
+					}
+					us.storedFrom(payload.DeviceID, addr)
+					us.sendAck(conn, addr, payload)
+					us.sendCommands(conn, addr, payload)
+				case errors.Is(err, errSequenceReplayed) && us.isStoredFrom(payload.DeviceID, addr):
+					us.sendAck(conn, addr, payload)
+				}
+			}
+			if err := us.pipeline.Enqueue(payload); err != nil {
+				log.Printf("Dropped packet from %s: %v", payload.DeviceID, err)
+				inflight.Done()
+			}
+		}
+	}
+}
+
+// storedFrom records where a device's latest stored packet came from.
+func (us *UDPSniffer) storedFrom(deviceID string, addr *net.UDPAddr) {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+	us.addrs[deviceID] = addr.String()
+}
+
+func (us *UDPSniffer) isStoredFrom(deviceID string, addr *net.UDPAddr) bool {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+	return us.addrs[deviceID] == addr.String()
+}
+
+func (us *UDPSniffer) sendAck(conn *net.UDPConn, addr *net.UDPAddr, payload *Payload) {
+	if !us.ack || payload.Sequence == nil {
+		return
+	}
+	ack := fmt.Sprintf("ack,%d,%d", *payload.Sequence, time.Now().UnixMilli())
+	sealed, err := payload.key.seal([]byte(ack))
+	if err != nil {
+		log.Printf("Error sealing ACK for %s: %v", payload.DeviceID, err)
+	} else if _, err := conn.WriteToUDP(sealed, addr); err != nil {
+		log.Printf("Error sending ACK to %s: %v", addr, err)
+	}
+}
+
+func (us *UDPSniffer) sendCommands(conn *net.UDPConn, addr *net.UDPAddr, payload *Payload) {
+	if downlink := us.ingestor.commandDownlink(payload); downlink != nil {
+		if _, err := conn.WriteToUDP(downlink, addr); err != nil {
+			log.Printf("Error sending commands to %s: %v", addr, err)
+		}
+	}
+}
+
+// storedNewFix reports whether storing the payload added a fix that was not
+// stored before.
+func (p *Payload) storedNewFix() bool {
+	for _, packet := range p.Fixes {
+		if !packet.Duplicate {
+			return true
+		}
+	}
+	return false
+}
+
+// maxUDPPacketSize is the largest datagram the sniffer reads.
+const maxUDPPacketSize = 65535
+
+// Payload is one decrypted packet: the sending device, its packet sequence
+// number and the fixes it carried, in chronological order. Protocols with
+// device-side alarms also raise notifications.
+type Payload struct {
+	DeviceID      string
+	Sequence      *uint64
+	Fixes         []*LocationPacket
+	Notifications []*Notification
+	CommandAcks   []CommandAck
+
+	// Key that opened an encrypted packet, for sealing replies. Only these
+	// packets take part in replay protection: the others carry no sequence
+	// a device vouched for.
+	key *packetKey
+	// Set for packets an operator resubmits after the replay window moved
+	// past them
+	skipReplay bool
+	// Called by the pipeline with the outcome once the payload is handled
+	done func(error)
+}
+
+// Packet grammar (decrypted payload, ASCII):
+//
+//	legacy: <device>,<lat>,<lng>
+//	v1:     v1,<device>,<lat>,<lng>[,<key>=<value>...]
+//	batch:  b1,<device>[,seq=<n>]
+//	        <lat>,<lng>,ts=<t>[,<key>=<value>...]   (one line per fix)
+//	nmea:   nmea,<device>[,seq=<n>]
+//	        $GPRMC/$GPGGA/$GPVTG sentences           (see nmea.go)
+//
+// v1 optional fields may appear in any order; unknown keys are ignored so
+// newer firmware keeps working against older servers:
+//
+//	spd  speed in km/h         hdg  heading in degrees
+//	alt  altitude in meters    hdop horizontal dilution of precision
+//	sat  satellites in use     bat  battery voltage in volts
+//	ts   fix time: unix seconds (fractional allowed), unix milliseconds
+//	     or RFC3339
+//	seq  packet sequence number, strictly increasing per device
+//	cack confirms a downlink command: cack=<id> or cack=<id>:<error>, may
+//	     repeat (see commands.go)
+//
+// Packets without ts are stamped with the receive time. Every fix in a batch
+// must carry its own ts; seq and cack belong to the batch header.
+//
+// Payloads starting with a binary version byte use the compact encoding in
+// binary_codec.go instead.
+func (ing *Ingestor) parsePacket(data []byte) (*Payload, error) {
+	if isBinaryPayload(data) {
+		payload, err := decodeBinaryPayload(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid binary packet: %w", err)
+		}
+		sort.SliceStable(payload.Fixes, func(i, j int) bool {
+			return payload.Fixes[i].Timestamp.Before(payload.Fixes[j].Timestamp)
+		})
+		ing.stampReceived(payload)
+		return payload, nil
+	}
+
+	parts := strings.TrimSpace(string(data))
+	if strings.HasPrefix(parts, "nmea,") {
+		payload, err := parseNMEA(parts, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("invalid NMEA packet: %w", err)
+		}
+		ing.stampReceived(payload)
+		return payload, nil
+	}
+	if strings.HasPrefix(parts, "b1,") {
+		payload, err := parseBatch(parts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch packet: %w", err)
+		}
+		ing.stampReceived(payload)
+		return payload, nil
+	}
+
+	fields := strings.Split(parts, ",")
+	payload := &Payload{}
+
+	var packet *LocationPacket
+	var err error
+	switch {
+	case len(fields) >= 4 && fields[0] == "v1":
+		packet, err = parseCoordinates(fields[1], fields[2], fields[3])
+		if err == nil {
+			err = parseTelemetry(packet, payload, fields[4:])
+		}
+	case len(fields) == 3:
+		packet, err = parseCoordinates(fields[0], fields[1], fields[2])
+	default:
+		return nil, fmt.Errorf("invalid packet format: %q", parts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid packet %q: %w", parts, err)
+	}
+
+	payload.DeviceID = packet.DeviceID
+	payload.Fixes = []*LocationPacket{packet}
+	ing.stampReceived(payload)
+	return payload, nil
+}
+
+func parseBatch(data string) (*Payload, error) {
+	lines := strings.Split(data, "\n")
+	header := strings.Split(strings.TrimSpace(lines[0]), ",")
+	if len(header) < 2 || header[1] == "" {
+		return nil, fmt.Errorf("missing device id in header %q", lines[0])
+	}
+
+	payload := &Payload{DeviceID: header[1]}
+	var headerFix LocationPacket
+	if err := parseTelemetry(&headerFix, payload, header[2:]); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+
+	for i, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("fix %d: expected lat,lng,ts=...", i+1)
+		}
+
+		packet, err := parseCoordinates(payload.DeviceID, fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("fix %d: %w", i+1, err)
+		}
+		if err := parseTelemetry(packet, nil, fields[2:]); err != nil {
+			return nil, fmt.Errorf("fix %d: %w", i+1, err)
+		}
+		if packet.Timestamp.IsZero() {
+			return nil, fmt.Errorf("fix %d: missing ts", i+1)
+		}
+		payload.Fixes = append(payload.Fixes, packet)
+	}
+
+	if len(payload.Fixes) == 0 {
+		return nil, fmt.Errorf("batch without fixes")
+	}
+
+	// Firmware buffers may flush newest-first; store and broadcast oldest-first
+	sort.SliceStable(payload.Fixes, func(i, j int) bool {
+		return payload.Fixes[i].Timestamp.Before(payload.Fixes[j].Timestamp)
+	})
+	return payload, nil
+}
+
+// stampReceived sets the receive time on every fix and falls back to it for
+// fixes without a usable device timestamp.
+func (ing *Ingestor) stampReceived(payload *Payload) {
+	now := time.Now()
+	for _, packet := range payload.Fixes {
+		packet.ReceivedAt = now
+		if packet.Timestamp.IsZero() {
+			packet.Timestamp = now
+			packet.receiveTimed = true
+		} else if packet.Timestamp.Sub(now) > ing.maxClockSkew {
+			log.Printf("Device %s clock ahead by %s, using receive time",
+				packet.DeviceID, packet.Timestamp.Sub(now).Round(time.Second))
+			packet.Timestamp = now
+			packet.receiveTimed = true
+		}
+	}
+}
+
+// parseFixTime accepts unix seconds, unix milliseconds or RFC3339.
+func parseFixTime(value string) (time.Time, error) {
+	if strings.Contains(value, "T") {
+		return time.Parse(time.RFC3339Nano, value)
+	}
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || v <= 0 {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+	}
+	if v > 1e11 { // beyond year 5138 in seconds, so it must be milliseconds
+		return time.UnixMilli(int64(v)).UTC(), nil
+	}
+	sec, frac := math.Modf(v)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+}
+
+// classifyFix flags late and out-of-order fixes against the newest fix time
+// stored for the device. The first fix of a device after startup is compared
+// with the database so restarts do not hide stale flushes. newest carries the
+// newest fix seen per device in the batch being classified; it only reaches
+// the shared cache through advanceLastFix, once the batch is stored.
+func (ing *Ingestor) classifyFix(packet *LocationPacket, newest map[string]time.Time) {
+	packet.Late = packet.ReceivedAt.Sub(packet.Timestamp) > ing.lateFixThreshold
+
+	last, ok := newest[packet.DeviceID]
+	if !ok {
+		last = ing.lastFixTime(packet.DeviceID)
+	}
+
+	if packet.Timestamp.Before(last) {
+		packet.OutOfOrder = true
+		newest[packet.DeviceID] = last
+		return
+	}
+	newest[packet.DeviceID] = packet.Timestamp
+}
+
+// lastFixTime returns the newest stored fix time of a device, loading it from
+// the database on first use. The query runs outside the lock so one slow load
+// does not hold up every other device.
+func (ing *Ingestor) lastFixTime(deviceID string) time.Time {
+	ing.lastFixMutex.Lock()
+	last, ok := ing.lastFix[deviceID]
+	ing.lastFixMutex.Unlock()
+	if ok {
+		return last
+	}
+
+	last, err := ing.loadLastFixTime(deviceID)
+	if err != nil {
+		// Not cached, so the next fix tries again
+		log.Printf("Error loading last fix time for %s: %v", deviceID, err)
+		return last
+	}
+
+	ing.lastFixMutex.Lock()
+	defer ing.lastFixMutex.Unlock()
+	if cached, ok := ing.lastFix[deviceID]; ok && cached.After(last) {
+		return cached
+	}
+	ing.lastFix[deviceID] = last
+	return last
+}
+
+// advanceLastFix moves the cached newest fix times forward after a batch has
+// been stored.
+func (ing *Ingestor) advanceLastFix(newest map[string]time.Time) {
+	ing.lastFixMutex.Lock()
+	defer ing.lastFixMutex.Unlock()
+
+	for deviceID, t := range newest {
+		if t.After(ing.lastFix[deviceID]) {
+			ing.lastFix[deviceID] = t
+		}
+	}
+}
+
+func (ing *Ingestor) loadLastFixTime(deviceID string) (time.Time, error) {
+	tableName := "locations"
+	if ing.tablePrefix != "" {
+		tableName = ing.tablePrefix + "_locations"
+	}
+
+	var last sql.NullTime
+	err := ing.db.QueryRow(fmt.Sprintf("SELECT MAX(COALESCE(last_seen, timestamp)) FROM %s WHERE device_id = $1", tableName),
+		deviceID).Scan(&last)
+	return last.Time, err
+}
+
+// Reset drops the per-device state of every device, including the replay
+// window cache, so it is rebuilt from the database.
+func (ing *Ingestor) Reset() {
+	ing.lastFixMutex.Lock()
+	ing.lastFix = make(map[string]time.Time)
+	ing.lastFixMutex.Unlock()
+
+	ing.fixVersionMutex.Lock()
+	ing.fixVersions = make(map[string]int64)
+	ing.fixVersionMutex.Unlock()
+
+	ing.replay.DropCache()
+	ing.outliers.Reset()
+	ing.smoother.Reset()
+	ing.compactor.Reset()
+}
+
+// forgetDevices drops every piece of per-device state the stateful stages
+// keep in memory (newest fix time, outlier anchor, smoother track, open
+// dwell), so it is rebuilt from the database. It is called when a failed
+// store left that state ahead of the table, so retried fixes are not judged
+// against themselves.
+func (ing *Ingestor) forgetDevices(deviceIDs []string) {
+	ing.lastFixMutex.Lock()
+	for _, deviceID := range deviceIDs {
+		delete(ing.lastFix, deviceID)
+	}
+	ing.lastFixMutex.Unlock()
+
+	ing.outliers.Forget(deviceIDs)
+	ing.smoother.Forget(deviceIDs)
+	ing.compactor.Forget(deviceIDs)
+}
+
+func parseCoordinates(deviceID, latStr, lngStr string) (*LocationPacket, error) {
+	if deviceID == "" {
+		return nil, fmt.Errorf("empty device id")
+	}
+
+	lat, err1 := strconv.ParseFloat(latStr, 64)
+	lng, err2 := strconv.ParseFloat(lngStr, 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid coordinates")
+	}
+
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return nil, fmt.Errorf("out-of-range coordinates: lat=%f, lng=%f", lat, lng)
+	}
+
+	return &LocationPacket{
+		DeviceID:  deviceID,
+		Latitude:  lat,
+		Longitude: lng,
+	}, nil
+}
+
+// parseTelemetry fills the optional v1 fields from key=value pairs. The
+// packet-level keys (seq, cack) go to payload, and are ignored when it is nil.
+// Empty values are treated as "not reported".
+func parseTelemetry(packet *LocationPacket, payload *Payload, fields []string) error {
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("malformed field %q", field)
+		}
+		if value == "" {
+			continue
+		}
+
+		switch key {
+		case "seq":
+			n, err := strconv.ParseUint(value, 10, 63)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %q", key, value)
+			}
+			if payload != nil {
+				payload.Sequence = &n
+			}
+			continue
+		case "cack":
+			ack, err := parseCommandAck(value)
+			if err != nil {
+				return err
+			}
+			if payload != nil {
+				payload.CommandAcks = append(payload.CommandAcks, ack)
+			}
+			continue
+		case "ts":
+			ts, err := parseFixTime(value)
+			if err != nil {
+				return err
+			}
+			packet.Timestamp = ts
+			continue
+		case "sat":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid %s: %q", key, value)
+			}
+			packet.Satellites = &n
+			continue
+		case "spd", "hdg", "alt", "hdop", "bat":
+		default:
+			continue
+		}
+
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %q", key, value)
+		}
+
+		switch key {
+		case "spd":
+			if v < 0 {
+				return fmt.Errorf("negative speed: %f", v)
+			}
+			packet.Speed = &v
+		case "hdg":
+			if v < 0 || v >= 360 {
+				return fmt.Errorf("heading out of range: %f", v)
+			}
+			packet.Heading = &v
+		case "alt":
+			packet.Altitude = &v
+		case "hdop":
+			if v < 0 {
+				return fmt.Errorf("negative hdop: %f", v)
+			}
+			packet.HDOP = &v
+		case "bat":
+			if v < 0 {
+				return fmt.Errorf("negative battery voltage: %f", v)
+			}
+			packet.BatteryVoltage = &v
 		}
 	}
+	return nil
 }
 
-func (h *WebSocketHub) closeAllClients() {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-	for client := range h.clients {
-		client.Close()
+// locationInsertParams is the number of bind parameters per inserted row;
+// PostgreSQL allows 65535 per statement, which bounds the rows per INSERT.
+const locationInsertParams = 21
+
+// storeLocations inserts every fix of a packet in one transaction, so a
+// batch is stored completely or not at all. It returns the new fix_version
+// of each device it wrote for.
+func (ing *Ingestor) storeLocations(packets []*LocationPacket) (map[string]int64, error) {
+	tableName := "locations"
+	if ing.tablePrefix != "" {
+		tableName = ing.tablePrefix + "_locations"
 	}
-	h.clients = make(map[*websocket.Conn]bool)
+	versions := make(map[string]int64)
+	return versions, ing.storeLocationsIn(tableName, packets, versions)
 }
 
-func (h *WebSocketHub) ClientCount() int {
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
-	return len(h.clients)
-}
+// storeLocationsIn inserts into any table with the locations layout. Fixes
+// compacted into an open dwell update its row instead, after the inserts so
+// a dwell opened earlier in the same batch is already there. Fixes the table
+// already holds are skipped and marked Duplicate. With versions set, the
+// fix_version of every device written for is bumped in the same transaction
+// and returned in it.
+func (ing *Ingestor) storeLocationsIn(tableName string, fixes []*LocationPacket, versions map[string]int64) error {
+	if len(fixes) == 0 {
+		return nil
+	}
 
-func (h *WebSocketHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
+	var packets, compacted []*LocationPacket
+	for _, packet := range fixes {
+		if packet.Duplicate {
+			continue
+		}
+		if packet.Dwell != nil {
+			compacted = append(compacted, packet)
+		} else {
+			packets = append(packets, packet)
+		}
 	}
 
-	h.register <- conn
+	tx, err := ing.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	// Handle client messages
-	go func() {
-		defer func() {
-			h.unregister <- conn
-		}()
+	maxRows := 65535 / locationInsertParams
+	for start := 0; start < len(packets); start += maxRows {
+		chunk := packets[start:min(start+maxRows, len(packets))]
 
-		for {
-			messageType, message, err := conn.ReadMessage()
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("WebSocket unexpected close error: %v", err)
+		rows := make([]string, len(chunk))
+		args := make([]interface{}, 0, len(chunk)*locationInsertParams)
+		for i, packet := range chunk {
+			var attributes []byte
+			if len(packet.Attributes) > 0 {
+				if attributes, err = json.Marshal(packet.Attributes); err != nil {
+					return err
 				}
-				break
 			}
 
-			// Handle ping-pong messages
-			if messageType == websocket.TextMessage {
-				messageStr := string(message)
-				if messageStr == "ping" {
-					// Respond with pong
-					err = conn.WriteMessage(websocket.TextMessage, []byte("pong"))
-					if err != nil {
-						log.Printf("WebSocket pong write error: %v", err)
-						break
-					}
-					continue
-				}
+			// Use ST_SetSRID and ST_MakePoint for PostGIS
+			n := i * locationInsertParams
+			params := make([]string, locationInsertParams-5)
+			for j := range params {
+				params[j] = fmt.Sprintf("$%d", n+6+j)
 			}
+			rows[i] = fmt.Sprintf("($%d, ST_SetSRID(ST_MakePoint($%d, $%d), 4326)::geography, ST_SetSRID(ST_MakePoint($%d, $%d), 4326)::geography, %s)",
+				n+1, n+2, n+3, n+4, n+5, strings.Join(params, ", "))
+
+			args = append(args,
+				packet.DeviceID,
+				packet.Longitude,         // X coordinate (longitude)
+				packet.Latitude,          // Y coordinate (latitude)
+				packet.SmoothedLongitude, // NULL for fixes the smoother skipped
+				packet.SmoothedLatitude,
+				packet.Timestamp,
+				packet.ReceivedAt,
+				packet.Late,
+				packet.OutOfOrder,
+				packet.Speed,
+				packet.Heading,
+				packet.Altitude,
+				packet.HDOP,
+				packet.Satellites,
+				packet.BatteryVoltage,
+				packet.Accuracy,
+				packet.BatteryLevel,
+				packet.FixQuality,
+				attributes,
+				sql.NullString{String: packet.Outlier, Valid: packet.Outlier != ""},
+				sql.NullString{String: packet.fixKey, Valid: packet.fixKey != ""},
+			)
 		}
-	}()
 
-	// Send initial ping to establish connection
-	go func() {
-		time.Sleep(2 * time.Second) // Wait a bit before first ping
-		err := conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+		inserted, err := tx.Query(fmt.Sprintf(`
+        INSERT INTO %s (device_id, location, smoothed_location, timestamp, received_at, late, out_of_order,
+                        speed, heading, altitude, hdop, satellites, battery_voltage,
+                        accuracy, battery_level, fix_quality, attributes, outlier, fix_key)
+        VALUES %s
+        ON CONFLICT DO NOTHING
+        RETURNING device_id, fix_key
+    `, tableName, strings.Join(rows, ",\n               ")), args...)
 		if err != nil {
-			log.Printf("Initial ping failed: %v", err)
+			return err
 		}
-	}()
+		if err := markDuplicates(inserted, chunk); err != nil {
+			return err
+		}
+	}
+
+	for _, packet := range compacted {
+		if err := extendDwell(tx, tableName, packet); err != nil {
+			return err
+		}
+	}
+
+	if versions != nil {
+		var deviceIDs []string
+		seen := make(map[string]bool)
+		for _, packet := range append(packets, compacted...) {
+			if !seen[packet.DeviceID] {
+				seen[packet.DeviceID] = true
+				deviceIDs = append(deviceIDs, packet.DeviceID)
+			}
+		}
+		if err := bumpFixVersions(tx, deviceIDs, versions); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (h *WebSocketHub) Broadcast(data interface{}) {
-	select {
-	case h.broadcast <- data:
-	default:
-		log.Println("WebSocket broadcast channel full, dropping message")
+// bumpFixVersions counts a write for each device, so other instances know
+// their in-memory state of it is stale.
+func bumpFixVersions(tx *sql.Tx, deviceIDs []string, versions map[string]int64) error {
+	if len(deviceIDs) == 0 {
+		return nil
 	}
+	rows, err := tx.Query(`
+		UPDATE devices SET fix_version = fix_version + 1
+		WHERE device_id = ANY($1)
+		RETURNING device_id, fix_version
+	`, pq.Array(deviceIDs))
+	if err != nil {
+		return err
+	}
+	return scanFixVersions(rows, versions)
 }
 
-// UDP Sniffer - MODIFICADO PARA DESCIFRADO
-type UDPSniffer struct {
-	db          *Database
-	wsHub       *WebSocketHub
-	port        string
-	tablePrefix string
+// loadFixVersions returns the current fix_version of each device.
+func (ing *Ingestor) loadFixVersions(deviceIDs []string) (map[string]int64, error) {
+	versions := make(map[string]int64)
+	if len(deviceIDs) == 0 {
+		return versions, nil
+	}
+	rows, err := ing.db.Query("SELECT device_id, fix_version FROM devices WHERE device_id = ANY($1)",
+		pq.Array(deviceIDs))
+	if err != nil {
+		return nil, err
+	}
+	return versions, scanFixVersions(rows, versions)
 }
 
-func NewUDPSniffer(db *Database, wsHub *WebSocketHub, port string, tablePrefix string) *UDPSniffer {
-	return &UDPSniffer{
-		db:          db,
-		wsHub:       wsHub,
-		port:        port,
-		tablePrefix: tablePrefix,
+func scanFixVersions(rows *sql.Rows, versions map[string]int64) error {
+	defer rows.Close()
+	for rows.Next() {
+		var deviceID string
+		var version int64
+		if err := rows.Scan(&deviceID, &version); err != nil {
+			return err
+		}
+		versions[deviceID] = version
 	}
+	return rows.Err()
 }
 
-func (us *UDPSniffer) Run(ctx context.Context) {
-	log.Println("Starting UDP sniffer service with AES-GCM decryption")
+// syncFixVersions forgets the in-memory state of devices another instance
+// stored fixes for, so it is reloaded from the table. Each device's
+// fix_version is expected to have moved by bumped (0 before storing, 1 after
+// this instance's own write) since it was last seen here; any other version,
+// or a device seen for the first time or missing from the registry, means
+// the state may not reflect the table.
+func (ing *Ingestor) syncFixVersions(deviceIDs []string, versions map[string]int64, bumped int64) {
+	var stale []string
+	ing.fixVersionMutex.Lock()
+	for _, deviceID := range deviceIDs {
+		version, ok := versions[deviceID]
+		seen, known := ing.fixVersions[deviceID]
+		if !ok || !known || seen+bumped != version {
+			stale = append(stale, deviceID)
+		}
+		if ok {
+			ing.fixVersions[deviceID] = version
+		} else {
+			delete(ing.fixVersions, deviceID)
+		}
+	}
+	ing.fixVersionMutex.Unlock()
 
-	addr, err := net.ResolveUDPAddr("udp", ":"+us.port)
-	if err != nil {
-		log.Printf("Error resolving UDP address: %v", err)
-		return
+	if len(stale) > 0 {
+		ing.forgetDevices(stale)
 	}
+}
 
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		log.Printf("Error starting UDP listener: %v", err)
-		return
+// markDuplicates flags the fixes of an insert that did not come back from
+// its RETURNING clause, i.e. were skipped by ON CONFLICT DO NOTHING. It is
+// only a backstop for a copy stored by another instance since
+// markStoredFixes looked.
+func markDuplicates(inserted *sql.Rows, packets []*LocationPacket) error {
+	defer inserted.Close()
+
+	stored := make(map[storedFix]bool)
+	for inserted.Next() {
+		var deviceID string
+		var key sql.NullString
+		if err := inserted.Scan(&deviceID, &key); err != nil {
+			return err
+		}
+		stored[storedFix{deviceID, key.String}] = true
+	}
+	if err := inserted.Err(); err != nil {
+		return err
 	}
-	defer conn.Close()
 
-	log.Printf("✓ UDP listening on port %s (AES-GCM encrypted)", us.port)
+	// Fixes without a key cannot conflict
+	for _, packet := range packets {
+		if packet.fixKey != "" && !stored[storedFix{packet.DeviceID, packet.fixKey}] {
+			packet.Duplicate = true
+		}
+	}
+	return nil
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-			buffer := make([]byte, 1024)
-			n, addr, err := conn.ReadFromUDP(buffer)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue // Timeout is expected
-				}
-				log.Printf("UDP read error: %v", err)
-				continue
-			}
+type storedFix struct {
+	deviceID string
+	fixKey   string
+}
 
-			// ✅ Log del paquete encriptado recibido
-			log.Printf("📦 Received encrypted packet from %s (%d bytes)", addr, n)
-			log.Printf("   Hex: %s", hex.EncodeToString(buffer[:n]))
+// assignFixKey sets the key that identifies a fix across resends of its
+// packet. A fix the device timestamped is known by that time and its
+// position, so two fixes reported with the same second-resolution time at
+// different places stay apart. A fix stamped with the receive time is known
+// by the packet's sequence number and its place in the packet, if the
+// packet has one; otherwise nothing identifies it.
+func assignFixKey(payload *Payload, i int, packet *LocationPacket) {
+	switch {
+	case !packet.receiveTimed:
+		packet.fixKey = fmt.Sprintf("t:%d:%d:%d", packet.Timestamp.UnixMicro(),
+			int64(math.Round(packet.Latitude*1e7)), int64(math.Round(packet.Longitude*1e7)))
+	case payload.Sequence != nil:
+		packet.fixKey = fmt.Sprintf("s:%d:%d", *payload.Sequence, i)
+	}
+}
 
-			// ✅ Descifrar el paquete
-			plaintext, err := decryptPacket(buffer[:n])
-			if err != nil {
-				log.Printf("❌ Decryption failed: %v", err)
+// markStoredFixes keys the payloads' fixes and marks Duplicate those already
+// stored, in the locations or the rejected table or compacted into a dwell,
+// or repeated within the batch. The rest that fall inside their device's
+// open dwell are counted in it (see FixCompactor.Absorb).
+func (ing *Ingestor) markStoredFixes(payloads []*Payload) error {
+	if err := ing.markStoredKeys(payloads); err != nil {
+		return err
+	}
+	for _, payload := range payloads {
+		for _, packet := range payload.Fixes {
+			ing.compactor.Absorb(packet)
+		}
+	}
+	return nil
+}
+
+func (ing *Ingestor) markStoredKeys(payloads []*Payload) error {
+	var deviceIDs, keys []string
+	seen := make(map[storedFix]bool)
+	for _, payload := range payloads {
+		for i, packet := range payload.Fixes {
+			assignFixKey(payload, i, packet)
+			if packet.fixKey == "" {
 				continue
 			}
-
-			log.Printf("✓ Decrypted: %s", string(plaintext))
-
-			// ✅ Parsear el mensaje descifrado
-			packet := us.parsePacket(plaintext)
-			if packet != nil {
-				if err := us.storeLocation(packet); err != nil {
-					log.Printf("Error storing location: %v", err)
-				} else {
-					us.wsHub.Broadcast(packet)
-					log.Printf("✓ Stored location: Device=%s, Lat=%.6f, Lng=%.6f",
-						packet.DeviceID, packet.Latitude, packet.Longitude)
-				}
+			fix := storedFix{packet.DeviceID, packet.fixKey}
+			if seen[fix] {
+				packet.Duplicate = true
+				continue
 			}
+			seen[fix] = true
+			deviceIDs = append(deviceIDs, packet.DeviceID)
+			keys = append(keys, packet.fixKey)
 		}
 	}
-}
-
-func (us *UDPSniffer) parsePacket(data []byte) *LocationPacket {
-	parts := strings.TrimSpace(string(data))
-	fields := strings.Split(parts, ",")
-	if len(fields) != 3 {
-		log.Printf("Invalid packet format: %s", parts)
+	if len(keys) == 0 {
 		return nil
 	}
 
-	deviceID := fields[0]
-	lat, err1 := strconv.ParseFloat(fields[1], 64)
-	lng, err2 := strconv.ParseFloat(fields[2], 64)
-	if err1 != nil || err2 != nil {
-		log.Printf("Invalid coordinates: %s", parts)
-		return nil
+	tableName := "locations"
+	if ing.tablePrefix != "" {
+		tableName = ing.tablePrefix + "_locations"
+	}
+	// Matches any device with any key, a superset filtered below
+	rows, err := ing.db.Query(fmt.Sprintf(`
+		SELECT device_id, fix_key FROM %s WHERE device_id = ANY($1) AND fix_key = ANY($2)
+		UNION ALL
+		SELECT device_id, fix_key FROM %s WHERE device_id = ANY($1) AND fix_key = ANY($2)
+		UNION ALL
+		SELECT device_id, fix_key FROM %s_fix_keys WHERE device_id = ANY($1) AND fix_key = ANY($2)
+	`, tableName, ing.outliers.rejectedTable, tableName), pq.Array(deviceIDs), pq.Array(keys))
+	if err != nil {
+		return err
 	}
+	defer rows.Close()
 
-	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
-		log.Printf("Out-of-range coordinates: lat=%f, lng=%f", lat, lng)
-		return nil
+	stored := make(map[storedFix]bool)
+	for rows.Next() {
+		var fix storedFix
+		if err := rows.Scan(&fix.deviceID, &fix.fixKey); err != nil {
+			return err
+		}
+		stored[fix] = true
 	}
-
-	return &LocationPacket{
-		DeviceID:  deviceID,
-		Latitude:  lat,
-		Longitude: lng,
-		Timestamp: time.Now(),
+	if err := rows.Err(); err != nil {
+		return err
 	}
-}
 
-func (us *UDPSniffer) storeLocation(packet *LocationPacket) error {
-	tableName := "locations"
-	if us.tablePrefix != "" {
-		tableName = us.tablePrefix + "_locations"
+	for _, payload := range payloads {
+		for _, packet := range payload.Fixes {
+			if packet.fixKey != "" && stored[storedFix{packet.DeviceID, packet.fixKey}] {
+				packet.Duplicate = true
+			}
+		}
 	}
-
-	// Use ST_SetSRID and ST_MakePoint for PostGIS
-	query := fmt.Sprintf(`
-        INSERT INTO %s (device_id, location, timestamp)
-        VALUES ($1, ST_SetSRID(ST_MakePoint($2, $3), 4326)::geography, $4)
-    `, tableName)
-
-	_, err := us.db.Exec(query,
-		packet.DeviceID,
-		packet.Longitude, // X coordinate (longitude)
-		packet.Latitude,  // Y coordinate (latitude)
-		packet.Timestamp,
-	)
-	return err
+	return nil
 }
 
 // API Server - SIN CAMBIOS
 type APIServer struct {
 	db          *Database
 	wsHub       *WebSocketHub
+	keys        *KeyStore
+	replay      *ReplayGuard
+	commands    *CommandQueue
+	devices     *DeviceRegistry
+	ingestor    *Ingestor
+	pipeline    *IngestPipeline
+	rateLimiter *RateLimiter
+	lorawan     *LoRaWANDecoders
+	leader      *LeaderElector
+	ingestToken string
+	adminToken  string
 	server      *http.Server
 	port        string
 	tablePrefix string
 }
 
-func NewAPIServer(db *Database, wsHub *WebSocketHub, port string, tablePrefix string) *APIServer {
+func NewAPIServer(db *Database, wsHub *WebSocketHub, keys *KeyStore, replay *ReplayGuard, commands *CommandQueue, devices *DeviceRegistry, ingestor *Ingestor, pipeline *IngestPipeline, rateLimiter *RateLimiter, lorawan *LoRaWANDecoders, leader *LeaderElector, config *Config) *APIServer {
 	return &APIServer{
 		db:          db,
 		wsHub:       wsHub,
-		port:        port,
-		tablePrefix: tablePrefix,
+		keys:        keys,
+		replay:      replay,
+		commands:    commands,
+		devices:     devices,
+		ingestor:    ingestor,
+		pipeline:    pipeline,
+		rateLimiter: rateLimiter,
+		lorawan:     lorawan,
+		leader:      leader,
+		ingestToken: config.HTTPIngestToken,
+		adminToken:  config.AdminToken,
+		port:        config.Port,
+		tablePrefix: config.TablePrefix,
 		server: &http.Server{
-			Addr:         ":" + port,
+			Addr:         ":" + config.Port,
 			ReadTimeout:  15 * time.Second,
 			WriteTimeout: 15 * time.Second,
 		},
@@ -678,6 +2302,13 @@ func (api *APIServer) Run(ctx context.Context) {
 
 	// API routes (MUST come before static files)
 	r.HandleFunc("/api/devices", api.activeDevicesHandler).Methods("GET")
+	r.HandleFunc("/api/devices/registry", api.getRegisteredDevicesHandler).Methods("GET")
+	r.HandleFunc("/api/devices/registry", api.requireAdmin(api.registerDeviceHandler)).Methods("POST")
+	r.HandleFunc("/api/devices/registry/{deviceId}/approve", api.requireAdmin(api.approveDeviceHandler)).Methods("POST")
+	r.HandleFunc("/api/devices/registry/{deviceId}/reject", api.requireAdmin(api.rejectDeviceHandler)).Methods("POST")
+	r.HandleFunc("/api/devices/registry/{deviceId}", api.requireAdmin(api.deleteRegisteredDeviceHandler)).Methods("DELETE")
+	r.HandleFunc("/api/devices/registry/{deviceId}/token", api.requireAdmin(api.issueIngestTokenHandler)).Methods("POST")
+	r.HandleFunc("/api/devices/registry/{deviceId}/token", api.requireAdmin(api.revokeIngestTokenHandler)).Methods("DELETE")
 	r.HandleFunc("/api/health", api.healthHandler).Methods("GET")
 	r.HandleFunc("/api/health/db", api.dbHealthHandler).Methods("GET")
 	r.HandleFunc("/api/locations/latest", api.latestLocationHandler).Methods("GET")
@@ -685,6 +2316,7 @@ func (api *APIServer) Run(ctx context.Context) {
 	r.HandleFunc("/api/locations/range", api.locationRangeHandler).Methods("GET")
 	r.HandleFunc("/api/locations/nearby", api.locationNearbyHandler).Methods("GET")
 	r.HandleFunc("/api/locations/device/{deviceId}", api.deviceLocationHistoryHandler).Methods("GET")
+	r.HandleFunc("/api/outliers", api.outliersHandler).Methods("GET")
 	r.HandleFunc("/api/stats", api.statsHandler).Methods("GET")
 
 	// Geofence routes
@@ -704,6 +2336,42 @@ func (api *APIServer) Run(ctx context.Context) {
 	r.HandleFunc("/api/notifications/{id}/read", api.markNotificationReadHandler).Methods("PUT")
 	r.HandleFunc("/api/notifications", api.createNotificationHandler).Methods("POST")
 
+	// Device key registry (ADMIN_TOKEN only)
+	r.HandleFunc("/api/keys", api.requireAdmin(api.getKeysHandler)).Methods("GET")
+	r.HandleFunc("/api/keys", api.requireAdmin(api.createKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/keys/shared", api.requireAdmin(api.sharedKeysHandler)).Methods("GET")
+	r.HandleFunc("/api/keys/{id}/activate", api.requireAdmin(api.activateKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/keys/{id}/retire", api.requireAdmin(api.retireKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/keys/{id}/revoke", api.requireAdmin(api.revokeKeyHandler)).Methods("POST")
+
+	// HTTP ingestion for phone apps
+	r.HandleFunc("/api/ingest/osmand", api.osmandIngestHandler).Methods("GET", "POST")
+	r.HandleFunc("/api/ingest/owntracks", api.owntracksIngestHandler).Methods("POST")
+	r.HandleFunc("/api/ingest/pipeline", api.pipelineStatsHandler).Methods("GET")
+	r.HandleFunc("/api/ingest/tts", api.ttsUplinkHandler).Methods("POST")
+	r.HandleFunc("/api/ingest/chirpstack", api.chirpstackUplinkHandler).Methods("POST")
+
+	// Downlink commands
+	r.HandleFunc("/api/commands", api.getCommandsHandler).Methods("GET")
+	r.HandleFunc("/api/commands", api.requireAdmin(api.createCommandHandler)).Methods("POST")
+	r.HandleFunc("/api/commands/{id}", api.getCommandHandler).Methods("GET")
+	r.HandleFunc("/api/commands/{id}/cancel", api.requireAdmin(api.cancelCommandHandler)).Methods("POST")
+
+	// UDP flood protection
+	r.HandleFunc("/api/ratelimit", api.rateLimitStatsHandler).Methods("GET")
+	r.HandleFunc("/api/ratelimit/blocks", api.requireAdmin(api.blockSourceHandler)).Methods("POST")
+	r.HandleFunc("/api/ratelimit/blocks/{ip}", api.requireAdmin(api.unblockSourceHandler)).Methods("DELETE")
+
+	// Dead letters (ADMIN_TOKEN only: raw packets, and reprocessing skips
+	// replay protection)
+	r.HandleFunc("/api/dead-letters", api.requireAdmin(api.getDeadLettersHandler)).Methods("GET")
+	r.HandleFunc("/api/dead-letters/{id}", api.requireAdmin(api.getDeadLetterHandler)).Methods("GET")
+	r.HandleFunc("/api/dead-letters/{id}/reprocess", api.requireAdmin(api.reprocessDeadLetterHandler)).Methods("POST")
+
+	// Replay protection
+	r.HandleFunc("/api/replay", api.replayStatsHandler).Methods("GET")
+	r.HandleFunc("/api/replay/{deviceId}/reset", api.requireAdmin(api.resetSequenceHandler)).Methods("POST")
+
 	// Static file serving (MUST be last)
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
 
@@ -745,6 +2413,7 @@ func (api *APIServer) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":    "healthy",
+		"leader":    api.leader.Status(),
 		"timestamp": time.Now(),
 	})
 }
@@ -790,7 +2459,7 @@ func (api *APIServer) statsHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error counting active devices: %v", err)
 	}
 
-	err = api.db.QueryRow(fmt.Sprintf("SELECT MAX(timestamp) FROM %s", tableName)).Scan(&lastUpdate)
+	err = api.db.QueryRow(fmt.Sprintf("SELECT MAX(COALESCE(last_seen, timestamp)) FROM %s", tableName)).Scan(&lastUpdate)
 	if err != nil {
 		log.Printf("Error getting last update: %v", err)
 	}
@@ -817,17 +2486,15 @@ func (api *APIServer) latestLocationHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	query := fmt.Sprintf(`
-		SELECT device_id,
-		       ST_Y(location::geometry) as latitude,
-		       ST_X(location::geometry) as longitude,
-		       timestamp
+		SELECT %s
 		FROM %s
-		ORDER BY timestamp DESC
+		WHERE outlier IS NULL
+		ORDER BY COALESCE(last_seen, timestamp) DESC
 		LIMIT 1
-	`, tableName)
+	`, locationColumns, tableName)
 
 	var location LocationPacket
-	err := api.db.QueryRow(query).Scan(&location.DeviceID, &location.Latitude, &location.Longitude, &location.Timestamp)
+	err := scanLocation(api.db.QueryRow(query), &location)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "No locations found", http.StatusNotFound)
@@ -853,20 +2520,24 @@ func (api *APIServer) locationHistoryHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	track, ok := trackParam(r)
+	if !ok {
+		http.Error(w, "Invalid track parameter, use raw or smoothed", http.StatusBadRequest)
+		return
+	}
+
 	tableName := "locations"
 	if api.tablePrefix != "" {
 		tableName = api.tablePrefix + "_locations"
 	}
 
 	query := fmt.Sprintf(`
-		SELECT device_id,
-		       ST_Y(location::geometry) as latitude,
-		       ST_X(location::geometry) as longitude,
-		       timestamp
+		SELECT %s
 		FROM %s
+		WHERE %s
 		ORDER BY timestamp DESC
 		LIMIT $1
-	`, tableName)
+	`, track.columns(), tableName, track.condition())
 
 	rows, err := api.db.Query(query, limitInt)
 	if err != nil {
@@ -879,7 +2550,7 @@ func (api *APIServer) locationHistoryHandler(w http.ResponseWriter, r *http.Requ
 	var locations []LocationPacket
 	for rows.Next() {
 		var location LocationPacket
-		if err := rows.Scan(&location.DeviceID, &location.Latitude, &location.Longitude, &location.Timestamp); err != nil {
+		if err := scanLocation(rows, &location); err != nil {
 			log.Printf("Row scan error: %v", err)
 			continue
 		}
@@ -933,11 +2604,18 @@ func (api *APIServer) locationRangeHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	track, ok := trackParam(r)
+	if !ok {
+		http.Error(w, "Invalid track parameter, use raw or smoothed", http.StatusBadRequest)
+		return
+	}
+
 	tableName := "locations"
 	if api.tablePrefix != "" {
 		tableName = api.tablePrefix + "_locations"
 	}
 
+	// A dwell that began before start but lasted into the range is in it
 	var query string
 	var args []interface{}
 
@@ -950,26 +2628,20 @@ func (api *APIServer) locationRangeHandler(w http.ResponseWriter, r *http.Reques
 		}
 
 		query = fmt.Sprintf(`
-			SELECT device_id,
-			       ST_Y(location::geometry) as latitude,
-			       ST_X(location::geometry) as longitude,
-			       timestamp
+			SELECT %s
 			FROM %s
-			WHERE timestamp >= $1 AND timestamp <= $2 AND device_id IN (%s)
+			WHERE COALESCE(last_seen, timestamp) >= $1 AND timestamp <= $2 AND device_id IN (%s) AND %s
 			ORDER BY timestamp DESC
 			LIMIT 1000
-		`, tableName, strings.Join(placeholders, ","))
+		`, track.columns(), tableName, strings.Join(placeholders, ","), track.condition())
 	} else {
 		query = fmt.Sprintf(`
-			SELECT device_id,
-			       ST_Y(location::geometry) as latitude,
-			       ST_X(location::geometry) as longitude,
-			       timestamp
+			SELECT %s
 			FROM %s
-			WHERE timestamp >= $1 AND timestamp <= $2
+			WHERE COALESCE(last_seen, timestamp) >= $1 AND timestamp <= $2 AND %s
 			ORDER BY timestamp DESC
 			LIMIT 1000
-		`, tableName)
+		`, track.columns(), tableName, track.condition())
 		args = []interface{}{startTime, endTime}
 	}
 
@@ -984,7 +2656,7 @@ func (api *APIServer) locationRangeHandler(w http.ResponseWriter, r *http.Reques
 	var locations []LocationPacket
 	for rows.Next() {
 		var location LocationPacket
-		if err := rows.Scan(&location.DeviceID, &location.Latitude, &location.Longitude, &location.Timestamp); err != nil {
+		if err := scanLocation(rows, &location); err != nil {
 			log.Printf("Row scan error: %v", err)
 			continue
 		}
@@ -1066,35 +2738,31 @@ func (api *APIServer) locationNearbyHandler(w http.ResponseWriter, r *http.Reque
 		}
 
 		query = fmt.Sprintf(`
-			SELECT device_id,
-			       ST_Y(location::geometry) as latitude,
-			       ST_X(location::geometry) as longitude,
-			       timestamp
+			SELECT %s
 			FROM %s
 			WHERE ST_DWithin(
 				location,
 				ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography,
 				$3
 			)
+			AND outlier IS NULL
 			AND device_id IN (%s)
 			ORDER BY timestamp DESC
 			LIMIT 1000
-		`, tableName, strings.Join(placeholders, ","))
+		`, locationColumns, tableName, strings.Join(placeholders, ","))
 	} else {
 		query = fmt.Sprintf(`
-			SELECT device_id,
-			       ST_Y(location::geometry) as latitude,
-			       ST_X(location::geometry) as longitude,
-			       timestamp
+			SELECT %s
 			FROM %s
 			WHERE ST_DWithin(
 				location,
 				ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography,
 				$3
 			)
+			AND outlier IS NULL
 			ORDER BY timestamp DESC
 			LIMIT 1000
-		`, tableName)
+		`, locationColumns, tableName)
 		args = []interface{}{lng, lat, radiusMeters}
 	}
 
@@ -1109,7 +2777,7 @@ func (api *APIServer) locationNearbyHandler(w http.ResponseWriter, r *http.Reque
 	var locations []LocationPacket
 	for rows.Next() {
 		var location LocationPacket
-		if err := rows.Scan(&location.DeviceID, &location.Latitude, &location.Longitude, &location.Timestamp); err != nil {
+		if err := scanLocation(rows, &location); err != nil {
 			log.Printf("Row scan error: %v", err)
 			continue
 		}
@@ -1134,8 +2802,8 @@ func (api *APIServer) activeDevicesHandler(w http.ResponseWriter, r *http.Reques
 
 	query := fmt.Sprintf(`
         SELECT DISTINCT device_id,
-               MAX(timestamp) as last_seen,
-               COUNT(*) as location_count
+               MAX(COALESCE(last_seen, timestamp)) as last_seen,
+               SUM(samples) as location_count
         FROM %s
         GROUP BY device_id
         ORDER BY last_seen DESC
@@ -1197,21 +2865,24 @@ func (api *APIServer) deviceLocationHistoryHandler(w http.ResponseWriter, r *htt
 		return
 	}
 
+	track, ok := trackParam(r)
+	if !ok {
+		http.Error(w, "Invalid track parameter, use raw or smoothed", http.StatusBadRequest)
+		return
+	}
+
 	tableName := "locations"
 	if api.tablePrefix != "" {
 		tableName = api.tablePrefix + "_locations"
 	}
 
 	query := fmt.Sprintf(`
-		SELECT device_id,
-		       ST_Y(location::geometry) as latitude,
-		       ST_X(location::geometry) as longitude,
-		       timestamp
+		SELECT %s
 		FROM %s
-		WHERE device_id = $1
+		WHERE device_id = $1 AND %s
 		ORDER BY timestamp DESC
 		LIMIT $2
-	`, tableName)
+	`, track.columns(), tableName, track.condition())
 
 	rows, err := api.db.Query(query, deviceId, limitInt)
 	if err != nil {
@@ -1224,7 +2895,7 @@ func (api *APIServer) deviceLocationHistoryHandler(w http.ResponseWriter, r *htt
 	var locations []LocationPacket
 	for rows.Next() {
 		var location LocationPacket
-		if err := rows.Scan(&location.DeviceID, &location.Latitude, &location.Longitude, &location.Timestamp); err != nil {
+		if err := scanLocation(rows, &location); err != nil {
 			log.Printf("Row scan error: %v", err)
 			continue
 		}
@@ -1743,12 +3414,20 @@ func (api *APIServer) createNotificationHandler(w http.ResponseWriter, r *http.R
 	})
 }
 
-func (api *APIServer) createNotification(deviceID, message, msgType string, lat, lng float64) {
+// createNotification stores a notification raised by the server. Alarms
+// without a position (zero coordinates) are stored without a location.
+func (db *Database) createNotification(n *Notification) error {
+	var lat, lng *float64
+	if n.Latitude != 0 || n.Longitude != 0 {
+		lat, lng = &n.Latitude, &n.Longitude
+	}
+
 	query := `
         INSERT INTO notifications (device_id, message, type, location)
         VALUES ($1, $2, $3, ST_SetSRID(ST_MakePoint($5, $4), 4326)::geography)
     `
-	api.db.Exec(query, deviceID, message, msgType, lat, lng)
+	_, err := db.Exec(query, n.DeviceID, n.Message, n.Type, lat, lng)
+	return err
 }
 
 // Get routes
@@ -1771,7 +3450,7 @@ func (api *APIServer) getRoutesHandler(w http.ResponseWriter, r *http.Request) {
 	query := fmt.Sprintf(`
         SELECT id, device_id, route_name,
                ST_AsGeoJSON(geom::geometry) as geom_json,
-               start_time, end_time, distance_meters, created_at
+               start_time, end_time, distance_meters, track, created_at
         FROM %s
     `, routesTableName)
 
@@ -1800,7 +3479,7 @@ func (api *APIServer) getRoutesHandler(w http.ResponseWriter, r *http.Request) {
 		var distanceMeters sql.NullFloat64
 
 		if err := rows.Scan(&rt.ID, &rt.DeviceID, &routeName, &geomJSON,
-			&rt.StartTime, &rt.EndTime, &distanceMeters, &rt.CreatedAt); err != nil {
+			&rt.StartTime, &rt.EndTime, &distanceMeters, &rt.Track, &rt.CreatedAt); err != nil {
 			continue
 		}
 
@@ -1854,6 +3533,12 @@ func (api *APIServer) createRouteHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	track, ok := trackParam(r)
+	if !ok {
+		http.Error(w, "Invalid track parameter, use raw or smoothed", http.StatusBadRequest)
+		return
+	}
+
 	tableName := "locations"
 	if api.tablePrefix != "" {
 		tableName = api.tablePrefix + "_locations"
@@ -1867,32 +3552,33 @@ func (api *APIServer) createRouteHandler(w http.ResponseWriter, r *http.Request)
 	// Query to create route from location points
 	query := fmt.Sprintf(`
         WITH route_points AS (
-            SELECT location::geometry as geom
+            SELECT %s as geom, timestamp, id
             FROM %s
             WHERE device_id = $1
-              AND timestamp >= $2
+              AND COALESCE(last_seen, timestamp) >= $2
               AND timestamp <= $3
-            ORDER BY timestamp ASC
+              AND %s
         )
-        INSERT INTO %s (device_id, route_name, geom, start_time, end_time, distance_meters)
+        INSERT INTO %s (device_id, route_name, geom, start_time, end_time, distance_meters, track)
         SELECT
             $1,
             $4,
-            ST_MakeLine(geom)::geography,
+            ST_MakeLine(geom ORDER BY timestamp, id)::geography,
             $2,
             $3,
-            ST_Length(ST_MakeLine(geom)::geography)
+            ST_Length(ST_MakeLine(geom ORDER BY timestamp, id)::geography),
+            $5
         FROM route_points
         WHERE (SELECT COUNT(*) FROM route_points) >= 2
-        RETURNING id, device_id, route_name, start_time, end_time, distance_meters, created_at
-    `, tableName, routesTableName)
+        RETURNING id, device_id, route_name, start_time, end_time, distance_meters, track, created_at
+    `, track.geometry(), tableName, track.condition(), routesTableName)
 
 	var route Route
 	var routeName sql.NullString
 	var distanceMeters sql.NullFloat64
 
-	err := api.db.QueryRow(query, input.DeviceID, input.StartTime, input.EndTime, input.RouteName).Scan(
-		&route.ID, &route.DeviceID, &routeName, &route.StartTime, &route.EndTime, &distanceMeters, &route.CreatedAt,
+	err := api.db.QueryRow(query, input.DeviceID, input.StartTime, input.EndTime, input.RouteName, string(track)).Scan(
+		&route.ID, &route.DeviceID, &routeName, &route.StartTime, &route.EndTime, &distanceMeters, &route.Track, &route.CreatedAt,
 	)
 	if err != nil {
 		if strings.Contains(err.Error(), "violates check constraint") {
@@ -1999,7 +3685,14 @@ func (api *APIServer) distanceHandler(w http.ResponseWriter, r *http.Request) {
 type App struct {
 	config     *Config
 	db         *Database
+	keys       *KeyStore
+	replay     *ReplayGuard
+	leader     *LeaderElector
+	ingestor   *Ingestor
+	pipeline   *IngestPipeline
 	udpSniffer *UDPSniffer
+	tcpServers []*TCPListener
+	mqtt       *MQTTSubscriber
 	apiServer  *APIServer
 	wsHub      *WebSocketHub
 }
@@ -2032,13 +3725,69 @@ func NewApp() (*App, error) {
 	}
 
 	wsHub := NewWebSocketHub()
-	udpSniffer := NewUDPSniffer(db, wsHub, config.UDPPort, config.TablePrefix)
-	apiServer := NewAPIServer(db, wsHub, config.Port, config.TablePrefix)
+	keys := NewKeyStore(db, config.KeyGracePeriod)
+	replay := NewReplayGuard(db, config.ReplayWindow, config.RequireSequence)
+	commands := NewCommandQueue(db, wsHub)
+	deadLetters := NewDeadLetterStore(db, config.DeadLetterLimit)
+	devices, err := NewDeviceRegistry(db, config.DevicePolicy)
+	if err != nil {
+		return nil, fmt.Errorf("DEVICE_POLICY: %w", err)
+	}
+	outliers, err := NewOutlierFilter(db, config)
+	if err != nil {
+		return nil, fmt.Errorf("OUTLIER_ACTION: %w", err)
+	}
+	smoother := NewTrackSmoother(config)
+	compactor := NewFixCompactor(db, config)
+	ingestor := NewIngestor(db, wsHub, keys, replay, commands, deadLetters, devices, outliers, smoother, compactor, config)
+	pipeline := NewIngestPipeline(ingestor, config.PipelineWorkers, config.PipelineQueueSize,
+		config.PipelineBatchSize, config.PipelineFlushInterval)
+	rateLimiter := NewRateLimiter(config)
+	udpSniffer := NewUDPSniffer(ingestor, pipeline, rateLimiter, config.UDPPort, config.UDPAck)
+
+	listeners, err := parseListenerSpecs(config.TCPListeners)
+	if err != nil {
+		return nil, fmt.Errorf("TCP_LISTENERS: %w", err)
+	}
+	if config.TCPPort != "off" {
+		listeners = append([]ListenerSpec{{Port: config.TCPPort, Protocol: "native"}}, listeners...)
+	}
+
+	var tcpServers []*TCPListener
+	for _, spec := range listeners {
+		decoders, err := newDecoders(spec.Protocol, ingestor)
+		if err != nil {
+			return nil, fmt.Errorf("TCP listener on port %s: %w", spec.Port, err)
+		}
+		tcpServers = append(tcpServers, NewTCPListener(pipeline, spec.Port, decoders,
+			config.TCPMaxConnections, config.TCPReadTimeout))
+	}
+
+	var mqttSubscriber *MQTTSubscriber
+	if config.MQTTBroker != "" {
+		mqttSubscriber, err = NewMQTTSubscriber(ingestor, pipeline, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lorawan, err := NewLoRaWANDecoders(config)
+	if err != nil {
+		return nil, fmt.Errorf("LoRaWAN decoders: %w", err)
+	}
+	leader := NewLeaderElector(db, config)
+	apiServer := NewAPIServer(db, wsHub, keys, replay, commands, devices, ingestor, pipeline, rateLimiter, lorawan, leader, config)
 
 	return &App{
 		config:     config,
 		db:         db,
+		keys:       keys,
+		replay:     replay,
+		leader:     leader,
+		ingestor:   ingestor,
+		pipeline:   pipeline,
 		udpSniffer: udpSniffer,
+		tcpServers: tcpServers,
+		mqtt:       mqttSubscriber,
 		apiServer:  apiServer,
 		wsHub:      wsHub,
 	}, nil
@@ -2055,11 +3804,32 @@ func (app *App) Run() error {
 		app.wsHub.Run(ctx)
 	}()
 
-	// Start UDP sniffer
+	// Keep the device key cache in sync with the registry
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		app.udpSniffer.Run(ctx)
+		app.keys.Run(ctx)
+	}()
+
+	// Every listener stores its fixes through the pipeline, which is drained
+	// before the database is closed
+	app.pipeline.Start()
+
+	// Start TCP listeners
+	for _, tcpServer := range app.tcpServers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tcpServer.Run(ctx)
+		}()
+	}
+
+	// UDP and MQTT would ingest every packet once per instance, so only the
+	// leader runs them
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.leader.Run(ctx, app.runLeaderListeners)
 	}()
 
 	// Start API server
@@ -2077,6 +3847,7 @@ func (app *App) Run() error {
 	log.Println("Shutting down application...")
 	cancel()
 	wg.Wait()
+	app.pipeline.Close()
 
 	if err := app.db.Close(); err != nil {
 		log.Printf("Error closing database: %v", err)
@@ -2086,6 +3857,40 @@ func (app *App) Run() error {
 	return nil
 }
 
+// runLeaderListeners runs the UDP sniffer and MQTT subscriber until ctx is
+// cancelled by shutdown or loss of leadership.
+func (app *App) runLeaderListeners(ctx context.Context) {
+	// Another instance led in the meantime, so whatever this one remembers
+	// about the devices may be stale
+	app.ingestor.Reset()
+
+	// A listener that stops on its own (e.g. the UDP port could not be
+	// bound) stops the other too, so the lease is handed to an instance
+	// that can run both
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		app.udpSniffer.Run(ctx)
+	}()
+
+	if app.mqtt != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			app.mqtt.Run(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
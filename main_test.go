@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAssignFixKey(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	seq := uint64(42)
+
+	key := func(payload *Payload, i int, packet *LocationPacket) string {
+		assignFixKey(payload, i, packet)
+		return packet.fixKey
+	}
+
+	// Same second, different places: two fixes, not one resent
+	a := key(&Payload{}, 0, &LocationPacket{DeviceID: "gt06-1", Timestamp: at, Latitude: 40.1, Longitude: -3.1})
+	b := key(&Payload{}, 1, &LocationPacket{DeviceID: "gt06-1", Timestamp: at, Latitude: 40.2, Longitude: -3.1})
+	if a == b {
+		t.Errorf("fixes at different places share key %q", a)
+	}
+	if resent := key(&Payload{Sequence: &seq}, 3, &LocationPacket{DeviceID: "gt06-1", Timestamp: at, Latitude: 40.1, Longitude: -3.1}); resent != a {
+		t.Errorf("resent fix keyed %q, want %q", resent, a)
+	}
+
+	// Receive-timed fixes are keyed by sequence and index, whatever time
+	// each copy arrived at
+	first := key(&Payload{Sequence: &seq}, 1, &LocationPacket{Timestamp: at, receiveTimed: true})
+	retry := key(&Payload{Sequence: &seq}, 1, &LocationPacket{Timestamp: at.Add(time.Minute), receiveTimed: true})
+	if first != retry {
+		t.Errorf("resent receive-timed fix keyed %q, want %q", retry, first)
+	}
+	if other := key(&Payload{Sequence: &seq}, 0, &LocationPacket{Timestamp: at, receiveTimed: true}); other == first {
+		t.Errorf("fixes 0 and 1 of a packet share key %q", other)
+	}
+	if none := key(&Payload{}, 0, &LocationPacket{Timestamp: at, receiveTimed: true}); none != "" {
+		t.Errorf("receive-timed fix without seq keyed %q, want none", none)
+	}
+}
+
+func TestPayloadStoredNewFix(t *testing.T) {
+	replayed := &Payload{Fixes: []*LocationPacket{{Duplicate: true}, {Duplicate: true}}}
+	if replayed.storedNewFix() {
+		t.Error("payload whose fixes were all stored before counts as new")
+	}
+	partly := &Payload{Fixes: []*LocationPacket{{Duplicate: true}, {}}}
+	if !partly.storedNewFix() {
+		t.Error("payload with a newly stored fix does not count as new")
+	}
+}
+
+func TestSyncFixVersions(t *testing.T) {
+	config := &Config{OutlierAction: outlierActionFlag}
+	outliers, err := NewOutlierFilter(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ing := &Ingestor{
+		outliers:    outliers,
+		smoother:    NewTrackSmoother(config),
+		compactor:   NewFixCompactor(nil, config),
+		lastFix:     make(map[string]time.Time),
+		fixVersions: make(map[string]int64),
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	remembers := func(deviceID string) bool {
+		_, ok := ing.lastFix[deviceID]
+		return ok
+	}
+
+	ing.syncFixVersions([]string{"truck-7"}, map[string]int64{"truck-7": 4}, 0)
+	ing.lastFix["truck-7"] = at
+
+	// Own write: the version moved by this instance's bump only
+	ing.syncFixVersions([]string{"truck-7"}, map[string]int64{"truck-7": 5}, 1)
+	if !remembers("truck-7") {
+		t.Fatal("state dropped after this instance's own write")
+	}
+	ing.syncFixVersions([]string{"truck-7"}, map[string]int64{"truck-7": 5}, 0)
+	if !remembers("truck-7") {
+		t.Fatal("state dropped although no other instance wrote")
+	}
+
+	// Another instance stored fixes in between
+	ing.syncFixVersions([]string{"truck-7"}, map[string]int64{"truck-7": 6}, 0)
+	if remembers("truck-7") {
+		t.Fatal("state kept after another instance stored fixes")
+	}
+
+	// Another instance stored fixes while this one did
+	ing.lastFix["truck-7"] = at
+	ing.syncFixVersions([]string{"truck-7"}, map[string]int64{"truck-7": 8}, 1)
+	if remembers("truck-7") {
+		t.Fatal("state kept after a concurrent write from another instance")
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTSubscriber ingests fixes published to an MQTT broker, so trackers can
+// share a broker with other IoT telemetry. The device id is the topic level
+// matched by the first "+" of the subscription pattern (the last level when
+// the pattern has none). Messages carry either the native encrypted packet,
+// exactly as sent over UDP, or plain JSON:
+//
+//	{"latitude": 40.7128, "longitude": -74.006, "timestamp": 1718000000,
+//	 "speed": 42.5, "heading": 270}
+//
+// or an array of such objects for a batch. JSON is only as trustworthy as
+// the topic it arrived on, so the broker must authenticate publishers and
+// restrict each to its own device's topic; it never takes part in replay
+// protection.
+//
+// Messages are received with QoS 1 and acknowledged only once handled. A
+// message whose fixes fail to store is retried in-process with backoff, since
+// the broker only redelivers on reconnect and stops delivering altogether once
+// its inflight window fills with unacknowledged messages; after
+// mqttRetryAttempts it is moved to the dead letters and acknowledged. The
+// handler is called in arrival order and only decodes and enqueues, so each
+// device's messages reach the pipeline in the order they were published
+// (a retried message lands after newer ones and is stored as out of order).
+type MQTTSubscriber struct {
+	ingestor *Ingestor
+	enqueue  func(*Payload) error
+	broker   string
+	clientID string
+	username string
+	password string
+	topics   []string
+	qos      byte
+
+	// First retry delay, doubled for each further attempt
+	retryBackoff time.Duration
+
+	// Messages enqueued or waiting for a retry, awaited before
+	// disconnecting so their acknowledgements are sent. Messages arriving,
+	// or due for a retry, once stopping is set (and stop closed) are left
+	// unacknowledged for the next session.
+	mutex    sync.Mutex
+	stopping bool
+	stop     chan struct{}
+	inflight sync.WaitGroup
+}
+
+// How long to wait for the in-flight acknowledgements on shutdown
+const mqttDisconnectQuiesce = 250 // milliseconds
+
+// Attempts at storing a message before it is dead-lettered; with the default
+// backoff the last one comes about two minutes after the first.
+const (
+	mqttRetryAttempts = 7
+	mqttRetryBackoff  = 2 * time.Second
+)
+
+func NewMQTTSubscriber(ingestor *Ingestor, pipeline *IngestPipeline, config *Config) (*MQTTSubscriber, error) {
+	if config.MQTTQoS < 0 || config.MQTTQoS > 2 {
+		return nil, fmt.Errorf("MQTT_QOS must be 0, 1 or 2, got %d", config.MQTTQoS)
+	}
+	if config.MQTTUsername == "" {
+		return nil, fmt.Errorf("MQTT_USERNAME is required: a broker that accepts anonymous clients lets anyone publish fixes for any device")
+	}
+
+	var topics []string
+	for _, topic := range strings.Split(config.MQTTTopics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("MQTT_TOPICS is empty")
+	}
+
+	return &MQTTSubscriber{
+		ingestor: ingestor,
+		enqueue:  pipeline.Enqueue,
+		broker:   config.MQTTBroker,
+		clientID: config.MQTTClientID,
+		username: config.MQTTUsername,
+		password: config.MQTTPassword,
+		topics:   topics,
+		qos:      byte(config.MQTTQoS),
+
+		retryBackoff: mqttRetryBackoff,
+		stop:         make(chan struct{}),
+	}, nil
+}
+
+func (ms *MQTTSubscriber) Run(ctx context.Context) {
+	log.Printf("Starting MQTT subscriber (%s, topics %s)", ms.broker, strings.Join(ms.topics, ", "))
+
+	// Run again each time this instance regains the leader lease
+	ms.mutex.Lock()
+	ms.stopping = false
+	ms.stop = make(chan struct{})
+	ms.mutex.Unlock()
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(ms.broker).
+		SetClientID(ms.clientID).
+		SetUsername(ms.username).
+		SetPassword(ms.password).
+		// A persistent session keeps QoS 1 messages queued on the broker
+		// while we are disconnected
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(true).
+		// Reconnect with exponential backoff, also for the first connection
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(2 * time.Minute).
+		SetOnConnectHandler(ms.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("⚠️  MQTT connection lost: %v", err)
+		}).
+		SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+			log.Printf("MQTT reconnecting to %s", ms.broker)
+		})
+
+	client := mqtt.NewClient(opts)
+	client.Connect() // retried in the background until it succeeds
+
+	<-ctx.Done()
+	ms.mutex.Lock()
+	ms.stopping = true
+	close(ms.stop)
+	ms.mutex.Unlock()
+	ms.inflight.Wait()
+	client.Disconnect(mqttDisconnectQuiesce)
+	log.Println("MQTT subscriber stopped")
+}
+
+// subscribe (re)subscribes on every connection, since the broker may have
+// dropped the session.
+func (ms *MQTTSubscriber) subscribe(client mqtt.Client) {
+	log.Printf("✓ MQTT connected to %s", ms.broker)
+
+	filters := make(map[string]byte, len(ms.topics))
+	for _, topic := range ms.topics {
+		filters[topic] = ms.qos
+	}
+
+	token := client.SubscribeMultiple(filters, ms.handleMessage)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("❌ MQTT subscribe failed: %v", token.Error())
+	}
+}
+
+func (ms *MQTTSubscriber) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	payload, err := ms.decode(msg.Topic(), msg.Payload())
+	if err != nil {
+		// It will never be accepted, so a redelivery would not help
+		msg.Ack()
+		return
+	}
+
+	ms.mutex.Lock()
+	if ms.stopping {
+		ms.mutex.Unlock()
+		return
+	}
+	ms.inflight.Add(1)
+	ms.mutex.Unlock()
+
+	ms.submit(msg, payload, 1)
+}
+
+// submit enqueues a decoded message, acknowledging it once handled and
+// scheduling another attempt if storing it failed.
+func (ms *MQTTSubscriber) submit(msg mqtt.Message, payload *Payload, attempt int) {
+	payload.done = func(err error) {
+		switch {
+		case !mqttRetryable(err):
+		case attempt < mqttRetryAttempts:
+			delay := ms.retryBackoff << (attempt - 1)
+			log.Printf("⚠️  MQTT message from %s not stored (attempt %d), retrying in %s: %v",
+				payload.DeviceID, attempt, delay, err)
+			go ms.retry(msg, attempt+1, delay)
+			return
+		default:
+			log.Printf("❌ MQTT message from %s not stored after %d attempts, moving it to the dead letters: %v",
+				payload.DeviceID, attempt, err)
+			ms.ingestor.deadLetters.Record("mqtt "+msg.Topic(), msg.Payload(), err)
+		}
+		msg.Ack()
+		ms.inflight.Done()
+	}
+	if err := ms.enqueue(payload); err != nil {
+		log.Printf("Dropped MQTT message from %s: %v", payload.DeviceID, err)
+		ms.inflight.Done()
+	}
+}
+
+// retry decodes the message afresh, so no state from the failed attempt
+// carries over, and submits it again after delay.
+func (ms *MQTTSubscriber) retry(msg mqtt.Message, attempt int, delay time.Duration) {
+	ms.mutex.Lock()
+	stop := ms.stop
+	ms.mutex.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stop:
+		// Left unacknowledged for the next session
+		ms.inflight.Done()
+		return
+	}
+
+	payload, err := ms.decode(msg.Topic(), msg.Payload())
+	if err != nil {
+		msg.Ack()
+		ms.inflight.Done()
+		return
+	}
+	ms.submit(msg, payload, attempt)
+}
+
+// mqttRetryable reports whether a failure is worth another attempt, as
+// opposed to payloads that will never be accepted.
+func mqttRetryable(err error) bool {
+	return err != nil && !errors.Is(err, errReplayRejected) && !errors.Is(err, errDeviceNotAdmitted)
+}
+
+// decode turns a message into a payload for the device its topic names.
+func (ms *MQTTSubscriber) decode(topic string, data []byte) (*Payload, error) {
+	deviceID := ms.topicDeviceID(topic)
+	if deviceID == "" {
+		log.Printf("MQTT message on %s has no device id in its topic", topic)
+		return nil, fmt.Errorf("no device id in topic")
+	}
+	source := "mqtt " + topic
+
+	var payload *Payload
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		payload, err = parseMQTTJSON(deviceID, trimmed)
+		if err == nil {
+			log.Printf("📡 JSON fix from %s (%d fixes)", source, len(payload.Fixes))
+			ms.ingestor.stampReceived(payload)
+		}
+	}
+	if payload == nil {
+		// Not JSON, or an encrypted packet that happens to start with a brace
+		payload, err = ms.ingestor.DecodePacket(data, source)
+		if err != nil {
+			return nil, err
+		}
+		if payload.DeviceID != deviceID {
+			log.Printf("❌ Device %s published on %s, which belongs to %s", payload.DeviceID, topic, deviceID)
+			return nil, fmt.Errorf("device id does not match topic")
+		}
+	}
+	return payload, nil
+}
+
+// topicDeviceID extracts the level matched by the first "+" of whichever
+// subscription pattern the topic matches.
+func (ms *MQTTSubscriber) topicDeviceID(topic string) string {
+	levels := strings.Split(topic, "/")
+	for _, pattern := range ms.topics {
+		filter := strings.Split(pattern, "/")
+		if !mqttTopicMatches(filter, levels) {
+			continue
+		}
+		for i, f := range filter {
+			if f == "+" {
+				return levels[i]
+			}
+		}
+		return levels[len(levels)-1]
+	}
+	return ""
+}
+
+func mqttTopicMatches(filter, levels []string) bool {
+	for i, f := range filter {
+		if f == "#" {
+			return true
+		}
+		if i >= len(levels) || (f != "+" && f != levels[i]) {
+			return false
+		}
+	}
+	return len(filter) == len(levels)
+}
+
+// mqttJSONFix is one fix of a plain JSON message. The timestamp may be unix
+// seconds, unix milliseconds or RFC3339, as in the native grammar.
+type mqttJSONFix struct {
+	DeviceID     string      `json:"device_id"`
+	Latitude     *float64    `json:"latitude"`
+	Longitude    *float64    `json:"longitude"`
+	Timestamp    interface{} `json:"timestamp"`
+	Speed        *float64    `json:"speed"`
+	Heading      *float64    `json:"heading"`
+	Altitude     *float64    `json:"altitude"`
+	HDOP         *float64    `json:"hdop"`
+	Satellites   *int        `json:"satellites"`
+	Battery      *float64    `json:"battery_voltage"`
+	Accuracy     *float64    `json:"accuracy"`
+	BatteryLevel *float64    `json:"battery_level"`
+}
+
+func parseMQTTJSON(deviceID string, data []byte) (*Payload, error) {
+	var fixes []mqttJSONFix
+	if data[0] == '[' {
+		if err := json.Unmarshal(data, &fixes); err != nil {
+			return nil, err
+		}
+	} else {
+		var fix mqttJSONFix
+		if err := json.Unmarshal(data, &fix); err != nil {
+			return nil, err
+		}
+		fixes = append(fixes, fix)
+	}
+	if len(fixes) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+
+	payload := &Payload{DeviceID: deviceID}
+	for i, fix := range fixes {
+		if fix.DeviceID != "" && fix.DeviceID != deviceID {
+			return nil, fmt.Errorf("fix %d: device_id %q does not match topic", i, fix.DeviceID)
+		}
+		if fix.Latitude == nil || fix.Longitude == nil {
+			return nil, fmt.Errorf("fix %d: latitude and longitude are required", i)
+		}
+		if *fix.Latitude < -90 || *fix.Latitude > 90 || *fix.Longitude < -180 || *fix.Longitude > 180 {
+			return nil, fmt.Errorf("fix %d: out-of-range coordinates", i)
+		}
+
+		packet := &LocationPacket{
+			DeviceID:       deviceID,
+			Latitude:       *fix.Latitude,
+			Longitude:      *fix.Longitude,
+			Speed:          fix.Speed,
+			Heading:        fix.Heading,
+			Altitude:       fix.Altitude,
+			HDOP:           fix.HDOP,
+			Satellites:     fix.Satellites,
+			BatteryVoltage: fix.Battery,
+			Accuracy:       fix.Accuracy,
+			BatteryLevel:   fix.BatteryLevel,
+		}
+		switch ts := fix.Timestamp.(type) {
+		case nil:
+		case float64:
+			t, err := parseFixTime(strconv.FormatFloat(ts, 'f', -1, 64))
+			if err != nil {
+				return nil, fmt.Errorf("fix %d: %w", i, err)
+			}
+			packet.Timestamp = t
+		case string:
+			t, err := parseFixTime(ts)
+			if err != nil {
+				return nil, fmt.Errorf("fix %d: %w", i, err)
+			}
+			packet.Timestamp = t
+		default:
+			return nil, fmt.Errorf("fix %d: invalid timestamp", i)
+		}
+		if err := validateTelemetry(packet); err != nil {
+			return nil, fmt.Errorf("fix %d: %w", i, err)
+		}
+		payload.Fixes = append(payload.Fixes, packet)
+	}
+
+	if len(payload.Fixes) > 1 {
+		for _, packet := range payload.Fixes {
+			if packet.Timestamp.IsZero() {
+				return nil, fmt.Errorf("every fix of a batch needs a timestamp")
+			}
+		}
+		sort.SliceStable(payload.Fixes, func(i, j int) bool {
+			return payload.Fixes[i].Timestamp.Before(payload.Fixes[j].Timestamp)
+		})
+	}
+	return payload, nil
+}
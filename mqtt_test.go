@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func newTestMQTTSubscriber(t *testing.T, config *Config) *MQTTSubscriber {
+	t.Helper()
+	ingestor := &Ingestor{maxClockSkew: time.Hour, deadLetters: NewDeadLetterStore(nil, 0)}
+	ms, err := NewMQTTSubscriber(ingestor, nil, config)
+	if err != nil {
+		t.Fatalf("NewMQTTSubscriber: %v", err)
+	}
+	return ms
+}
+
+func TestNewMQTTSubscriberConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		qos      int
+		username string
+		topics   string
+		want     string
+	}{
+		{"negative qos", -1, "location-tracker", "trackers/+/location", "MQTT_QOS"},
+		{"qos above 2", 3, "location-tracker", "trackers/+/location", "MQTT_QOS"},
+		{"anonymous", 1, "", "trackers/+/location", "MQTT_USERNAME"},
+		{"no topics", 1, "location-tracker", " , ", "MQTT_TOPICS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMQTTSubscriber(nil, nil, &Config{
+				MQTTBroker:   "tcp://localhost:1883",
+				MQTTTopics:   tt.topics,
+				MQTTUsername: tt.username,
+				MQTTQoS:      tt.qos,
+			})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one mentioning %s", err, tt.want)
+			}
+		})
+	}
+
+	for qos := 0; qos <= 2; qos++ {
+		if _, err := NewMQTTSubscriber(nil, nil, &Config{
+			MQTTTopics: "trackers/+/location", MQTTUsername: "location-tracker", MQTTQoS: qos,
+		}); err != nil {
+			t.Errorf("qos %d rejected: %v", qos, err)
+		}
+	}
+}
+
+func TestMQTTTopicDeviceID(t *testing.T) {
+	ms := newTestMQTTSubscriber(t, &Config{
+		MQTTTopics:   "trackers/+/location, fleet/+/+/gps, legacy/#",
+		MQTTUsername: "location-tracker",
+	})
+
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{"trackers/truck-7/location", "truck-7"},
+		{"trackers/truck-7/status", ""},
+		{"trackers/truck-7", ""},
+		{"fleet/north/van-2/gps", "north"},
+		{"legacy/a/b/dev-9", "dev-9"},
+		{"other/truck-7/location", ""},
+	}
+	for _, tt := range tests {
+		if got := ms.topicDeviceID(tt.topic); got != tt.want {
+			t.Errorf("topicDeviceID(%q) = %q, want %q", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestParseMQTTJSON(t *testing.T) {
+	payload, err := parseMQTTJSON("truck-7", []byte(`[
+		{"latitude": 40.5, "longitude": -3.5, "timestamp": 1718000060, "speed": 12, "seq": 99},
+		{"latitude": 40.4, "longitude": -3.4, "timestamp": "2024-06-10T06:13:20Z", "device_id": "truck-7"}
+	]`))
+	if err != nil {
+		t.Fatalf("parseMQTTJSON: %v", err)
+	}
+	if payload.Sequence != nil {
+		t.Errorf("JSON seq %d reached the payload; unauthenticated messages must not touch the replay window", *payload.Sequence)
+	}
+	if len(payload.Fixes) != 2 {
+		t.Fatalf("got %d fixes, want 2", len(payload.Fixes))
+	}
+	// Sorted chronologically
+	if payload.Fixes[0].Latitude != 40.4 || payload.Fixes[1].Latitude != 40.5 {
+		t.Errorf("fixes not in chronological order: %v, %v", payload.Fixes[0].Timestamp, payload.Fixes[1].Timestamp)
+	}
+	for _, fix := range payload.Fixes {
+		if fix.DeviceID != "truck-7" {
+			t.Errorf("fix device id = %q, want truck-7", fix.DeviceID)
+		}
+	}
+
+	invalid := []struct {
+		name string
+		data string
+	}{
+		{"other device", `{"device_id": "truck-8", "latitude": 1, "longitude": 1}`},
+		{"missing longitude", `{"latitude": 1}`},
+		{"latitude out of range", `{"latitude": 91, "longitude": 1}`},
+		{"heading out of range", `{"latitude": 1, "longitude": 1, "heading": 360}`},
+		{"invalid timestamp", `{"latitude": 1, "longitude": 1, "timestamp": true}`},
+		{"batch without timestamps", `[{"latitude": 1, "longitude": 1}, {"latitude": 2, "longitude": 2}]`},
+		{"empty batch", `[]`},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseMQTTJSON("truck-7", []byte(tt.data)); err == nil {
+				t.Error("parse succeeded, want error")
+			}
+		})
+	}
+}
+
+// fakeMQTTMessage records whether it was acknowledged.
+type fakeMQTTMessage struct {
+	topic   string
+	payload []byte
+	acked   bool
+}
+
+func (m *fakeMQTTMessage) Duplicate() bool   { return false }
+func (m *fakeMQTTMessage) Qos() byte         { return 1 }
+func (m *fakeMQTTMessage) Retained() bool    { return false }
+func (m *fakeMQTTMessage) Topic() string     { return m.topic }
+func (m *fakeMQTTMessage) MessageID() uint16 { return 1 }
+func (m *fakeMQTTMessage) Payload() []byte   { return m.payload }
+func (m *fakeMQTTMessage) Ack()              { m.acked = true }
+
+func TestMQTTHandleMessageAck(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		data    string
+		outcome error
+		queued  bool
+		acked   bool
+	}{
+		{"stored", "trackers/truck-7/location", `{"latitude": 1, "longitude": 1}`, nil, true, true},
+		{"device not admitted", "trackers/truck-7/location", `{"latitude": 1, "longitude": 1}`, errDeviceNotAdmitted, true, true},
+		{"replay rejected", "trackers/truck-7/location", `{"latitude": 1, "longitude": 1}`, errSequenceReplayed, true, true},
+		{"no device id in topic", "trackers/truck-7", `{"latitude": 1, "longitude": 1}`, nil, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := newTestMQTTSubscriber(t, &Config{MQTTTopics: "trackers/+/location", MQTTUsername: "location-tracker"})
+			queued := false
+			ms.enqueue = func(payload *Payload) error {
+				queued = true
+				if payload.DeviceID != "truck-7" {
+					t.Errorf("payload device id = %q, want truck-7", payload.DeviceID)
+				}
+				payload.done(tt.outcome)
+				return nil
+			}
+
+			msg := &fakeMQTTMessage{topic: tt.topic, payload: []byte(tt.data)}
+			ms.handleMessage(nil, msg)
+			if queued != tt.queued {
+				t.Errorf("queued = %t, want %t", queued, tt.queued)
+			}
+			if msg.acked != tt.acked {
+				t.Errorf("acked = %t, want %t", msg.acked, tt.acked)
+			}
+		})
+	}
+}
+
+// ackSignal reports acknowledgements on a channel, for messages acknowledged
+// from another goroutine.
+type ackSignal struct {
+	fakeMQTTMessage
+	acks chan struct{}
+}
+
+func (m *ackSignal) Ack() { m.acks <- struct{}{} }
+
+func TestMQTTRetriesFailedStore(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+	}{
+		{"stored on a retry", 2},
+		{"dead-lettered after the last attempt", mqttRetryAttempts},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := newTestMQTTSubscriber(t, &Config{MQTTTopics: "trackers/+/location", MQTTUsername: "location-tracker"})
+			ms.retryBackoff = time.Millisecond
+
+			var mutex sync.Mutex
+			attempts := 0
+			ms.enqueue = func(payload *Payload) error {
+				mutex.Lock()
+				attempts++
+				failed := attempts <= tt.failures
+				mutex.Unlock()
+				if failed {
+					payload.done(errors.New("connection refused"))
+				} else {
+					payload.done(nil)
+				}
+				return nil
+			}
+
+			msg := &ackSignal{
+				fakeMQTTMessage: fakeMQTTMessage{topic: "trackers/truck-7/location", payload: []byte(`{"latitude": 1, "longitude": 1}`)},
+				acks:            make(chan struct{}, 1),
+			}
+			ms.handleMessage(nil, msg)
+
+			select {
+			case <-msg.acks:
+			case <-time.After(5 * time.Second):
+				t.Fatal("message never acknowledged: the broker would stop delivering once its inflight window fills")
+			}
+			ms.inflight.Wait()
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			want := tt.failures + 1
+			if want > mqttRetryAttempts {
+				want = mqttRetryAttempts
+			}
+			if attempts != want {
+				t.Errorf("enqueued %d times, want %d", attempts, want)
+			}
+		})
+	}
+}
+
+func TestMQTTRetryStopsOnShutdown(t *testing.T) {
+	ms := newTestMQTTSubscriber(t, &Config{MQTTTopics: "trackers/+/location", MQTTUsername: "location-tracker"})
+	ms.retryBackoff = time.Hour
+	ms.enqueue = func(payload *Payload) error {
+		payload.done(errors.New("connection refused"))
+		return nil
+	}
+
+	msg := &fakeMQTTMessage{topic: "trackers/truck-7/location", payload: []byte(`{"latitude": 1, "longitude": 1}`)}
+	ms.handleMessage(nil, msg)
+	close(ms.stop)
+
+	waited := make(chan struct{})
+	go func() {
+		ms.inflight.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending retry held up shutdown")
+	}
+	if msg.acked {
+		t.Error("message acknowledged on shutdown; it should be left for the next session")
+	}
+}
+
+// TestMQTTBrokerOrdering runs the subscriber against the broker named by
+// MQTT_TEST_BROKER. Its account (MQTT_TEST_USERNAME, MQTT_TEST_PASSWORD)
+// must be allowed to publish and subscribe under location-tracker-test/.
+func TestMQTTBrokerOrdering(t *testing.T) {
+	broker := os.Getenv("MQTT_TEST_BROKER")
+	if broker == "" {
+		t.Skip("MQTT_TEST_BROKER not set")
+	}
+	username, password := os.Getenv("MQTT_TEST_USERNAME"), os.Getenv("MQTT_TEST_PASSWORD")
+	if username == "" {
+		username = "location-tracker-test"
+	}
+
+	run := time.Now().UnixNano()
+	prefix := fmt.Sprintf("location-tracker-test/%d", run)
+	config := &Config{
+		MQTTBroker:   broker,
+		MQTTTopics:   prefix + "/+/location",
+		MQTTClientID: fmt.Sprintf("location-tracker-test-%d", run),
+		MQTTUsername: username,
+		MQTTPassword: password,
+		MQTTQoS:      1,
+	}
+	ms := newTestMQTTSubscriber(t, config)
+
+	var mutex sync.Mutex
+	received := make(map[string][]float64)
+	ms.enqueue = func(payload *Payload) error {
+		mutex.Lock()
+		for _, fix := range payload.Fixes {
+			received[payload.DeviceID] = append(received[payload.DeviceID], fix.Latitude)
+		}
+		mutex.Unlock()
+		payload.done(nil)
+		return nil
+	}
+	count := func(deviceID string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(received[deviceID])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		ms.Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+		// Drop the persistent session the subscriber left on the broker
+		cleanup := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).
+			SetClientID(config.MQTTClientID).SetUsername(username).SetPassword(password).
+			SetCleanSession(true))
+		if token := cleanup.Connect(); token.WaitTimeout(5*time.Second) && token.Error() == nil {
+			cleanup.Disconnect(0)
+		}
+	}()
+
+	publisher := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).
+		SetClientID(fmt.Sprintf("location-tracker-test-pub-%d", run)).
+		SetUsername(username).SetPassword(password))
+	if token := publisher.Connect(); !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+		t.Fatalf("connecting publisher to %s: %v", broker, token.Error())
+	}
+	defer publisher.Disconnect(0)
+
+	publish := func(deviceID, body string) {
+		t.Helper()
+		token := publisher.Publish(prefix+"/"+deviceID+"/location", 1, false, body)
+		if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			t.Fatalf("publish: %v", token.Error())
+		}
+	}
+
+	// Messages published before the subscription exists are lost, so wait
+	// until a probe gets through
+	deadline := time.Now().Add(15 * time.Second)
+	for count("probe") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber never received the probe message")
+		}
+		publish("probe", `{"latitude": 0, "longitude": 0}`)
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	const messages = 50
+	for i := 0; i < messages; i++ {
+		publish("truck-1", fmt.Sprintf(`{"latitude": %d, "longitude": 1}`, i))
+		publish("truck-2", fmt.Sprintf(`{"latitude": %d, "longitude": 2}`, i))
+	}
+	// Neither may be enqueued
+	publish("truck-1", `{"device_id": "truck-2", "latitude": 89, "longitude": 1}`)
+	publish("truck-1", `{"latitude": 1}`)
+	publish("truck-1", `{"latitude": 88, "longitude": 1}`)
+
+	deadline = time.Now().Add(15 * time.Second)
+	for count("truck-1") < messages+1 || count("truck-2") < messages {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d and %d messages, want %d and %d",
+				count("truck-1"), count("truck-2"), messages+1, messages)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, deviceID := range []string{"truck-1", "truck-2"} {
+		for i := 0; i < messages; i++ {
+			if got := received[deviceID][i]; got != float64(i) {
+				t.Fatalf("%s message %d has latitude %v: messages reordered", deviceID, i, got)
+			}
+		}
+	}
+	if last := received["truck-1"][messages]; last != 88 {
+		t.Errorf("last truck-1 message has latitude %v, want 88 (rejected messages were enqueued)", last)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NMEA 0183 payloads let cheap GPS modules forward their raw output instead of
+// pre-parsing it on the device:
+//
+//	nmea,<device>[,seq=<n>]
+//	$GPRMC,...*hh
+//	$GPGGA,...*hh
+//	$GPVTG,...*hh
+//
+// RMC, GGA and VTG from any talker (GP, GN, GL, GA, BD...) are understood;
+// other sentences are ignored. Sentences reporting the same UTC time are
+// merged into one fix, so a module's RMC+GGA+VTG burst becomes a single row,
+// and several bursts in one payload become a batch. Every sentence must carry
+// a valid checksum.
+
+const knotsToKmh = 1.852
+
+// nmeaFix collects what the sentences of one epoch said about it.
+type nmeaFix struct {
+	packet      *LocationPacket
+	timeOfDay   time.Duration
+	date        time.Time // from RMC; zero when only GGA was seen
+	hasPosition bool
+}
+
+func parseNMEA(data string, receivedAt time.Time) (*Payload, error) {
+	lines := strings.Split(data, "\n")
+	header := strings.Split(strings.TrimSpace(lines[0]), ",")
+	if len(header) < 2 || header[1] == "" {
+		return nil, fmt.Errorf("missing device id in header %q", lines[0])
+	}
+
+	payload := &Payload{DeviceID: header[1]}
+	var headerFix LocationPacket
+	if err := parseTelemetry(&headerFix, payload, header[2:]); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+
+	epochs := make(map[string]*nmeaFix)
+	var order []string
+	var last *nmeaFix
+
+	for i, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields, err := nmeaFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("sentence %d: %w", i+1, err)
+		}
+		if len(fields[0]) != 5 {
+			continue
+		}
+
+		sentence := fields[0][2:]
+		if sentence == "VTG" {
+			// VTG has no time of its own; it belongs to the preceding epoch
+			if last != nil {
+				if err := applyVTG(last.packet, fields); err != nil {
+					return nil, fmt.Errorf("sentence %d: %w", i+1, err)
+				}
+			}
+			continue
+		}
+		if sentence != "RMC" && sentence != "GGA" {
+			continue
+		}
+		if len(fields) < 2 || fields[1] == "" {
+			continue
+		}
+
+		epoch, ok := epochs[fields[1]]
+		if !ok {
+			tod, err := parseNMEATime(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("sentence %d: %w", i+1, err)
+			}
+			epoch = &nmeaFix{
+				packet:    &LocationPacket{DeviceID: payload.DeviceID},
+				timeOfDay: tod,
+			}
+			epochs[fields[1]] = epoch
+			order = append(order, fields[1])
+		}
+		last = epoch
+
+		if sentence == "RMC" {
+			err = applyRMC(epoch, fields)
+		} else {
+			err = applyGGA(epoch, fields)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sentence %d: %w", i+1, err)
+		}
+	}
+
+	// Dateless (GGA-only) epochs are dated relative to an RMC from the same
+	// payload when there is one, otherwise relative to the receive time.
+	reference := receivedAt.UTC()
+	for _, key := range order {
+		if epoch := epochs[key]; !epoch.date.IsZero() {
+			reference = epoch.date.Add(epoch.timeOfDay)
+			break
+		}
+	}
+
+	for _, key := range order {
+		epoch := epochs[key]
+		if !epoch.hasPosition {
+			continue
+		}
+		epoch.packet.Timestamp = nmeaTimestamp(epoch, reference)
+		if err := validateTelemetry(epoch.packet); err != nil {
+			return nil, err
+		}
+		payload.Fixes = append(payload.Fixes, epoch.packet)
+	}
+
+	if len(payload.Fixes) == 0 {
+		return nil, fmt.Errorf("no valid position in NMEA payload")
+	}
+	sort.SliceStable(payload.Fixes, func(i, j int) bool {
+		return payload.Fixes[i].Timestamp.Before(payload.Fixes[j].Timestamp)
+	})
+	return payload, nil
+}
+
+// nmeaFields verifies the checksum of "$<body>*hh" and splits the body.
+func nmeaFields(sentence string) ([]string, error) {
+	if !strings.HasPrefix(sentence, "$") {
+		return nil, fmt.Errorf("not an NMEA sentence: %q", sentence)
+	}
+	body, checksum, ok := strings.Cut(sentence[1:], "*")
+	if !ok || len(checksum) != 2 {
+		return nil, fmt.Errorf("missing checksum: %q", sentence)
+	}
+
+	want, err := strconv.ParseUint(checksum, 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum %q", checksum)
+	}
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	if sum != byte(want) {
+		return nil, fmt.Errorf("checksum mismatch: got %02X, want %02X", sum, want)
+	}
+
+	return strings.Split(body, ","), nil
+}
+
+// $xxRMC,hhmmss.ss,A,llll.ll,a,yyyyy.yy,a,speed(kn),course,ddmmyy,...
+func applyRMC(epoch *nmeaFix, fields []string) error {
+	if len(fields) < 10 {
+		return fmt.Errorf("short RMC sentence")
+	}
+	if fields[2] != "A" { // V = receiver warning, no fix
+		return nil
+	}
+
+	if err := setNMEAPosition(epoch, fields[3], fields[4], fields[5], fields[6]); err != nil {
+		return err
+	}
+
+	if fields[7] != "" {
+		knots, err := strconv.ParseFloat(fields[7], 64)
+		if err != nil {
+			return fmt.Errorf("invalid RMC speed %q", fields[7])
+		}
+		speed := knots * knotsToKmh
+		epoch.packet.Speed = &speed
+	}
+	if fields[8] != "" {
+		course, err := strconv.ParseFloat(fields[8], 64)
+		if err != nil {
+			return fmt.Errorf("invalid RMC course %q", fields[8])
+		}
+		epoch.packet.Heading = &course
+	}
+
+	date, err := time.Parse("020106", fields[9])
+	if err != nil {
+		return fmt.Errorf("invalid RMC date %q", fields[9])
+	}
+	epoch.date = date
+	return nil
+}
+
+// $xxGGA,hhmmss.ss,llll.ll,a,yyyyy.yy,a,quality,sats,hdop,alt,M,...
+func applyGGA(epoch *nmeaFix, fields []string) error {
+	if len(fields) < 10 {
+		return fmt.Errorf("short GGA sentence")
+	}
+
+	quality, err := strconv.Atoi(fields[6])
+	if err != nil {
+		return fmt.Errorf("invalid GGA fix quality %q", fields[6])
+	}
+	if quality == 0 { // no fix
+		return nil
+	}
+	epoch.packet.FixQuality = &quality
+
+	if !epoch.hasPosition {
+		if err := setNMEAPosition(epoch, fields[2], fields[3], fields[4], fields[5]); err != nil {
+			return err
+		}
+	}
+
+	if fields[7] != "" {
+		sats, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return fmt.Errorf("invalid GGA satellites %q", fields[7])
+		}
+		epoch.packet.Satellites = &sats
+	}
+	if fields[8] != "" {
+		hdop, err := strconv.ParseFloat(fields[8], 64)
+		if err != nil {
+			return fmt.Errorf("invalid GGA hdop %q", fields[8])
+		}
+		epoch.packet.HDOP = &hdop
+	}
+	if fields[9] != "" {
+		alt, err := strconv.ParseFloat(fields[9], 64)
+		if err != nil {
+			return fmt.Errorf("invalid GGA altitude %q", fields[9])
+		}
+		epoch.packet.Altitude = &alt
+	}
+	return nil
+}
+
+// $xxVTG,course,T,course,M,speed,N,speed,K,...
+func applyVTG(packet *LocationPacket, fields []string) error {
+	if len(fields) < 9 {
+		return fmt.Errorf("short VTG sentence")
+	}
+
+	if fields[1] != "" {
+		course, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid VTG course %q", fields[1])
+		}
+		packet.Heading = &course
+	}
+	if fields[7] != "" {
+		speed, err := strconv.ParseFloat(fields[7], 64)
+		if err != nil {
+			return fmt.Errorf("invalid VTG speed %q", fields[7])
+		}
+		packet.Speed = &speed
+	}
+	return nil
+}
+
+func setNMEAPosition(epoch *nmeaFix, lat, latHemi, lng, lngHemi string) error {
+	latitude, err := parseNMEACoordinate(lat, latHemi, 2)
+	if err != nil {
+		return err
+	}
+	longitude, err := parseNMEACoordinate(lng, lngHemi, 3)
+	if err != nil {
+		return err
+	}
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return fmt.Errorf("out-of-range coordinates: lat=%f, lng=%f", latitude, longitude)
+	}
+
+	epoch.packet.Latitude = latitude
+	epoch.packet.Longitude = longitude
+	epoch.hasPosition = true
+	return nil
+}
+
+// parseNMEACoordinate converts (d)ddmm.mmmm plus hemisphere to signed degrees.
+func parseNMEACoordinate(value, hemisphere string, degreeDigits int) (float64, error) {
+	if len(value) < degreeDigits+2 {
+		return 0, fmt.Errorf("invalid coordinate %q", value)
+	}
+	degrees, err1 := strconv.ParseFloat(value[:degreeDigits], 64)
+	minutes, err2 := strconv.ParseFloat(value[degreeDigits:], 64)
+	if err1 != nil || err2 != nil || minutes >= 60 {
+		return 0, fmt.Errorf("invalid coordinate %q", value)
+	}
+
+	coord := degrees + minutes/60
+	switch hemisphere {
+	case "N", "E":
+	case "S", "W":
+		coord = -coord
+	default:
+		return 0, fmt.Errorf("invalid hemisphere %q", hemisphere)
+	}
+	return coord, nil
+}
+
+// parseNMEATime reads hhmmss(.sss) as an offset from midnight UTC.
+func parseNMEATime(value string) (time.Duration, error) {
+	if len(value) < 6 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	h, err1 := strconv.Atoi(value[0:2])
+	m, err2 := strconv.Atoi(value[2:4])
+	sec, err3 := strconv.ParseFloat(value[4:], 64)
+	if err1 != nil || err2 != nil || err3 != nil || h > 23 || m > 59 || sec >= 61 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(math.Round(sec*1000))*time.Millisecond, nil
+}
+
+// nmeaTimestamp combines the epoch time with its RMC date, or with the date
+// of the reference time, picking the day that lands closest to the reference
+// so fixes either side of midnight UTC are not shifted by 24 hours.
+func nmeaTimestamp(epoch *nmeaFix, reference time.Time) time.Time {
+	if !epoch.date.IsZero() {
+		return epoch.date.Add(epoch.timeOfDay)
+	}
+
+	ts := time.Date(reference.Year(), reference.Month(), reference.Day(), 0, 0, 0, 0, time.UTC).Add(epoch.timeOfDay)
+	switch diff := ts.Sub(reference); {
+	case diff > 12*time.Hour:
+		ts = ts.AddDate(0, 0, -1)
+	case diff < -12*time.Hour:
+		ts = ts.AddDate(0, 0, 1)
+	}
+	return ts
+}
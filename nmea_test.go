@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The 12:35:19 burst is the reference example of the NMEA 0183 sentences
+// (gpsd's "NMEA Revealed"); the midnight sentences are the same GGA re-timed,
+// with their checksums recomputed.
+const (
+	nmeaRMC = "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"
+	nmeaGGA = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+	nmeaVTG = "$GPVTG,054.7,T,034.4,M,005.5,N,010.2,K*48"
+	nmeaGSV = "$GPGSV,3,1,11,03,03,111,00,04,15,270,00,06,01,010,00,13,06,292,00*74"
+
+	nmeaGGABeforeMidnight = "$GPGGA,235959.00,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*65"
+	nmeaGGAAfterMidnight  = "$GPGGA,000001.00,4807.040,N,01131.002,E,1,08,0.9,545.4,M,46.9,M,,*68"
+)
+
+func nmeaPayload(sentences ...string) string {
+	return strings.Join(append([]string{"nmea,gps-01,seq=7"}, sentences...), "\n")
+}
+
+func TestParseNMEAMergesEpoch(t *testing.T) {
+	payload, err := parseNMEA(nmeaPayload(nmeaRMC, nmeaGSV, nmeaGGA, nmeaVTG), time.Now())
+	if err != nil {
+		t.Fatalf("parseNMEA: %v", err)
+	}
+	if payload.DeviceID != "gps-01" || payload.Sequence == nil || *payload.Sequence != 7 {
+		t.Errorf("header parsed as device %q, seq %v", payload.DeviceID, payload.Sequence)
+	}
+	if len(payload.Fixes) != 1 {
+		t.Fatalf("got %d fixes, want RMC, GGA and VTG merged into 1", len(payload.Fixes))
+	}
+
+	fix := payload.Fixes[0]
+	if want := time.Date(1994, 3, 23, 12, 35, 19, 0, time.UTC); !fix.Timestamp.Equal(want) {
+		t.Errorf("timestamp = %s, want %s", fix.Timestamp, want)
+	}
+	if !approx(fix.Latitude, 48.1173) || !approx(fix.Longitude, 11.516667) {
+		t.Errorf("position = %f,%f, want 48.1173,11.516667", fix.Latitude, fix.Longitude)
+	}
+	// From GGA
+	if fix.Satellites == nil || *fix.Satellites != 8 || fix.HDOP == nil || *fix.HDOP != 0.9 ||
+		fix.Altitude == nil || *fix.Altitude != 545.4 || fix.FixQuality == nil || *fix.FixQuality != 1 {
+		t.Errorf("GGA fields not merged: %+v", fix)
+	}
+	// VTG follows the epoch and reports km/h directly, overriding RMC
+	if fix.Speed == nil || *fix.Speed != 10.2 || fix.Heading == nil || *fix.Heading != 54.7 {
+		t.Errorf("speed/heading = %v/%v, want VTG's 10.2/54.7", fix.Speed, fix.Heading)
+	}
+}
+
+func TestParseNMEAChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		sentence string
+		want     string
+	}{
+		{"wrong checksum", strings.Replace(nmeaRMC, "*6A", "*6B", 1), "checksum mismatch"},
+		{"corrupted body", strings.Replace(nmeaGGA, "4807.038", "4807.039", 1), "checksum mismatch"},
+		{"missing checksum", strings.TrimSuffix(nmeaGGA, "*47"), "missing checksum"},
+		{"invalid checksum", strings.Replace(nmeaGGA, "*47", "*G7", 1), "invalid checksum"},
+		{"not a sentence", "GPGGA,123519*47", "not an NMEA sentence"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseNMEA(nmeaPayload(nmeaRMC, tt.sentence), time.Now())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNMEAAcrossMidnight(t *testing.T) {
+	// Received just after midnight: the 23:59:59 fix is from the day before
+	received := time.Date(2024, 5, 2, 0, 0, 3, 0, time.UTC)
+	payload, err := parseNMEA(nmeaPayload(nmeaGGABeforeMidnight, nmeaGGAAfterMidnight), received)
+	if err != nil {
+		t.Fatalf("parseNMEA: %v", err)
+	}
+	want := []time.Time{
+		time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC),
+		time.Date(2024, 5, 2, 0, 0, 1, 0, time.UTC),
+	}
+	if len(payload.Fixes) != len(want) {
+		t.Fatalf("got %d fixes, want %d", len(payload.Fixes), len(want))
+	}
+	for i, fix := range payload.Fixes {
+		if !fix.Timestamp.Equal(want[i]) {
+			t.Errorf("fix %d at %s, want %s", i, fix.Timestamp, want[i])
+		}
+	}
+
+	// Received just before midnight, the 00:00:01 fix is from the next day
+	// (a receiver clock slightly ahead)
+	received = time.Date(2024, 5, 1, 23, 59, 58, 0, time.UTC)
+	payload, err = parseNMEA(nmeaPayload(nmeaGGAAfterMidnight), received)
+	if err != nil {
+		t.Fatalf("parseNMEA: %v", err)
+	}
+	if got := payload.Fixes[0].Timestamp; !got.Equal(want[1]) {
+		t.Errorf("fix at %s, want %s", got, want[1])
+	}
+}
+
+func TestParseNMEAWithoutFix(t *testing.T) {
+	// Receiver warning and fix quality 0: nothing to store
+	noFix := []string{
+		"$GPRMC,123519,V,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*7D",
+		"$GPGGA,123519,4807.038,N,01131.000,E,0,08,0.9,545.4,M,46.9,M,,*46",
+	}
+	if _, err := parseNMEA(nmeaPayload(noFix...), time.Now()); err == nil {
+		t.Error("parseNMEA succeeded without a valid position")
+	}
+}
+
+func approx(a, b float64) bool {
+	d := a - b
+	return d < 1e-6 && d > -1e-6
+}
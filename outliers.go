@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OutlierFilter catches fixes that cannot be right: the (0,0) "null island"
+// of receivers without a fix, fixes with an HDOP above OUTLIER_MAX_HDOP, and
+// jumps from the device's last plausible fix that would need a speed above
+// OUTLIER_MAX_SPEED (multipath, cold starts). Depending on OUTLIER_ACTION
+// they are stored with the failed check in "outlier" (flag) or moved to the
+// rejected_fixes table (reject); either way they are not broadcast as the
+// device's live position and stay available through /api/outliers.
+//
+// Only plausible, in-order fixes become the reference for the speed check.
+// A device whose fixes fail it outlierReanchorAfter times in a row is
+// re-anchored at the latest one, so a bad reference or a real relocation
+// (a tracker shipped by air) does not lock it out.
+const (
+	outlierActionOff    = "off"
+	outlierActionFlag   = "flag"
+	outlierActionReject = "reject"
+)
+
+const (
+	outlierNullIsland = "null_island"
+	outlierHDOP       = "hdop"
+	outlierSpeed      = "speed"
+)
+
+const outlierReanchorAfter = 5
+
+// nullIslandTolerance is how close to (0,0), in degrees, counts as no fix.
+const nullIslandTolerance = 1e-4
+
+type OutlierFilter struct {
+	db            *Database
+	locations     string
+	rejectedTable string
+	action        string
+	maxSpeed      float64 // km/h, 0 disables the check
+	maxHDOP       float64 // 0 disables the check
+
+	mutex   sync.Mutex
+	anchors map[string]*outlierAnchor
+}
+
+type outlierAnchor struct {
+	latitude, longitude float64
+	timestamp           time.Time
+	speedRejects        int
+}
+
+func NewOutlierFilter(db *Database, config *Config) (*OutlierFilter, error) {
+	switch config.OutlierAction {
+	case outlierActionOff, outlierActionFlag, outlierActionReject:
+	default:
+		return nil, fmt.Errorf("unknown outlier action %q (expected %s, %s or %s)",
+			config.OutlierAction, outlierActionOff, outlierActionFlag, outlierActionReject)
+	}
+
+	locations, rejected := "locations", "rejected_fixes"
+	if config.TablePrefix != "" {
+		locations = config.TablePrefix + "_locations"
+		rejected = config.TablePrefix + "_rejected_fixes"
+	}
+	return &OutlierFilter{
+		db:            db,
+		locations:     locations,
+		rejectedTable: rejected,
+		action:        config.OutlierAction,
+		maxSpeed:      config.OutlierMaxSpeed,
+		maxHDOP:       config.OutlierMaxHDOP,
+		anchors:       make(map[string]*outlierAnchor),
+	}, nil
+}
+
+// Check returns the plausibility check the fix fails, or "" if it passes.
+// Fixes must be checked in the order they are stored.
+func (of *OutlierFilter) Check(packet *LocationPacket) string {
+	if of.action == outlierActionOff {
+		return ""
+	}
+
+	if math.Abs(packet.Latitude) < nullIslandTolerance && math.Abs(packet.Longitude) < nullIslandTolerance {
+		return outlierNullIsland
+	}
+	if of.maxHDOP > 0 && packet.HDOP != nil && *packet.HDOP > of.maxHDOP {
+		return outlierHDOP
+	}
+	// History arriving late says nothing about where the device is now
+	if packet.OutOfOrder {
+		return ""
+	}
+
+	of.mutex.Lock()
+	defer of.mutex.Unlock()
+
+	anchor, ok := of.anchors[packet.DeviceID]
+	if !ok {
+		anchor = of.loadAnchor(packet.DeviceID)
+		of.anchors[packet.DeviceID] = anchor
+	}
+
+	if of.maxSpeed > 0 && anchor != nil {
+		// Sub-second gaps (or equal timestamps) are judged over one second
+		hours := math.Max(packet.Timestamp.Sub(anchor.timestamp).Hours(), 1.0/3600)
+		km := haversineKm(anchor.latitude, anchor.longitude, packet.Latitude, packet.Longitude)
+		if km/hours > of.maxSpeed {
+			anchor.speedRejects++
+			if anchor.speedRejects < outlierReanchorAfter {
+				return outlierSpeed
+			}
+			log.Printf("Re-anchoring %s after %d implausible jumps", packet.DeviceID, anchor.speedRejects)
+		}
+	}
+
+	of.anchors[packet.DeviceID] = &outlierAnchor{
+		latitude:  packet.Latitude,
+		longitude: packet.Longitude,
+		timestamp: packet.Timestamp,
+	}
+	return ""
+}
+
+// Forget drops the anchors of these devices, so they are reloaded from the
+// table after a failed store left the in-memory state ahead of it.
+func (of *OutlierFilter) Forget(deviceIDs []string) {
+	of.mutex.Lock()
+	defer of.mutex.Unlock()
+
+	for _, deviceID := range deviceIDs {
+		delete(of.anchors, deviceID)
+	}
+}
+
+// Reset drops every anchor.
+func (of *OutlierFilter) Reset() {
+	of.mutex.Lock()
+	defer of.mutex.Unlock()
+	of.anchors = make(map[string]*outlierAnchor)
+}
+
+// rejects reports whether outliers are kept out of the locations table.
+func (of *OutlierFilter) rejects() bool {
+	return of.action == outlierActionReject
+}
+
+// loadAnchor returns the newest plausible stored fix, or nil for a device
+// without one. A dwell row stands for its last fix, so the anchor takes its
+// last_seen: the speed check then measures from when the device was last
+// there, not from when it arrived.
+func (of *OutlierFilter) loadAnchor(deviceID string) *outlierAnchor {
+	var anchor outlierAnchor
+	err := of.db.QueryRow(fmt.Sprintf(`
+		SELECT ST_Y(location::geometry), ST_X(location::geometry), COALESCE(last_seen, timestamp)
+		FROM %s
+		WHERE device_id = $1 AND outlier IS NULL
+		ORDER BY COALESCE(last_seen, timestamp) DESC
+		LIMIT 1
+	`, of.locations), deviceID).Scan(&anchor.latitude, &anchor.longitude, &anchor.timestamp)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading last plausible fix for %s: %v", deviceID, err)
+		}
+		return nil
+	}
+	return &anchor
+}
+
+// haversineKm is the great-circle distance between two points.
+func haversineKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKm = 6371.0088
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLng := (lng2 - lng1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// API handlers
+
+type outlierFix struct {
+	*LocationPacket
+	Rejected bool `json:"rejected"`
+}
+
+// outliersHandler lists flagged and rejected fixes, newest first.
+func (api *APIServer) outliersHandler(w http.ResponseWriter, r *http.Request) {
+	filter := api.ingestor.outliers
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	condition := "outlier IS NOT NULL"
+	args := []interface{}{}
+	if deviceID := r.URL.Query().Get("device_id"); deviceID != "" {
+		condition += " AND device_id = $1"
+		args = append(args, deviceID)
+	}
+
+	fixes := []outlierFix{}
+	for _, source := range []struct {
+		table    string
+		rejected bool
+	}{{filter.locations, false}, {filter.rejectedTable, true}} {
+		rows, err := api.db.Query(fmt.Sprintf(`
+			SELECT %s FROM %s WHERE %s ORDER BY timestamp DESC LIMIT %d
+		`, locationColumns, source.table, condition, limit), args...)
+		if err != nil {
+			log.Printf("Error querying outliers: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var location LocationPacket
+			if err := scanLocation(rows, &location); err != nil {
+				log.Printf("Row scan error: %v", err)
+				continue
+			}
+			fixes = append(fixes, outlierFix{&location, source.rejected})
+		}
+		rows.Close()
+	}
+
+	sort.Slice(fixes, func(i, j int) bool { return fixes[i].Timestamp.After(fixes[j].Timestamp) })
+	if len(fixes) > limit {
+		fixes = fixes[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fixes)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IngestPipeline decouples reading packets from storing them. Every listener
+// hands its payloads to it, and they are queued to one of several workers,
+// chosen by device id so each device's packets stay in order (replay,
+// out-of-order and outlier checks, smoothing and compaction depend on it).
+// Each worker collects payloads until it has batchSize fixes or
+// flushInterval passes, then stores them with a single multi-row INSERT.
+//
+// UDP enqueues and moves on; listeners that answer the device with the
+// outcome (TCP, MQTT, HTTP) wait for it with Ingest.
+//
+// When a worker's queue is full, Enqueue blocks: the reader slows down rather
+// than dropping packets it has already accepted, and the stall is counted so
+// an undersized pipeline shows up in the stats. Close drains every queue
+// before returning.
+type IngestPipeline struct {
+	ingestor      *Ingestor
+	batchSize     int
+	flushInterval time.Duration
+	shards        []chan *Payload
+	wg            sync.WaitGroup
+
+	// Guards the shards against Enqueue after Close
+	mutex  sync.RWMutex
+	closed bool
+
+	enqueued     atomic.Uint64
+	queueFull    atomic.Uint64
+	batches      atomic.Uint64
+	storedFixes  atomic.Uint64
+	failed       atomic.Uint64
+	lastBatch    atomic.Int64
+	lastFlushDur atomic.Int64 // nanoseconds
+}
+
+// PipelineStats is the snapshot served by /api/ingest/pipeline.
+type PipelineStats struct {
+	Workers        int     `json:"workers"`
+	QueueCapacity  int     `json:"queue_capacity"`
+	QueueDepth     int     `json:"queue_depth"`
+	Enqueued       uint64  `json:"enqueued"`
+	QueueFull      uint64  `json:"queue_full"`
+	Batches        uint64  `json:"batches"`
+	StoredFixes    uint64  `json:"stored_fixes"`
+	FailedPackets  uint64  `json:"failed_packets"`
+	LastBatchFixes int64   `json:"last_batch_fixes"`
+	LastFlushMs    float64 `json:"last_flush_ms"`
+}
+
+func NewIngestPipeline(ingestor *Ingestor, workers, queueSize, batchSize int, flushInterval time.Duration) *IngestPipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = 200 * time.Millisecond
+	}
+	perShard := max(queueSize/workers, 1)
+
+	p := &IngestPipeline{
+		ingestor:      ingestor,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		shards:        make([]chan *Payload, workers),
+	}
+	for i := range p.shards {
+		p.shards[i] = make(chan *Payload, perShard)
+	}
+	return p
+}
+
+func (p *IngestPipeline) Start() {
+	log.Printf("✓ Ingestion pipeline: %d workers, queue %d, batches of %d fixes or %s",
+		len(p.shards), len(p.shards)*cap(p.shards[0]), p.batchSize, p.flushInterval)
+
+	for _, shard := range p.shards {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.worker(shard)
+		}()
+	}
+}
+
+var errPipelineClosed = errors.New("ingestion pipeline closed")
+
+// Enqueue hands a payload to its device's worker, which calls payload.done
+// with the outcome once it is handled. After Close it fails with
+// errPipelineClosed.
+func (p *IngestPipeline) Enqueue(payload *Payload) error {
+	h := fnv.New32a()
+	h.Write([]byte(payload.DeviceID))
+	shard := p.shards[h.Sum32()%uint32(len(p.shards))]
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.closed {
+		return errPipelineClosed
+	}
+
+	p.enqueued.Add(1)
+	select {
+	case shard <- payload:
+	default:
+		p.queueFull.Add(1)
+		shard <- payload
+	}
+	return nil
+}
+
+// Ingest enqueues a payload and waits until it is handled, for listeners
+// that answer the device with the outcome. That takes up to flushInterval
+// on a quiet pipeline.
+func (p *IngestPipeline) Ingest(payload *Payload) error {
+	result := make(chan error, 1)
+	payload.done = func(err error) { result <- err }
+	if err := p.Enqueue(payload); err != nil {
+		return err
+	}
+	return <-result
+}
+
+// Close stops accepting payloads and waits until everything queued is stored.
+func (p *IngestPipeline) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	for _, shard := range p.shards {
+		close(shard)
+	}
+	p.mutex.Unlock()
+
+	p.wg.Wait()
+	log.Println("Ingestion pipeline drained")
+}
+
+func (p *IngestPipeline) worker(queue <-chan *Payload) {
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Payload
+	fixes := 0
+	flush := func() {
+		if len(batch) > 0 {
+			p.flush(batch, fixes)
+			batch, fixes = nil, 0
+		}
+	}
+
+	for {
+		select {
+		case payload, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, payload)
+			fixes += len(payload.Fixes)
+			if fixes >= p.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (p *IngestPipeline) flush(batch []*Payload, fixes int) {
+	start := time.Now()
+	errs := p.ingestor.IngestBatch(batch)
+
+	stored := 0
+	for i, err := range errs {
+		payload := batch[i]
+		if err == nil {
+			stored += len(payload.Fixes)
+		} else {
+			p.failed.Add(1)
+		}
+		if payload.done != nil {
+			payload.done(err)
+		}
+	}
+
+	p.batches.Add(1)
+	p.storedFixes.Add(uint64(stored))
+	p.lastBatch.Store(int64(fixes))
+	p.lastFlushDur.Store(int64(time.Since(start)))
+}
+
+func (p *IngestPipeline) Stats() PipelineStats {
+	stats := PipelineStats{
+		Workers:        len(p.shards),
+		Enqueued:       p.enqueued.Load(),
+		QueueFull:      p.queueFull.Load(),
+		Batches:        p.batches.Load(),
+		StoredFixes:    p.storedFixes.Load(),
+		FailedPackets:  p.failed.Load(),
+		LastBatchFixes: p.lastBatch.Load(),
+		LastFlushMs:    float64(p.lastFlushDur.Load()) / float64(time.Millisecond),
+	}
+	for _, shard := range p.shards {
+		stats.QueueCapacity += cap(shard)
+		stats.QueueDepth += len(shard)
+	}
+	return stats
+}
+
+// pipelineStatsHandler reports queue depth and throughput of the ingestion
+// pipeline.
+func (api *APIServer) pipelineStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.pipeline.Stats())
+}
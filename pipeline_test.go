@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIngestPipelineClosed(t *testing.T) {
+	p := NewIngestPipeline(nil, 2, 8, 10, time.Millisecond)
+	p.Start()
+	p.Close()
+
+	payload := &Payload{DeviceID: "tracker-001", Fixes: []*LocationPacket{{}}}
+	if err := p.Enqueue(payload); !errors.Is(err, errPipelineClosed) {
+		t.Errorf("Enqueue after Close = %v, want errPipelineClosed", err)
+	}
+	if err := p.Ingest(payload); !errors.Is(err, errPipelineClosed) {
+		t.Errorf("Ingest after Close = %v, want errPipelineClosed", err)
+	}
+}
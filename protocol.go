@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ProtocolDecoder adapts a tracker protocol to the ingestion pipeline. TCP
+// listeners are configured with one decoder per port (or "auto", which picks
+// one from the first bytes of each connection), so supporting a new family
+// of trackers means adding a decoder here rather than touching the listeners.
+type ProtocolDecoder interface {
+	Name() string
+
+	// Detect reports whether the opening bytes of a connection belong to
+	// this protocol. head holds up to detectHeaderSize bytes.
+	Detect(head []byte) bool
+
+	// NewSession starts decoding one connection; source identifies the peer
+	// in logs.
+	NewSession(source string) DecoderSession
+}
+
+// DecoderSession holds the per-connection state of a protocol (e.g. the
+// device identity learned at login).
+type DecoderSession interface {
+	// ReadFrame reads the next protocol frame from the stream.
+	ReadFrame(r *bufio.Reader) ([]byte, error)
+
+	// Decode turns a frame into a payload. Frames that only drive the
+	// protocol (login, heartbeat) return a nil payload. Errors wrapping
+	// errCloseSession end the connection after Ack has been sent.
+	Decode(frame []byte) (*Payload, error)
+
+	// Ack builds the reply to the last decoded frame given the outcome of
+	// decoding and storing it, or nil when the device expects none.
+	Ack(err error) []byte
+}
+
+// errCloseSession is wrapped by decoders that want the connection dropped,
+// e.g. after refusing a login.
+var errCloseSession = errors.New("session closed by decoder")
+
+// detectHeaderSize is how many bytes "auto" listeners peek before choosing a
+// decoder. Every supported protocol's first frame is at least this long.
+const detectHeaderSize = 17
+
+// protocolDecoders is the registry of decoders a listener can be configured
+// with, keyed by the name used in TCP_LISTENERS.
+var protocolDecoders = map[string]func(ing *Ingestor) ProtocolDecoder{
+	"gt06":      func(*Ingestor) ProtocolDecoder { return gt06Decoder{} },
+	"native":    func(ing *Ingestor) ProtocolDecoder { return nativeDecoder{ingestor: ing} },
+	"teltonika": func(*Ingestor) ProtocolDecoder { return teltonikaDecoder{} },
+}
+
+// newDecoders resolves a protocol name to the decoders a listener tries.
+// "auto" returns every registered decoder, with native (which accepts any
+// frame) last.
+func newDecoders(name string, ing *Ingestor) ([]ProtocolDecoder, error) {
+	if name != "auto" {
+		factory, ok := protocolDecoders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown protocol %q", name)
+		}
+		return []ProtocolDecoder{factory(ing)}, nil
+	}
+
+	names := make([]string, 0, len(protocolDecoders))
+	for n := range protocolDecoders {
+		if n != "native" {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	decoders := make([]ProtocolDecoder, 0, len(protocolDecoders))
+	for _, n := range names {
+		decoders = append(decoders, protocolDecoders[n](ing))
+	}
+	return append(decoders, protocolDecoders["native"](ing)), nil
+}
+
+// ListenerSpec is one entry of TCP_LISTENERS.
+type ListenerSpec struct {
+	Port     string
+	Protocol string
+}
+
+// parseListenerSpecs reads "<port>:<protocol>[,<port>:<protocol>...]".
+func parseListenerSpecs(value string) ([]ListenerSpec, error) {
+	var specs []ListenerSpec
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		port, protocol, ok := strings.Cut(entry, ":")
+		if !ok || port == "" || protocol == "" {
+			return nil, fmt.Errorf("invalid listener %q, expected <port>:<protocol>", entry)
+		}
+		specs = append(specs, ListenerSpec{Port: port, Protocol: protocol})
+	}
+	return specs, nil
+}
+
+// nativeDecoder speaks this project's own length-prefixed, AES-GCM encrypted
+// framing (see TCPListener).
+type nativeDecoder struct {
+	ingestor *Ingestor
+}
+
+func (nativeDecoder) Name() string { return "native" }
+
+// Detect accepts anything; native is the fallback of "auto" listeners.
+func (nativeDecoder) Detect([]byte) bool { return true }
+
+func (d nativeDecoder) NewSession(source string) DecoderSession {
+	return &nativeSession{ingestor: d.ingestor, source: source}
+}
+
+type nativeSession struct {
+	ingestor *Ingestor
+	source   string
+	last     *Payload
+}
+
+func (s *nativeSession) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	return readFrame(r)
+}
+
+func (s *nativeSession) Decode(frame []byte) (*Payload, error) {
+	payload, err := s.ingestor.DecodePacket(frame, s.source)
+	s.last = payload
+	return payload, err
+}
+
+// Ack sends nothing back for the packet itself; once it is stored, pending
+// downlink commands are returned in a frame of the same format.
+func (s *nativeSession) Ack(err error) []byte {
+	payload := s.last
+	s.last = nil
+	if err != nil || payload == nil {
+		return nil
+	}
+
+	downlink := s.ingestor.commandDownlink(payload)
+	if downlink == nil {
+		return nil
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(downlink))), downlink...)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RateLimiter protects the UDP listener from floods. Datagrams are checked
+// against a token bucket per source IP before any decryption is attempted,
+// and decoded packets against a bucket per device id, so one misbehaving
+// tracker cannot crowd out the rest behind the same carrier NAT.
+//
+// Sources that keep sending packets no key opens are throttled to
+// throttleRate for a while rather than blocked. An automatic block was the
+// first design, but UDP source addresses are trivially spoofed, so anyone
+// could have blocked a carrier NAT address, and every tracker behind it, with
+// a few garbage datagrams; the throttle still caps what such a source costs
+// in decryption attempts. A source that had a new fix stored within
+// goodSourceTrust is never throttled, and such a fix lifts a throttle at
+// once; a packet that merely decrypts, such as a replayed capture, does not
+// count. Operators can still block and unblock addresses through the API.
+type RateLimiter struct {
+	sourceRate       float64
+	sourceBurst      float64
+	deviceRate       float64
+	deviceBurst      float64
+	throttleAfter    int
+	throttleDuration time.Duration
+	throttleRate     float64
+
+	mutex     sync.Mutex
+	sources   map[string]*sourceLimit
+	devices   map[string]*deviceLimit
+	overflow  tokenBucket
+	lastSweep time.Time
+	totals    rateLimitTotals
+}
+
+// maxTrackedSources bounds the per-IP state a spoofed-source flood can
+// create; sources beyond it share a single bucket until the next sweep.
+const maxTrackedSources = 65536
+
+// Idle sources and devices are forgotten after rateLimitIdle, unless the
+// source is still trusted for a good packet.
+const (
+	rateLimitSweepInterval = time.Minute
+	rateLimitIdle          = 10 * time.Minute
+)
+
+// goodSourceTrust is how long a stored fix exempts its source from
+// throttling; trackers that report less often are still let through by the
+// throttle and lift it with their first stored fix.
+const goodSourceTrust = time.Hour
+
+type rateLimitTotals struct {
+	Allowed        uint64 `json:"allowed"`
+	SourceLimited  uint64 `json:"source_limited"`
+	DeviceLimited  uint64 `json:"device_limited"`
+	Throttled      uint64 `json:"throttled"`
+	Blocked        uint64 `json:"blocked"`
+	DecryptFailure uint64 `json:"decrypt_failures"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time, rate, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type sourceLimit struct {
+	bucket   tokenBucket
+	lastSeen time.Time
+	lastGood time.Time
+	// Consecutive decryption failures since the last good packet
+	failures       int
+	throttle       tokenBucket
+	throttledUntil time.Time
+	blockedUntil   time.Time
+
+	Limited        uint64 `json:"limited"`
+	Throttled      uint64 `json:"throttled"`
+	Blocked        uint64 `json:"blocked"`
+	DecryptFailure uint64 `json:"decrypt_failures"`
+}
+
+type deviceLimit struct {
+	bucket   tokenBucket
+	lastSeen time.Time
+	Limited  uint64 `json:"limited"`
+}
+
+func NewRateLimiter(config *Config) *RateLimiter {
+	throttleRate := config.UDPThrottleRate
+	if throttleRate <= 0 {
+		// A throttle that lets nothing through would be a block again
+		log.Printf("UDP throttle rate %g out of range, using 1", throttleRate)
+		throttleRate = 1
+	}
+	return &RateLimiter{
+		sourceRate:       config.UDPSourceRate,
+		sourceBurst:      float64(max(config.UDPSourceBurst, 1)),
+		deviceRate:       config.UDPDeviceRate,
+		deviceBurst:      float64(max(config.UDPDeviceBurst, 1)),
+		throttleAfter:    config.UDPThrottleAfter,
+		throttleDuration: config.UDPThrottleDuration,
+		throttleRate:     throttleRate,
+		sources:          make(map[string]*sourceLimit),
+		devices:          make(map[string]*deviceLimit),
+	}
+}
+
+// AllowSource reports whether a datagram from ip may be processed.
+func (rl *RateLimiter) AllowSource(ip string) bool {
+	now := time.Now()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.sweep(now)
+
+	source := rl.sources[ip]
+	if source == nil {
+		if len(rl.sources) >= maxTrackedSources {
+			if rl.sourceRate > 0 && !rl.overflow.allow(now, rl.sourceRate, rl.sourceBurst) {
+				rl.totals.SourceLimited++
+				return false
+			}
+			rl.totals.Allowed++
+			return true
+		}
+		source = &sourceLimit{}
+		rl.sources[ip] = source
+	}
+	source.lastSeen = now
+
+	if now.Before(source.blockedUntil) {
+		source.Blocked++
+		rl.totals.Blocked++
+		return false
+	}
+	if now.Before(source.throttledUntil) && !source.throttle.allow(now, rl.throttleRate, 1) {
+		source.Throttled++
+		rl.totals.Throttled++
+		return false
+	}
+	if rl.sourceRate > 0 && !source.bucket.allow(now, rl.sourceRate, rl.sourceBurst) {
+		source.Limited++
+		rl.totals.SourceLimited++
+		return false
+	}
+	rl.totals.Allowed++
+	return true
+}
+
+// AllowDevice reports whether a decoded packet from deviceID may be stored.
+func (rl *RateLimiter) AllowDevice(deviceID string) bool {
+	if rl.deviceRate <= 0 {
+		return true
+	}
+	now := time.Now()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	device := rl.devices[deviceID]
+	if device == nil {
+		device = &deviceLimit{}
+		rl.devices[deviceID] = device
+	}
+	device.lastSeen = now
+
+	if !device.bucket.allow(now, rl.deviceRate, rl.deviceBurst) {
+		device.Limited++
+		rl.totals.DeviceLimited++
+		return false
+	}
+	return true
+}
+
+// RecordDecryptFailure counts a packet from ip that no key opened, and
+// throttles the source once throttleAfter of them arrive without a good
+// packet between. Sources that sent a good packet recently are exempt.
+func (rl *RateLimiter) RecordDecryptFailure(ip string) {
+	now := time.Now()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.totals.DecryptFailure++
+	source := rl.sources[ip]
+	if source == nil {
+		return
+	}
+	source.DecryptFailure++
+	if rl.throttleAfter <= 0 || now.Sub(source.lastGood) < goodSourceTrust || now.Before(source.throttledUntil) {
+		return
+	}
+	source.failures++
+	if source.failures >= rl.throttleAfter {
+		source.failures = 0
+		source.throttledUntil = now.Add(rl.throttleDuration)
+		source.throttle = tokenBucket{}
+		log.Printf("🐢 Throttling %s to %g packets/s for %s after %d decryption failures",
+			ip, rl.throttleRate, rl.throttleDuration, rl.throttleAfter)
+	}
+}
+
+// RecordSuccess trusts a source whose packet stored a new fix: its failure
+// streak is reset and any throttle lifted.
+func (rl *RateLimiter) RecordSuccess(ip string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if source := rl.sources[ip]; source != nil {
+		source.failures = 0
+		source.lastGood = time.Now()
+		source.throttledUntil = time.Time{}
+	}
+}
+
+// Block drops every datagram from ip for the given duration.
+func (rl *RateLimiter) Block(ip string, duration time.Duration) time.Time {
+	now := time.Now()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	source := rl.sources[ip]
+	if source == nil {
+		source = &sourceLimit{lastSeen: now}
+		rl.sources[ip] = source
+	}
+	source.blockedUntil = now.Add(duration)
+	return source.blockedUntil
+}
+
+// Unblock lifts a block, reporting whether ip was blocked.
+func (rl *RateLimiter) Unblock(ip string) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	source := rl.sources[ip]
+	if source == nil || !time.Now().Before(source.blockedUntil) {
+		return false
+	}
+	source.blockedUntil = time.Time{}
+	return true
+}
+
+// sweep forgets idle sources that are neither blocked, throttled nor
+// trusted, and idle devices. Callers hold the mutex.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+
+	for ip, source := range rl.sources {
+		if now.Sub(source.lastSeen) > rateLimitIdle && !now.Before(source.blockedUntil) &&
+			!now.Before(source.throttledUntil) && now.Sub(source.lastGood) >= goodSourceTrust {
+			delete(rl.sources, ip)
+		}
+	}
+	for deviceID, device := range rl.devices {
+		if now.Sub(device.lastSeen) > rateLimitIdle {
+			delete(rl.devices, deviceID)
+		}
+	}
+}
+
+type sourceLimitStats struct {
+	IP             string     `json:"ip"`
+	BlockedUntil   *time.Time `json:"blocked_until,omitempty"`
+	ThrottledUntil *time.Time `json:"throttled_until,omitempty"`
+	LastGood       *time.Time `json:"last_good,omitempty"`
+	*sourceLimit
+}
+
+type deviceLimitStats struct {
+	DeviceID string `json:"device_id"`
+	*deviceLimit
+}
+
+// RateLimitStats is the snapshot served by /api/ratelimit. Only sources and
+// devices that were limited, throttled, blocked or failed decryption are
+// listed.
+type RateLimitStats struct {
+	SourceRate       float64            `json:"source_rate"`
+	SourceBurst      float64            `json:"source_burst"`
+	DeviceRate       float64            `json:"device_rate"`
+	DeviceBurst      float64            `json:"device_burst"`
+	ThrottleAfter    int                `json:"throttle_after"`
+	ThrottleDuration string             `json:"throttle_duration"`
+	ThrottleRate     float64            `json:"throttle_rate"`
+	Totals           rateLimitTotals    `json:"totals"`
+	Sources          []sourceLimitStats `json:"sources"`
+	Devices          []deviceLimitStats `json:"devices"`
+}
+
+func (rl *RateLimiter) Stats() RateLimitStats {
+	now := time.Now()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	stats := RateLimitStats{
+		SourceRate:       rl.sourceRate,
+		SourceBurst:      rl.sourceBurst,
+		DeviceRate:       rl.deviceRate,
+		DeviceBurst:      rl.deviceBurst,
+		ThrottleAfter:    rl.throttleAfter,
+		ThrottleDuration: rl.throttleDuration.String(),
+		ThrottleRate:     rl.throttleRate,
+		Totals:           rl.totals,
+		Sources:          []sourceLimitStats{},
+		Devices:          []deviceLimitStats{},
+	}
+	for ip, source := range rl.sources {
+		blocked := now.Before(source.blockedUntil)
+		throttled := now.Before(source.throttledUntil)
+		if !blocked && !throttled && source.Limited == 0 && source.Throttled == 0 &&
+			source.Blocked == 0 && source.DecryptFailure == 0 {
+			continue
+		}
+		copied := *source
+		s := sourceLimitStats{IP: ip, sourceLimit: &copied}
+		if blocked {
+			until := source.blockedUntil
+			s.BlockedUntil = &until
+		}
+		if throttled {
+			until := source.throttledUntil
+			s.ThrottledUntil = &until
+		}
+		if !source.lastGood.IsZero() {
+			lastGood := source.lastGood
+			s.LastGood = &lastGood
+		}
+		stats.Sources = append(stats.Sources, s)
+	}
+	for deviceID, device := range rl.devices {
+		if device.Limited == 0 {
+			continue
+		}
+		copied := *device
+		stats.Devices = append(stats.Devices, deviceLimitStats{DeviceID: deviceID, deviceLimit: &copied})
+	}
+	sort.Slice(stats.Sources, func(i, j int) bool { return stats.Sources[i].IP < stats.Sources[j].IP })
+	sort.Slice(stats.Devices, func(i, j int) bool { return stats.Devices[i].DeviceID < stats.Devices[j].DeviceID })
+	return stats
+}
+
+// API handlers
+
+func (api *APIServer) rateLimitStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.rateLimiter.Stats())
+}
+
+func (api *APIServer) blockSourceHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IP       string `json:"ip"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ip := net.ParseIP(input.IP)
+	if ip == nil {
+		http.Error(w, "ip must be an IP address", http.StatusBadRequest)
+		return
+	}
+	duration := 24 * time.Hour
+	if input.Duration != "" {
+		d, err := time.ParseDuration(input.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "duration must be a positive Go duration (e.g. 1h)", http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+
+	until := api.rateLimiter.Block(ip.String(), duration)
+	log.Printf("🚫 Blocked %s until %s", ip, until.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ip":            ip.String(),
+		"blocked_until": until,
+	})
+}
+
+func (api *APIServer) unblockSourceHandler(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(mux.Vars(r)["ip"])
+	if ip == nil {
+		http.Error(w, "Invalid IP address", http.StatusBadRequest)
+		return
+	}
+	if !api.rateLimiter.Unblock(ip.String()) {
+		http.Error(w, "Address not blocked", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Unblocked %s", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter() *RateLimiter {
+	return NewRateLimiter(&Config{
+		UDPSourceRate:       1000,
+		UDPSourceBurst:      1000,
+		UDPThrottleAfter:    3,
+		UDPThrottleDuration: time.Minute,
+		UDPThrottleRate:     0.001,
+	})
+}
+
+// fail sends n undecryptable datagrams from ip.
+func fail(rl *RateLimiter, ip string, n int) {
+	for i := 0; i < n; i++ {
+		if rl.AllowSource(ip) {
+			rl.RecordDecryptFailure(ip)
+		}
+	}
+}
+
+func TestRateLimiterThrottlesFailingSource(t *testing.T) {
+	rl := newTestRateLimiter()
+	const ip = "198.51.100.7"
+
+	fail(rl, ip, 3)
+	// Throttled, not blocked: the bucket holds one datagram
+	if !rl.AllowSource(ip) {
+		t.Fatal("throttled source got nothing through")
+	}
+	if rl.AllowSource(ip) {
+		t.Fatal("throttled source not limited to the throttle rate")
+	}
+	if stats := rl.Stats(); stats.Totals.Throttled != 1 || stats.Totals.Blocked != 0 {
+		t.Errorf("throttled = %d, blocked = %d; want 1 and 0", stats.Totals.Throttled, stats.Totals.Blocked)
+	}
+
+	// A good packet lifts the throttle at once
+	rl.RecordSuccess(ip)
+	for i := 0; i < 10; i++ {
+		if !rl.AllowSource(ip) {
+			t.Fatalf("datagram %d dropped after a good packet", i)
+		}
+	}
+}
+
+func TestRateLimiterTrustsRecentlyGoodSource(t *testing.T) {
+	rl := newTestRateLimiter()
+	const ip = "203.0.113.1" // carrier NAT with real trackers behind it
+
+	if !rl.AllowSource(ip) {
+		t.Fatal("first datagram dropped")
+	}
+	rl.RecordSuccess(ip)
+
+	// Spoofed garbage in its name
+	fail(rl, ip, 100)
+	for i := 0; i < 10; i++ {
+		if !rl.AllowSource(ip) {
+			t.Fatalf("datagram %d from a recently good source dropped", i)
+		}
+	}
+	stats := rl.Stats()
+	if stats.Totals.Throttled != 0 {
+		t.Errorf("throttled = %d, want 0", stats.Totals.Throttled)
+	}
+	if stats.Totals.DecryptFailure != 100 {
+		t.Errorf("decrypt failures = %d, want 100", stats.Totals.DecryptFailure)
+	}
+}
+
+func TestRateLimiterManualBlock(t *testing.T) {
+	rl := newTestRateLimiter()
+	const ip = "192.0.2.9"
+
+	rl.Block(ip, time.Hour)
+	rl.RecordSuccess(ip)
+	if rl.AllowSource(ip) {
+		t.Fatal("blocked source let through")
+	}
+	if !rl.Unblock(ip) {
+		t.Fatal("Unblock reported the source was not blocked")
+	}
+	if !rl.AllowSource(ip) {
+		t.Fatal("unblocked source dropped")
+	}
+}
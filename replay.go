@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxReplayWindow is the widest reordering window the bitmap can track.
+const maxReplayWindow = 64
+
+// errReplayRejected is wrapped by Verify's rejections, so callers can tell
+// them from database failures worth retrying. errSequenceReplayed further
+// marks a sequence that was already stored, e.g. a resend after a lost ACK.
+var (
+	errReplayRejected   = errors.New("replay protection")
+	errSequenceReplayed = fmt.Errorf("%w: replayed sequence", errReplayRejected)
+)
+
+// ReplayGuard rejects packets whose sequence number was already accepted or
+// is too old to judge. Per device it keeps the highest accepted sequence and a
+// bitmap of the window below it (bit i set = highest-i accepted), the same
+// sliding-window scheme IPsec uses. State is persisted in device_sequences so
+// a restart does not reopen the window.
+//
+// Reserve and Commit are split so a packet that fails to store can be resent
+// by the device without being mistaken for a replay: Reserve holds the
+// sequence until Commit or Release, so a second copy arriving meanwhile on
+// another connection is turned away. Every instance shares device_sequences,
+// so Reserve reloads the device's state from it rather than trusting what
+// this instance last saw, and Commit merges into the stored row instead of
+// overwriting it.
+//
+// Once a device has had a sequenced packet accepted, its packets without a
+// sequence number are rejected, so captured legacy packets cannot be
+// replayed after its firmware started numbering them.
+type ReplayGuard struct {
+	db              *Database
+	window          uint64
+	requireSequence bool
+
+	mutex   sync.Mutex
+	states  map[string]*sequenceState
+	pending map[replaySeq]bool
+	rejects map[string]*replayRejects
+}
+
+type sequenceState struct {
+	Highest uint64 `json:"highest_sequence"`
+	bitmap  uint64
+	// Set while a Commit could not be persisted, so the accepted sequence
+	// is not forgotten when the next Reserve reloads the state
+	dirty bool
+}
+
+type replaySeq struct {
+	deviceID string
+	seq      uint64
+}
+
+type replayRejects struct {
+	Replayed uint64 `json:"replayed"`
+	Stale    uint64 `json:"stale"`
+	Missing  uint64 `json:"missing"`
+}
+
+func NewReplayGuard(db *Database, window int, requireSequence bool) *ReplayGuard {
+	if window < 1 || window > maxReplayWindow {
+		log.Printf("Replay window %d out of range, using %d", window, maxReplayWindow)
+		window = maxReplayWindow
+	}
+	return &ReplayGuard{
+		db:              db,
+		window:          uint64(window),
+		requireSequence: requireSequence,
+		states:          make(map[string]*sequenceState),
+		pending:         make(map[replaySeq]bool),
+		rejects:         make(map[string]*replayRejects),
+	}
+}
+
+// Reserve reports whether a packet with this sequence number may be accepted
+// and, if so, holds the sequence until Commit or Release. Packets without a
+// sequence pass unless REQUIRE_SEQUENCE is set or the device has sent
+// sequenced packets before. Sequences are stored as BIGINT, so values above
+// math.MaxInt64 are rejected.
+func (rg *ReplayGuard) Reserve(deviceID string, seq *uint64) error {
+	if seq != nil && *seq > math.MaxInt64 {
+		return fmt.Errorf("%w: sequence %d out of range", errReplayRejected, *seq)
+	}
+
+	loaded, err := rg.loadState(deviceID)
+	if err != nil {
+		return err
+	}
+
+	rg.mutex.Lock()
+	defer rg.mutex.Unlock()
+
+	state := loaded
+	if cached, ok := rg.states[deviceID]; ok && cached.dirty {
+		if loaded != nil {
+			cached.merge(loaded)
+		}
+		state = cached
+	} else if loaded != nil {
+		rg.states[deviceID] = loaded
+	} else {
+		delete(rg.states, deviceID)
+	}
+
+	if seq == nil {
+		switch {
+		case rg.requireSequence:
+			rg.rejectsFor(deviceID).Missing++
+			return fmt.Errorf("%w: packet without sequence number", errReplayRejected)
+		case state != nil:
+			rg.rejectsFor(deviceID).Missing++
+			return fmt.Errorf("%w: packet without sequence number from a device that sends them", errReplayRejected)
+		}
+		return nil
+	}
+
+	key := replaySeq{deviceID, *seq}
+	if rg.pending[key] {
+		// Not errSequenceReplayed: the first copy is not stored yet, so
+		// this one must not be acknowledged
+		return fmt.Errorf("%w: sequence %d is already being stored", errReplayRejected, *seq)
+	}
+	if state != nil && *seq <= state.Highest {
+		offset := state.Highest - *seq
+		if offset >= rg.window {
+			rg.rejectsFor(deviceID).Stale++
+			return fmt.Errorf("%w: stale sequence %d (highest accepted %d, window %d)", errReplayRejected, *seq, state.Highest, rg.window)
+		}
+		if state.bitmap&(1<<offset) != 0 {
+			rg.rejectsFor(deviceID).Replayed++
+			return fmt.Errorf("%w %d", errSequenceReplayed, *seq)
+		}
+	}
+	rg.pending[key] = true
+	return nil
+}
+
+// Release gives up a reservation whose packet failed to store, so the
+// device's resend is accepted.
+func (rg *ReplayGuard) Release(deviceID string, seq *uint64) {
+	if seq == nil {
+		return
+	}
+
+	rg.mutex.Lock()
+	defer rg.mutex.Unlock()
+	delete(rg.pending, replaySeq{deviceID, *seq})
+}
+
+// Commit records a sequence number as accepted once its packet is stored.
+func (rg *ReplayGuard) Commit(deviceID string, seq *uint64) {
+	if seq == nil || *seq > math.MaxInt64 {
+		return
+	}
+
+	rg.mutex.Lock()
+	delete(rg.pending, replaySeq{deviceID, *seq})
+	state, ok := rg.states[deviceID]
+	if !ok {
+		state = &sequenceState{Highest: *seq}
+		rg.states[deviceID] = state
+	}
+	state.merge(&sequenceState{Highest: *seq, bitmap: 1})
+	highest, bitmap := state.Highest, state.bitmap
+	rg.mutex.Unlock()
+
+	// Another instance may have moved the stored window meanwhile, so the
+	// row is merged with ours rather than replaced: the window never moves
+	// back and no accepted sequence is dropped from it
+	_, err := rg.db.Exec(`
+		INSERT INTO device_sequences (device_id, highest_sequence, window_bitmap, updated_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (device_id) DO UPDATE
+		SET highest_sequence = GREATEST(device_sequences.highest_sequence, EXCLUDED.highest_sequence),
+		    window_bitmap = CASE
+		        WHEN EXCLUDED.highest_sequence - device_sequences.highest_sequence >= 64
+		            THEN EXCLUDED.window_bitmap
+		        WHEN EXCLUDED.highest_sequence >= device_sequences.highest_sequence
+		            THEN EXCLUDED.window_bitmap | (device_sequences.window_bitmap
+		                << (EXCLUDED.highest_sequence - device_sequences.highest_sequence)::int)
+		        WHEN device_sequences.highest_sequence - EXCLUDED.highest_sequence >= 64
+		            THEN device_sequences.window_bitmap
+		        ELSE device_sequences.window_bitmap | (EXCLUDED.window_bitmap
+		            << (device_sequences.highest_sequence - EXCLUDED.highest_sequence)::int)
+		    END,
+		    updated_at = NOW()
+	`, deviceID, int64(highest), int64(bitmap))
+	if err != nil {
+		log.Printf("Error persisting sequence state for %s: %v", deviceID, err)
+	}
+
+	rg.mutex.Lock()
+	state.dirty = err != nil
+	rg.mutex.Unlock()
+}
+
+// merge folds another view of the same device's window into s.
+func (s *sequenceState) merge(other *sequenceState) {
+	if other.Highest > s.Highest {
+		s.bitmap = shiftWindow(s.bitmap, other.Highest-s.Highest) | other.bitmap
+		s.Highest = other.Highest
+	} else {
+		s.bitmap |= shiftWindow(other.bitmap, s.Highest-other.Highest)
+	}
+}
+
+// shiftWindow moves a bitmap n sequences down the window.
+func shiftWindow(bitmap, n uint64) uint64 {
+	if n >= maxReplayWindow {
+		return 0
+	}
+	return bitmap << n
+}
+
+// loadState reads a device's persisted window. A nil state means the device
+// has never had a sequenced packet accepted.
+func (rg *ReplayGuard) loadState(deviceID string) (*sequenceState, error) {
+	var highest, bitmap int64
+	err := rg.db.QueryRow(`
+		SELECT highest_sequence, window_bitmap FROM device_sequences WHERE device_id = $1
+	`, deviceID).Scan(&highest, &bitmap)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error loading sequence state: %w", err)
+	}
+	return &sequenceState{Highest: uint64(highest), bitmap: uint64(bitmap)}, nil
+}
+
+func (rg *ReplayGuard) rejectsFor(deviceID string) *replayRejects {
+	r, ok := rg.rejects[deviceID]
+	if !ok {
+		r = &replayRejects{}
+		rg.rejects[deviceID] = r
+	}
+	return r
+}
+
+// DropCache forgets the cached windows, so they are reloaded from
+// device_sequences. Windows whose Commit could not be persisted are kept,
+// since the table does not know about those sequences yet.
+func (rg *ReplayGuard) DropCache() {
+	rg.mutex.Lock()
+	defer rg.mutex.Unlock()
+
+	for deviceID, state := range rg.states {
+		if !state.dirty {
+			delete(rg.states, deviceID)
+		}
+	}
+}
+
+// Reset forgets a device's sequence state, e.g. after a firmware reflash
+// restarted its counter from zero.
+func (rg *ReplayGuard) Reset(deviceID string) error {
+	rg.mutex.Lock()
+	defer rg.mutex.Unlock()
+
+	if _, err := rg.db.Exec("DELETE FROM device_sequences WHERE device_id = $1", deviceID); err != nil {
+		return err
+	}
+	delete(rg.states, deviceID)
+	return nil
+}
+
+type replayDeviceStats struct {
+	DeviceID        string  `json:"device_id"`
+	HighestSequence *uint64 `json:"highest_sequence,omitempty"`
+	replayRejects
+}
+
+// Stats reports rejection counters since startup, per device.
+func (rg *ReplayGuard) Stats() []replayDeviceStats {
+	rg.mutex.Lock()
+	defer rg.mutex.Unlock()
+
+	stats := []replayDeviceStats{}
+	for deviceID, r := range rg.rejects {
+		s := replayDeviceStats{DeviceID: deviceID, replayRejects: *r}
+		if state, ok := rg.states[deviceID]; ok {
+			highest := state.Highest
+			s.HighestSequence = &highest
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].DeviceID < stats[j].DeviceID })
+	return stats
+}
+
+// API handlers
+
+func (api *APIServer) replayStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window":           api.replay.window,
+		"require_sequence": api.replay.requireSequence,
+		"devices":          api.replay.Stats(),
+		"timestamp":        time.Now(),
+	})
+}
+
+func (api *APIServer) resetSequenceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+	if err := api.replay.Reset(deviceID); err != nil {
+		log.Printf("Error resetting sequence state: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔄 Sequence state reset for device %s", deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
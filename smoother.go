@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TrackSmoother runs a constant-velocity Kalman filter per device over its
+// plausible, in-order fixes and stores the estimate in smoothed_location
+// next to the raw position, so a straight drive no longer zig-zags by the
+// receiver's noise and routes built from it do not overstate their length.
+//
+// The state is a position and a north/east velocity. Process noise models
+// random accelerations of SMOOTHING_ACCELERATION (m/s²); measurement noise
+// comes from the fix itself: the accuracy phone apps report, else HDOP times
+// a typical range error, else a fixed guess. Filters are kept in memory and
+// restart from the first fix after a restart or a gap of smootherMaxGap,
+// since a velocity estimated before a stop says nothing about what follows.
+//
+// Outliers and out-of-order fixes are stored without a smoothed position.
+type TrackSmoother struct {
+	enabled      bool
+	acceleration float64 // m/s²
+
+	mutex  sync.Mutex
+	tracks map[string]*kalmanTrack
+}
+
+const smootherMaxGap = 5 * time.Minute
+
+// Measurement noise, as one standard deviation in meters
+const (
+	smootherRangeError   = 5.0 // per unit of HDOP
+	smootherDefaultSigma = 10.0
+	smootherMinSigma     = 1.0
+)
+
+// smootherInitialSpeed is the uncertainty, in m/s, of a new track's velocity
+const smootherInitialSpeed = 30.0
+
+// metersPerDegree of latitude, on the sphere haversineKm uses
+const metersPerDegree = 6371008.8 * math.Pi / 180
+
+type kalmanTrack struct {
+	latitude, longitude float64
+	north, east         float64 // m/s
+	timestamp           time.Time
+
+	// Covariance of position (m) and velocity (m/s) along one axis. Both
+	// axes see the same noise, so they share it.
+	pp, pv, vv float64
+}
+
+func NewTrackSmoother(config *Config) *TrackSmoother {
+	return &TrackSmoother{
+		enabled:      config.Smoothing,
+		acceleration: config.SmoothingAcceleration,
+		tracks:       make(map[string]*kalmanTrack),
+	}
+}
+
+// Smooth feeds a fix to its device's filter and sets its smoothed position.
+// Fixes must be passed in the order they are stored.
+func (ts *TrackSmoother) Smooth(packet *LocationPacket) {
+	if !ts.enabled || packet.Outlier != "" || packet.OutOfOrder {
+		return
+	}
+
+	sigma := measurementSigma(packet)
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	track, ok := ts.tracks[packet.DeviceID]
+	dt := 0.0
+	if ok {
+		dt = packet.Timestamp.Sub(track.timestamp).Seconds()
+	}
+	if !ok || dt < 0 || dt > smootherMaxGap.Seconds() {
+		track = &kalmanTrack{
+			latitude:  packet.Latitude,
+			longitude: packet.Longitude,
+			timestamp: packet.Timestamp,
+			pp:        sigma * sigma,
+			vv:        smootherInitialSpeed * smootherInitialSpeed,
+		}
+		ts.tracks[packet.DeviceID] = track
+	} else {
+		track.predict(dt, ts.acceleration)
+		track.update(packet.Latitude, packet.Longitude, sigma*sigma)
+		track.timestamp = packet.Timestamp
+	}
+
+	latitude, longitude := track.latitude, track.longitude
+	packet.SmoothedLatitude = &latitude
+	packet.SmoothedLongitude = &longitude
+}
+
+// Forget drops the filters of these devices, which restart from their next
+// fix, after a failed store left them ahead of the table.
+func (ts *TrackSmoother) Forget(deviceIDs []string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for _, deviceID := range deviceIDs {
+		delete(ts.tracks, deviceID)
+	}
+}
+
+// Reset drops every filter.
+func (ts *TrackSmoother) Reset() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.tracks = make(map[string]*kalmanTrack)
+}
+
+// measurementSigma estimates a fix's horizontal error in meters.
+func measurementSigma(packet *LocationPacket) float64 {
+	sigma := smootherDefaultSigma
+	if packet.Accuracy != nil && *packet.Accuracy > 0 {
+		sigma = *packet.Accuracy
+	} else if packet.HDOP != nil && *packet.HDOP > 0 {
+		sigma = *packet.HDOP * smootherRangeError
+	}
+	return math.Max(sigma, smootherMinSigma)
+}
+
+// predict moves the estimate dt seconds ahead at its current velocity.
+func (t *kalmanTrack) predict(dt, acceleration float64) {
+	t.latitude += t.north * dt / metersPerDegree
+	t.longitude = wrapLongitude(t.longitude + t.east*dt/t.metersPerDegreeLng())
+
+	q := acceleration * acceleration
+	dt2 := dt * dt
+	t.pp += 2*dt*t.pv + dt2*t.vv + q*dt2*dt2/4
+	t.pv += dt*t.vv + q*dt2*dt/2
+	t.vv += q * dt2
+}
+
+// update corrects the estimate with a fix of variance r (m²).
+func (t *kalmanTrack) update(latitude, longitude, r float64) {
+	dNorth := (latitude - t.latitude) * metersPerDegree
+	dEast := wrapLongitude(longitude-t.longitude) * t.metersPerDegreeLng()
+
+	s := t.pp + r
+	kp, kv := t.pp/s, t.pv/s
+
+	t.latitude += kp * dNorth / metersPerDegree
+	t.longitude = wrapLongitude(t.longitude + kp*dEast/t.metersPerDegreeLng())
+	t.north += kv * dNorth
+	t.east += kv * dEast
+
+	t.vv -= kv * t.pv
+	t.pv *= 1 - kp
+	t.pp *= 1 - kp
+}
+
+func (t *kalmanTrack) metersPerDegreeLng() float64 {
+	// Clamped so the poles do not divide by zero
+	return metersPerDegree * math.Max(math.Cos(t.latitude*math.Pi/180), 1e-6)
+}
+
+func wrapLongitude(lng float64) float64 {
+	if lng > 180 {
+		return lng - 360
+	}
+	if lng < -180 {
+		return lng + 360
+	}
+	return lng
+}
+
+// Tracks the history, range and route endpoints can read, chosen with
+// ?track=. The smoothed track leaves out flagged outliers and falls back to
+// the raw position of fixes stored without a smoothed one.
+type track string
+
+const (
+	trackRaw      track = "raw"
+	trackSmoothed track = "smoothed"
+)
+
+// trackParam reads ?track=, raw by default.
+func trackParam(r *http.Request) (track, bool) {
+	switch t := track(r.URL.Query().Get("track")); t {
+	case "", trackRaw:
+		return trackRaw, true
+	case trackSmoothed:
+		return trackSmoothed, true
+	default:
+		return "", false
+	}
+}
+
+// columns is the select list to read rows of this track with scanLocation.
+func (t track) columns() string {
+	if t == trackSmoothed {
+		return smoothedLocationColumns
+	}
+	return locationColumns
+}
+
+// geometry is the position column of this track, as a geometry.
+func (t track) geometry() string {
+	if t == trackSmoothed {
+		return "COALESCE(smoothed_location, location)::geometry"
+	}
+	return "location::geometry"
+}
+
+// condition restricts a WHERE clause to the fixes that belong to this track.
+func (t track) condition() string {
+	if t == trackSmoothed {
+		return "outlier IS NULL"
+	}
+	return "TRUE"
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackSmootherForget(t *testing.T) {
+	ts := NewTrackSmoother(&Config{Smoothing: true, SmoothingAcceleration: 1})
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	ts.Smooth(&LocationPacket{DeviceID: "truck-7", Timestamp: start, Latitude: 40, Longitude: -3})
+	// Stands for a fix whose store failed: the filter moved towards it
+	ts.Smooth(&LocationPacket{DeviceID: "truck-7", Timestamp: start.Add(10 * time.Second), Latitude: 40.001, Longitude: -3})
+
+	ts.Forget([]string{"truck-7"})
+
+	retry := &LocationPacket{DeviceID: "truck-7", Timestamp: start.Add(10 * time.Second), Latitude: 40.001, Longitude: -3}
+	ts.Smooth(retry)
+	if *retry.SmoothedLatitude != retry.Latitude || *retry.SmoothedLongitude != retry.Longitude {
+		t.Errorf("retried fix smoothed to %v,%v; want a fresh track at %v,%v",
+			*retry.SmoothedLatitude, *retry.SmoothedLongitude, retry.Latitude, retry.Longitude)
+	}
+}
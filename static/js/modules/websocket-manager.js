@@ -44,6 +44,11 @@ export class WebSocketManager {
 
           // Try to parse as JSON
           const data = JSON.parse(event.data);
+
+          // Typed messages (e.g. command status changes) are not locations
+          if (data.type) {
+            return;
+          }
           this.tracker.handleLocationUpdate(data);
         } catch (error) {
           // Ignore non-JSON messages that aren't ping/pong
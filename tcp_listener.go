@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCPListener accepts tracker connections on one port and hands them to a
+// ProtocolDecoder. The native protocol carries the same encrypted packets as
+// UDPSniffer, for trackers behind NATs that mangle UDP or modems that only
+// speak TCP, each framed with a 2-byte big-endian length prefix:
+//
+//	[length uint16][encrypted packet (length bytes)]
+//
+// With several decoders ("auto") the first bytes of each connection pick one.
+type TCPListener struct {
+	pipeline       *IngestPipeline
+	port           string
+	decoders       []ProtocolDecoder
+	maxConnections int
+	readTimeout    time.Duration
+
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func NewTCPListener(pipeline *IngestPipeline, port string, decoders []ProtocolDecoder, maxConnections int, readTimeout time.Duration) *TCPListener {
+	return &TCPListener{
+		pipeline:       pipeline,
+		port:           port,
+		decoders:       decoders,
+		maxConnections: maxConnections,
+		readTimeout:    readTimeout,
+		conns:          make(map[net.Conn]struct{}),
+	}
+}
+
+func (tl *TCPListener) Run(ctx context.Context) {
+	log.Printf("Starting TCP listener service (%s)", tl.protocolName())
+
+	listener, err := net.Listen("tcp", ":"+tl.port)
+	if err != nil {
+		log.Printf("Error starting TCP listener: %v", err)
+		return
+	}
+
+	log.Printf("✓ TCP listening on port %s (%s, max %d connections)", tl.port, tl.protocolName(), tl.maxConnections)
+
+	var wg sync.WaitGroup
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		tl.closeAll()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("TCP accept error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if !tl.track(conn) {
+			log.Printf("⚠️  TCP connection limit reached (%d), rejecting %s", tl.maxConnections, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer tl.untrack(conn)
+			tl.handleConnection(conn)
+		}()
+	}
+
+	wg.Wait()
+	log.Println("TCP listener stopped")
+}
+
+// track registers a connection, refusing it when the limit is reached.
+func (tl *TCPListener) track(conn net.Conn) bool {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if len(tl.conns) >= tl.maxConnections {
+		return false
+	}
+	tl.conns[conn] = struct{}{}
+	return true
+}
+
+func (tl *TCPListener) untrack(conn net.Conn) {
+	tl.mutex.Lock()
+	delete(tl.conns, conn)
+	tl.mutex.Unlock()
+	conn.Close()
+}
+
+func (tl *TCPListener) protocolName() string {
+	if len(tl.decoders) > 1 {
+		return "auto"
+	}
+	return tl.decoders[0].Name()
+}
+
+func (tl *TCPListener) closeAll() {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	for conn := range tl.conns {
+		conn.Close()
+	}
+}
+
+func (tl *TCPListener) handleConnection(conn net.Conn) {
+	source := "tcp " + conn.RemoteAddr().String()
+	log.Printf("TCP client connected: %s", conn.RemoteAddr())
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(tl.readTimeout))
+	decoder := tl.detect(reader)
+	if decoder == nil {
+		log.Printf("TCP client disconnected: %s", conn.RemoteAddr())
+		return
+	}
+	session := decoder.NewSession(source)
+
+	for {
+		// The deadline covers the whole frame, so a peer that stalls halfway
+		// is dropped as well as an idle one
+		conn.SetReadDeadline(time.Now().Add(tl.readTimeout))
+
+		frame, err := session.ReadFrame(reader)
+		if err != nil {
+			var netErr net.Error
+			switch {
+			case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+			case errors.As(err, &netErr) && netErr.Timeout():
+				log.Printf("TCP client %s idle for %s, closing", conn.RemoteAddr(), tl.readTimeout)
+			default:
+				log.Printf("TCP read error from %s: %v", conn.RemoteAddr(), err)
+			}
+			break
+		}
+
+		payload, err := session.Decode(frame)
+		if err != nil {
+			log.Printf("❌ %s frame from %s rejected: %v", decoder.Name(), conn.RemoteAddr(), err)
+		} else if payload != nil {
+			err = tl.pipeline.Ingest(payload)
+		}
+
+		if reply := session.Ack(err); reply != nil {
+			conn.SetWriteDeadline(time.Now().Add(tl.readTimeout))
+			if _, werr := conn.Write(reply); werr != nil {
+				log.Printf("TCP write error to %s: %v", conn.RemoteAddr(), werr)
+				break
+			}
+		}
+		if errors.Is(err, errCloseSession) {
+			break
+		}
+	}
+
+	log.Printf("TCP client disconnected: %s", conn.RemoteAddr())
+}
+
+// detect picks the decoder for a connection from its first bytes. Listeners
+// with a single decoder skip the peek.
+func (tl *TCPListener) detect(reader *bufio.Reader) ProtocolDecoder {
+	if len(tl.decoders) == 1 {
+		return tl.decoders[0]
+	}
+
+	head, err := reader.Peek(detectHeaderSize)
+	if len(head) == 0 {
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("TCP read error while detecting protocol: %v", err)
+		}
+		return nil
+	}
+	for _, decoder := range tl.decoders {
+		if decoder.Detect(head) {
+			return decoder
+		}
+	}
+	return nil
+}
+
+// readFrame reads one length-prefixed packet.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(header[:])
+	if length == 0 {
+		return nil, errors.New("empty frame")
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
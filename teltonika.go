@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Teltonika FMxxx trackers over TCP. A connection opens with the IMEI, which
+// the server accepts with 0x01 (or refuses with 0x00):
+//
+//	[length uint16][IMEI, ASCII digits]
+//
+// after which the device sends AVL data packets:
+//
+//	[0x00000000][data length uint32]
+//	[codec id][record count][records...][record count]   <- data field
+//	[CRC-16/IBM of the data field, as uint32]
+//
+// and expects the number of accepted records back as a uint32. Codec 8 (0x08)
+// and Codec 8 Extended (0x8E) are supported; they differ only in the width
+// of the IO element ids and counts. Each record is:
+//
+//	[timestamp uint64 ms][priority uint8]
+//	[longitude int32][latitude int32]   (degrees × 10⁷)
+//	[altitude int16 m][angle uint16][satellites uint8][speed uint16 km/h]
+//	[IO elements]
+
+const (
+	teltonikaCodec8  = 0x08
+	teltonikaCodec8E = 0x8E
+
+	teltonikaMaxDataLength = 64 * 1024
+)
+
+// Well-known AVL IO ids mapped onto LocationPacket fields or named
+// attributes; everything else is kept as "io<id>".
+const (
+	teltonikaIOGSMSignal      = 21
+	teltonikaIOOdometer       = 16
+	teltonikaIOExternalPower  = 66
+	teltonikaIOBatteryVoltage = 67
+	teltonikaIOBatteryLevel   = 113
+	teltonikaIOPDOP           = 181
+	teltonikaIOHDOP           = 182
+	teltonikaIOIgnition       = 239
+	teltonikaIOMovement       = 240
+)
+
+type teltonikaDecoder struct{}
+
+func (teltonikaDecoder) Name() string { return "teltonika" }
+
+// Detect looks for the IMEI login: a short length followed by digits.
+func (teltonikaDecoder) Detect(head []byte) bool {
+	if len(head) < 3 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(head))
+	if length < 8 || length > 17 {
+		return false
+	}
+	for _, b := range head[2:min(len(head), 2+length)] {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (teltonikaDecoder) NewSession(source string) DecoderSession {
+	return &teltonikaSession{source: source}
+}
+
+type teltonikaSession struct {
+	source  string
+	imei    string
+	records int  // records in the last AVL packet
+	login   bool // last frame was the IMEI login
+}
+
+func (s *teltonikaSession) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	if s.imei == "" {
+		var header [2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint16(header[:])
+		if length == 0 || length > 32 {
+			return nil, fmt.Errorf("invalid IMEI length %d", length)
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return nil, errors.New("missing AVL preamble")
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 3 || length > teltonikaMaxDataLength {
+		return nil, fmt.Errorf("invalid AVL data length %d", length)
+	}
+
+	frame := make([]byte, length+4) // data field + CRC
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (s *teltonikaSession) Decode(frame []byte) (*Payload, error) {
+	s.records = 0
+	s.login = s.imei == ""
+
+	if s.login {
+		for _, b := range frame {
+			if b < '0' || b > '9' {
+				return nil, fmt.Errorf("%w: invalid IMEI %q", errCloseSession, frame)
+			}
+		}
+		s.imei = string(frame)
+		log.Printf("📟 Teltonika device %s logged in from %s", s.imei, s.source)
+		return nil, nil
+	}
+
+	data, crc := frame[:len(frame)-4], binary.BigEndian.Uint32(frame[len(frame)-4:])
+	if sum := crc16IBM(data); uint32(sum) != crc {
+		return nil, fmt.Errorf("CRC mismatch: got %04X, want %04X", sum, crc)
+	}
+
+	fixes, err := decodeTeltonikaAVL(s.imei, data)
+	if err != nil {
+		return nil, err
+	}
+	s.records = int(data[1])
+	return &Payload{DeviceID: s.imei, Fixes: fixes}, nil
+}
+
+func (s *teltonikaSession) Ack(err error) []byte {
+	if s.login {
+		if err != nil {
+			return []byte{0x00}
+		}
+		return []byte{0x01}
+	}
+	if err != nil {
+		// No acknowledgement makes the device resend the packet
+		return nil
+	}
+	reply := make([]byte, 4)
+	binary.BigEndian.PutUint32(reply, uint32(s.records))
+	return reply
+}
+
+// decodeTeltonikaAVL decodes the data field of an AVL packet. Records
+// without a GPS fix (no satellites, zero position) are dropped.
+func decodeTeltonikaAVL(imei string, data []byte) ([]*LocationPacket, error) {
+	r := &binaryReader{data: data}
+
+	codec := r.byte()
+	if r.err == nil && codec != teltonikaCodec8 && codec != teltonikaCodec8E {
+		return nil, fmt.Errorf("unsupported Teltonika codec 0x%02X", codec)
+	}
+	extended := codec == teltonikaCodec8E
+
+	count := int(r.byte())
+	var fixes []*LocationPacket
+	for i := 0; i < count && r.err == nil; i++ {
+		packet, err := decodeTeltonikaRecord(r, extended)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		if packet == nil {
+			continue
+		}
+		packet.DeviceID = imei
+		fixes = append(fixes, packet)
+	}
+
+	if trailer := int(r.byte()); r.err == nil && trailer != count {
+		return nil, fmt.Errorf("record count mismatch: %d vs %d", count, trailer)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(r.data))
+	}
+	return fixes, nil
+}
+
+func decodeTeltonikaRecord(r *binaryReader, extended bool) (*LocationPacket, error) {
+	timestamp := r.uint64()
+	priority := r.byte()
+	lng := int32(r.uint32())
+	lat := int32(r.uint32())
+	altitude := int16(r.uint16())
+	angle := r.uint16()
+	satellites := int(r.byte())
+	speed := r.uint16()
+
+	packet := &LocationPacket{
+		Timestamp:  time.UnixMilli(int64(timestamp)).UTC(),
+		Latitude:   float64(lat) / 1e7,
+		Longitude:  float64(lng) / 1e7,
+		Satellites: &satellites,
+		Attributes: map[string]interface{}{"priority": priority},
+	}
+	if alt := float64(altitude); satellites > 0 {
+		spd, hdg := float64(speed), float64(angle)
+		packet.Altitude, packet.Speed, packet.Heading = &alt, &spd, &hdg
+	}
+
+	if err := decodeTeltonikaIO(r, extended, packet); err != nil {
+		return nil, err
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if satellites == 0 && lat == 0 && lng == 0 {
+		return nil, nil
+	}
+	if packet.Latitude < -90 || packet.Latitude > 90 || packet.Longitude < -180 || packet.Longitude > 180 {
+		return nil, fmt.Errorf("out-of-range coordinates: lat=%f, lng=%f", packet.Latitude, packet.Longitude)
+	}
+	return packet, validateTelemetry(packet)
+}
+
+// decodeTeltonikaIO reads the IO element block: the event IO id, the total
+// element count, then groups of 1, 2, 4 and 8 byte values (and, in Codec 8E,
+// variable-length values). Ids and counts are one byte in Codec 8 and two in
+// Codec 8E.
+func decodeTeltonikaIO(r *binaryReader, extended bool, packet *LocationPacket) error {
+	readN := func() int {
+		if extended {
+			return int(r.uint16())
+		}
+		return int(r.byte())
+	}
+
+	eventID := readN()
+	total := readN()
+	if eventID != 0 {
+		packet.Attributes["event"] = eventID
+	}
+
+	seen := 0
+	for _, width := range []int{1, 2, 4, 8} {
+		n := readN()
+		for i := 0; i < n && r.err == nil; i++ {
+			id := readN()
+			var value uint64
+			switch width {
+			case 1:
+				value = uint64(r.byte())
+			case 2:
+				value = uint64(r.uint16())
+			case 4:
+				value = uint64(r.uint32())
+			case 8:
+				value = r.uint64()
+			}
+			applyTeltonikaIO(packet, id, value)
+		}
+		seen += n
+	}
+	if extended {
+		n := readN()
+		for i := 0; i < n && r.err == nil; i++ {
+			id := readN()
+			value := r.bytes(uint64(r.uint16()))
+			packet.Attributes[fmt.Sprintf("io%d", id)] = fmt.Sprintf("%x", value)
+		}
+		seen += n
+	}
+
+	if r.err == nil && seen != total {
+		return fmt.Errorf("IO element count mismatch: %d vs %d", seen, total)
+	}
+	return r.err
+}
+
+func applyTeltonikaIO(packet *LocationPacket, id int, value uint64) {
+	switch id {
+	case teltonikaIOBatteryVoltage:
+		volts := float64(value) / 1000
+		packet.BatteryVoltage = &volts
+	case teltonikaIOBatteryLevel:
+		level := float64(value)
+		packet.BatteryLevel = &level
+	case teltonikaIOHDOP:
+		hdop := float64(value) / 10
+		packet.HDOP = &hdop
+	case teltonikaIOPDOP:
+		packet.Attributes["pdop"] = float64(value) / 10
+	case teltonikaIOExternalPower:
+		packet.Attributes["power"] = float64(value) / 1000
+	case teltonikaIOIgnition:
+		packet.Attributes["ignition"] = value != 0
+	case teltonikaIOMovement:
+		packet.Attributes["motion"] = value != 0
+	case teltonikaIOGSMSignal:
+		packet.Attributes["gsm_signal"] = value
+	case teltonikaIOOdometer:
+		packet.Attributes["odometer"] = value
+	default:
+		packet.Attributes[fmt.Sprintf("io%d", id)] = value
+	}
+}
+
+// crc16IBM is CRC-16/ARC (poly 0xA001 reflected, init 0), which Teltonika
+// calls CRC-16/IBM.
+func crc16IBM(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
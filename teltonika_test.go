@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+// AVL packets captured from devices: the Codec 8 and 8E examples of the
+// Teltonika protocol documentation (records without a GPS fix) and an FM
+// device reporting from Vilnius.
+const (
+	teltonikaLogin = "000F333536333037303432343431303133" // IMEI 356307042441013
+
+	teltonikaCodec8NoFix      = "000000000000003608010000016B40D8EA30010000000000000000000000000000000105021503010101425E0F01F10000601A014E0000000000000000010000C7CF"
+	teltonikaCodec8TwoRecords = "000000000000004308020000016B40D57B480100000000000000000000000000000001010101000000000000016B40D5C198010000000000000000000000000000000101010101000000020000252C"
+	teltonikaCodec8EExample   = "000000000000004A8E010000016B412CEE000100000000000000000000000000000000010005000100010100010011001D00010010015E2C880002000B000000003544C87A000E000000001DD7E06A00000100002994"
+	teltonikaCodec8Vilnius    = "000000000000008c08010000013feb55ff74000f0ea850209a690000940000120000001e09010002000300040016014703f0001504c8000c0900730a00460b00501300464306d7440000b5000bb60007422e9f180000cd0386ce000107c700000000f10000601a46000001344800000bb84900000bb84a00000bb84c00000000024e0000000000000000cf00000000000000000100003fca"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad fixture %q: %v", s, err)
+	}
+	return b
+}
+
+// teltonikaExchange logs a session in, then feeds it one AVL packet and
+// returns the decoded payload and the acknowledgement sent back.
+func teltonikaExchange(t *testing.T, packet []byte) (*Payload, []byte, error) {
+	t.Helper()
+
+	session := teltonikaDecoder{}.NewSession("test")
+	r := bufio.NewReader(bytes.NewReader(append(mustHex(t, teltonikaLogin), packet...)))
+
+	frame, err := session.ReadFrame(r)
+	if err != nil {
+		t.Fatalf("reading login: %v", err)
+	}
+	if payload, err := session.Decode(frame); err != nil || payload != nil {
+		t.Fatalf("login: payload %v, error %v", payload, err)
+	}
+	if ack := session.Ack(nil); !bytes.Equal(ack, []byte{0x01}) {
+		t.Fatalf("login ack %x, want 01", ack)
+	}
+
+	frame, err = session.ReadFrame(r)
+	if err != nil {
+		t.Fatalf("reading AVL packet: %v", err)
+	}
+	payload, err := session.Decode(frame)
+	return payload, session.Ack(err), err
+}
+
+func TestTeltonikaDetect(t *testing.T) {
+	if !(teltonikaDecoder{}).Detect(mustHex(t, teltonikaLogin)) {
+		t.Error("IMEI login not detected")
+	}
+	if (teltonikaDecoder{}).Detect(mustHex(t, "78780D01012345678901234500018CDD0D0A")) {
+		t.Error("GT06 login detected as Teltonika")
+	}
+}
+
+func TestTeltonikaAVLPackets(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  string
+		records uint32
+		fixes   int
+	}{
+		{"codec 8 without fix", teltonikaCodec8NoFix, 1, 0},
+		{"codec 8 two records", teltonikaCodec8TwoRecords, 2, 0},
+		{"codec 8E", teltonikaCodec8EExample, 1, 0},
+		{"codec 8 with fix", teltonikaCodec8Vilnius, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, ack, err := teltonikaExchange(t, mustHex(t, tt.packet))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if payload.DeviceID != "356307042441013" {
+				t.Errorf("device id %q", payload.DeviceID)
+			}
+			if len(payload.Fixes) != tt.fixes {
+				t.Errorf("%d fixes, want %d", len(payload.Fixes), tt.fixes)
+			}
+
+			want := make([]byte, 4)
+			binary.BigEndian.PutUint32(want, tt.records)
+			if !bytes.Equal(ack, want) {
+				t.Errorf("ack %x, want %x", ack, want)
+			}
+		})
+	}
+}
+
+func TestTeltonikaRecordFields(t *testing.T) {
+	payload, _, err := teltonikaExchange(t, mustHex(t, teltonikaCodec8Vilnius))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	fix := payload.Fixes[0]
+
+	if want := time.UnixMilli(1374042849140).UTC(); !fix.Timestamp.Equal(want) {
+		t.Errorf("timestamp %s, want %s", fix.Timestamp, want)
+	}
+	if fix.Latitude != 54.6990336 || fix.Longitude != 25.2618832 {
+		t.Errorf("position %f,%f, want 54.6990336,25.2618832", fix.Latitude, fix.Longitude)
+	}
+	if *fix.Altitude != 148 || *fix.Satellites != 18 || *fix.Speed != 0 || *fix.Heading != 0 {
+		t.Errorf("altitude %v, satellites %v, speed %v, heading %v, want 148, 18, 0, 0",
+			*fix.Altitude, *fix.Satellites, *fix.Speed, *fix.Heading)
+	}
+	if fix.HDOP == nil || *fix.HDOP != 0.7 {
+		t.Errorf("hdop %v, want 0.7", fix.HDOP)
+	}
+	if fix.BatteryVoltage == nil || *fix.BatteryVoltage != 1.751 {
+		t.Errorf("battery %v, want 1.751", fix.BatteryVoltage)
+	}
+	if fix.Attributes["power"] != 11.935 || fix.Attributes["gsm_signal"] != uint64(4) || fix.Attributes["motion"] != false {
+		t.Errorf("attributes %v", fix.Attributes)
+	}
+}
+
+func TestTeltonikaCorruptPackets(t *testing.T) {
+	// withCRC recomputes the CRC after a field was changed on purpose
+	withCRC := func(packet []byte) []byte {
+		data := packet[8 : len(packet)-4]
+		binary.BigEndian.PutUint32(packet[len(packet)-4:], uint32(crc16IBM(data)))
+		return packet
+	}
+
+	tests := []struct {
+		name   string
+		modify func([]byte) []byte
+	}{
+		{"CRC mismatch", func(p []byte) []byte { p[len(p)-1] ^= 0xFF; return p }},
+		{"corrupted data", func(p []byte) []byte { p[20] ^= 0x01; return p }},
+		{"record count mismatch", func(p []byte) []byte { p[len(p)-5] = 2; return withCRC(p) }},
+		{"unsupported codec", func(p []byte) []byte { p[8] = 0x10; return withCRC(p) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := tt.modify(mustHex(t, teltonikaCodec8NoFix))
+			_, ack, err := teltonikaExchange(t, packet)
+			if err == nil {
+				t.Fatal("decode succeeded")
+			}
+			// Without an acknowledgement the device resends the packet
+			if ack != nil {
+				t.Errorf("ack %x for a rejected packet", ack)
+			}
+		})
+	}
+}
+
+func TestTeltonikaInvalidLogin(t *testing.T) {
+	session := teltonikaDecoder{}.NewSession("test")
+	r := bufio.NewReader(bytes.NewReader(append([]byte{0x00, 0x05}, "12a45"...)))
+
+	frame, err := session.ReadFrame(r)
+	if err != nil {
+		t.Fatalf("reading login: %v", err)
+	}
+	_, err = session.Decode(frame)
+	if !errors.Is(err, errCloseSession) {
+		t.Fatalf("error %v, want errCloseSession", err)
+	}
+	if ack := session.Ack(err); !bytes.Equal(ack, []byte{0x00}) {
+		t.Errorf("ack %x, want 00", ack)
+	}
+}